@@ -7,4 +7,48 @@ export DBCONN="host=doxmon.cloudapp.net port=5432 dbname=kiron user=postgres pas
 # marco local
 #export DBCONN="host=localhost port=5432 dbname=kiron_local user=postgres password=postgres sslmode=disable"
 
+# no database at all, everything is lost on restart
+#export KIRON_REPOSITORY=memory
+
+# where uploaded documents are kept
+export KIRON_BLOB_DIR=/var/lib/kiron/blobs
+#export KIRON_BLOBSTORE=s3
+#export KIRON_S3_ENDPOINT=http://localhost:9000
+#export KIRON_S3_BUCKET=kiron
+#export KIRON_S3_ACCESS_KEY=
+#export KIRON_S3_SECRET_KEY=
+
+# virus scanning of uploads
+#export KIRON_CLAMD_ADDRESS=localhost:3310
+
+# master keys for the documents and applications, id:base64 of 32 random bytes, current key first
+#export KIRON_MASTER_KEYS=2017:$(cat /etc/kiron/master-2017.key)
+# blind indexes of the encrypted application fields, needed with the master keys
+#export KIRON_INDEX_KEY=$(cat /etc/kiron/index.key)
+
+# purge personal data nobody needs any more, see README
+#export KIRON_RETAIN_REJECTED_DOCUMENTS_DAYS=90
+#export KIRON_RETAIN_INACTIVE_APPLICANTS_MONTHS=24
+#export KIRON_RETENTION_DRY_RUN=true
+
+# sessions last as long as they are refreshed within the refresh token lifetime
+#export KIRON_ACCESS_TOKEN_LIFETIME=1h
+#export KIRON_REFRESH_TOKEN_LIFETIME=168h
+# tokens are stored hashed with this key, base64 of 32 random bytes
+export KIRON_TOKEN_KEY=$(cat /etc/kiron/token.key)
+# sign access tokens instead of storing them, id:base64 of 32 random bytes, current key first
+#export KIRON_SIGNING_KEYS=2017:$(cat /etc/kiron/signing-2017.key)
+
+# links in mails start with this
+#export KIRON_PUBLIC_URL=https://kiron.example.com
+#export KIRON_MAIL_FROM=kiron@example.com
+# mails are sent with a mail server
+export KIRON_MAILER=smtp
+export KIRON_SMTP_ADDRESS=localhost:587
+#export KIRON_SMTP_USERNAME=
+#export KIRON_SMTP_PASSWORD=
+# or written below KIRON_MAIL_DIR on development machines
+#export KIRON_MAILER=file
+#export KIRON_MAIL_DIR=/tmp/kiron-mail
+
 kiron
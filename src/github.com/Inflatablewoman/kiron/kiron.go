@@ -13,6 +13,33 @@ import (
 
 func main() {
 
+	// kiron migrate ... manages the database schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := server.Migrate(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// kiron applications ... maintains the stored applications and exits
+	if len(os.Args) > 1 && os.Args[1] == "applications" {
+		err := server.Applications(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Applications command failed: %v", err)
+		}
+		return
+	}
+
+	// kiron documents ... maintains the stored documents and exits
+	if len(os.Args) > 1 && os.Args[1] == "documents" {
+		err := server.Documents(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Documents command failed: %v", err)
+		}
+		return
+	}
+
 	host := os.Getenv("KIRON_HOST")
 	if host == "" {
 		host = "localhost"
@@ -32,6 +59,31 @@ func main() {
 		log.Fatalf("Unable to connect to database %v", err)
 	}
 
+	err = server.InitBlobStore()
+	if err != nil {
+		log.Fatalf("Unable to open blob store %v", err)
+	}
+
+	err = server.InitSessions()
+	if err != nil {
+		log.Fatalf("Unable to configure sessions %v", err)
+	}
+
+	err = server.InitMailer()
+	if err != nil {
+		log.Fatalf("Unable to configure mailer %v", err)
+	}
+
+	janitor, err := server.StartTokenJanitor()
+	if err != nil {
+		log.Fatalf("Unable to start token janitor %v", err)
+	}
+
+	retention, err := server.StartRetention()
+	if err != nil {
+		log.Fatalf("Unable to start retention policy %v", err)
+	}
+
 	// Create handlers
 	mux := tigertonic.NewTrieServeMux()
 	server.RegisterHTTPHandlers(mux)
@@ -47,8 +99,12 @@ func main() {
 			log.Fatalf("Kiron Service Fatal: %v", err)
 		}
 	}()
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	log.Println(<-ch)
 	server.Close()
+
+	// Let the background tasks finish what they are doing
+	janitor.Stop()
+	retention.Stop()
 }
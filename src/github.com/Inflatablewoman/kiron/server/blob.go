@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// blobs holds the contents of the documents
+var blobs BlobStore
+
+// BlobStore keeps the contents of documents outside the database.  Keys are
+// slash separated paths made of letters, digits, dots, dashes and underscores.
+type BlobStore interface {
+	// Put stores size bytes read from contents under key, replacing what was there
+	Put(key string, contents io.Reader, size int64) error
+	// Get returns the contents stored under key or ErrNotFound
+	Get(key string) (Blob, error)
+	// Delete removes key.  Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// Blob is stored contents that can be read from any position, so parts of it
+// can be served without reading the rest
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// ErrInvalidBlobKey is returned for keys that could escape the store
+var ErrInvalidBlobKey = errors.New("Invalid blob key")
+
+var blobKeySegment = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// validBlobKey returns true for relative paths without . or .. segments
+func validBlobKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if !blobKeySegment.MatchString(segment) || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newBlobKey returns a new random key for a document of the application
+func newBlobKey(applicationID int) (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("documents/%d/%s", applicationID, hex.EncodeToString(random)), nil
+}
+
+// InitBlobStore will create the blob store selected by KIRON_BLOBSTORE.  Use
+// "s3" for an S3 compatible service, "memory" for tests and anything else
+// for a directory on the local disk.
+func InitBlobStore() error {
+	err := initDocumentLimits()
+	if err != nil {
+		return err
+	}
+
+	err = initScanner()
+	if err != nil {
+		return err
+	}
+
+	store, err := newBlobStore()
+	if err != nil {
+		return err
+	}
+
+	blobs = store
+	return nil
+}
+
+// newBlobStore returns the blob store configured in the environment
+func newBlobStore() (BlobStore, error) {
+	switch os.Getenv("KIRON_BLOBSTORE") {
+	case "s3":
+		return newS3BlobStoreFromEnv()
+	case "memory":
+		log.Println("Using in-memory blob store.  Documents will be lost on restart.")
+		return newMemoryBlobStore(), nil
+	}
+
+	dir := os.Getenv("KIRON_BLOB_DIR")
+	if dir == "" {
+		dir = "blobs"
+	}
+
+	return newFileBlobStore(dir)
+}
+
+// putSpooled stores contents of unknown size under key.  The stores need the
+// size up front, so the contents are written to a temporary file first.  It
+// returns errDocumentTooLarge if there are more than limit bytes.
+func putSpooled(store BlobStore, key string, contents io.Reader, limit int64) error {
+	spool, err := ioutil.TempFile("", "kiron-upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.LimitReader(contents, limit+1))
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return errDocumentTooLarge
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(key, spool, size)
+}
+
+// fileBlobStore keeps every blob in a file below dir
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Storing documents in %s", dir)
+
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (s *fileBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *fileBlobStore) Put(key string, contents io.Reader, size int64) (err error) {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see half a blob
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+
+	written, err := io.Copy(file, contents)
+	if err == nil && written != size {
+		err = fmt.Errorf("Expected %d bytes for blob %s, got %d", size, key, written)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (s *fileBlobStore) Get(key string) (Blob, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (s *fileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// memoryBlobStore keeps the blobs in a map.  It is meant for tests and local
+// development, nothing survives a restart.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memoryBlobStore) Put(key string, contents io.Reader, size int64) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	blob, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+	if int64(len(blob)) != size {
+		return fmt.Errorf("Expected %d bytes for blob %s, got %d", size, key, len(blob))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[key] = blob
+
+	return nil
+}
+
+func (s *memoryBlobStore) Get(key string) (Blob, error) {
+	if !validBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// Stored blobs are never modified, only replaced
+	return memoryBlob{bytes.NewReader(blob)}, nil
+}
+
+// memoryBlob is a stored blob being read
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (memoryBlob) Close() error {
+	return nil
+}
+
+func (s *memoryBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, key)
+
+	return nil
+}
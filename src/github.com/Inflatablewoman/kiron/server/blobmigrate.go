@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Documents runs a document maintenance command against the postgres
+// database in DBCONN and the blob store configured in the environment.
+//
+//	migrate-blobs  move contents still stored in the documents table to the blob store
+//	scan           scan the documents that are still pending
+//	rotate-keys    wrap all data keys with the first of KIRON_MASTER_KEYS and
+//	               encrypt documents stored unencrypted
+func Documents(args []string) error {
+	if len(args) == 0 || (args[0] != "migrate-blobs" && args[0] != "scan" && args[0] != "rotate-keys") {
+		return errors.New("Usage: kiron documents migrate-blobs|scan|rotate-keys")
+	}
+
+	db, err := openPostgres()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store, err := newBlobStore()
+	if err != nil {
+		return err
+	}
+
+	err = initMasterKeys()
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "rotate-keys" {
+		if masterKeys == nil {
+			return errors.New("KIRON_MASTER_KEYS is not set")
+		}
+
+		rotated, err := rotateKeys(postgresRepository{db: db}, store, masterKeys)
+		log.Printf("Rotated the keys of %d documents to master key %s", rotated, masterKeys.current)
+
+		return err
+	}
+
+	if args[0] == "scan" {
+		err = initScanner()
+		if err != nil {
+			return err
+		}
+
+		scanned, err := scanPendingDocuments(postgresRepository{db: db}, store, documentScanner)
+		log.Printf("Scanned %d documents", scanned)
+
+		return err
+	}
+
+	moved, err := migrateBlobs(db, store)
+	log.Printf("Moved %d documents to the blob store", moved)
+
+	return err
+}
+
+// migrateBlobs moves the contents of every document without a storage key to
+// the store, one document at a time.  It can be stopped and run again at any
+// point, documents that are already moved are skipped.
+func migrateBlobs(db *sql.DB, store BlobStore) (int, error) {
+	rows, err := db.Query("SELECT id, application_id FROM documents WHERE storage_key IS NULL AND contents IS NOT NULL ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the ids are read up front, the contents can be big
+	applications := make(map[int]int)
+	var ids []int
+	for rows.Next() {
+		var id, applicationID int
+		err := rows.Scan(&id, &applicationID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		applications[id] = applicationID
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		var contents []byte
+		err := db.QueryRow("SELECT contents FROM documents WHERE id=$1 AND storage_key IS NULL", id).Scan(&contents)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+
+		key, err := newBlobKey(applications[id])
+		if err != nil {
+			return moved, err
+		}
+
+		err = store.Put(key, bytes.NewReader(contents), int64(len(contents)))
+		if err != nil {
+			return moved, fmt.Errorf("Unable to move document %d: %v", id, err)
+		}
+
+		affected, err := setStorageKey(db, id, key)
+		if err != nil || affected == 0 {
+			// Somebody else moved it in the meantime or the update failed
+			if derr := store.Delete(key); derr != nil {
+				log.Printf("Unable to delete blob %s: %v", key, derr)
+			}
+		}
+		if err != nil {
+			return moved, fmt.Errorf("Unable to move document %d: %v", id, err)
+		}
+		if affected == 0 {
+			continue
+		}
+
+		log.Printf("Moved document %d to %s", id, key)
+		moved++
+	}
+
+	return moved, nil
+}
+
+// setStorageKey points a document that has not been moved yet to key and
+// drops its contents from the table
+func setStorageKey(db *sql.DB, documentID int, key string) (int64, error) {
+	res, err := db.Exec("UPDATE documents SET storage_key=$1, contents=NULL WHERE id=$2 AND storage_key IS NULL", key, documentID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// defaultContentType is used for documents whose type cannot be detected
+const defaultContentType = "application/octet-stream"
+
+// Size limits in bytes for a single document and for all documents of an
+// application.  Set them with KIRON_MAX_DOCUMENT_SIZE and KIRON_MAX_APPLICATION_SIZE.
+var (
+	maxDocumentSize    int64 = 20 << 20
+	maxApplicationSize int64 = 100 << 20
+)
+
+// errDocumentTooLarge is returned when an upload goes beyond its limit
+var errDocumentTooLarge = errors.New("Document is too large")
+
+// initDocumentLimits reads the size limits from the environment
+func initDocumentLimits() error {
+	limits := []struct {
+		name  string
+		value *int64
+	}{
+		{"KIRON_MAX_DOCUMENT_SIZE", &maxDocumentSize},
+		{"KIRON_MAX_APPLICATION_SIZE", &maxApplicationSize},
+	}
+
+	for _, l := range limits {
+		if os.Getenv(l.name) == "" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(os.Getenv(l.name), 10, 64)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("%s has to be a positive number of bytes", l.name)
+		}
+		*l.value = value
+	}
+
+	return nil
+}
+
+// uploadLimit returns how many bytes may still be added to the documents
+// and a message explaining the limit
+func uploadLimit(documents []*Document) (int64, string) {
+	var used int64
+	for _, document := range documents {
+		used += document.Size
+	}
+
+	if remaining := maxApplicationSize - used; remaining < maxDocumentSize {
+		if remaining < 0 {
+			remaining = 0
+		}
+		return remaining, fmt.Sprintf("The documents of the application may only use %d bytes, %d bytes are left", maxApplicationSize, remaining)
+	}
+
+	return maxDocumentSize, fmt.Sprintf("A document may only have %d bytes", maxDocumentSize)
+}
+
+// sniffLength is the number of bytes http.DetectContentType looks at
+const sniffLength = 512
+
+// documentDigest collects the metadata of contents written to it, so they
+// can be streamed to the blobs without being held in memory
+type documentDigest struct {
+	hash hash.Hash
+	head []byte
+	size int64
+}
+
+func newDocumentDigest() *documentDigest {
+	return &documentDigest{hash: sha256.New()}
+}
+
+func (d *documentDigest) Write(p []byte) (int, error) {
+	if missing := sniffLength - len(d.head); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		d.head = append(d.head, p[:missing]...)
+	}
+
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// document returns a document with the metadata of everything written so far
+func (d *documentDigest) document(applicationID, documentTypeID, uploadedBy int, filename string, created time.Time) *Document {
+	document := Document{
+		ApplicationID:  applicationID,
+		DocumentTypeID: documentTypeID,
+		Filename:       filename,
+		ContentType:    detectContentType(filename, d.head),
+		Size:           d.size,
+		Checksum:       hex.EncodeToString(d.hash.Sum(nil)),
+		UploadedBy:     uploadedBy,
+		Created:        created,
+	}
+	return &document
+}
+
+// newDocument returns a document with the metadata of the contents.  The
+// contents still have to be put into the blobs.
+func newDocument(applicationID, documentTypeID, uploadedBy int, filename string, contents []byte, created time.Time) *Document {
+	digest := newDocumentDigest()
+	digest.Write(contents)
+	return digest.document(applicationID, documentTypeID, uploadedBy, filename, created)
+}
+
+// detectContentType sniffs the type of the contents.  The extension of the
+// filename is only used if sniffing does not recognise the contents.
+func detectContentType(filename string, contents []byte) string {
+	contentType := http.DetectContentType(contents)
+	if contentType != defaultContentType {
+		return contentType
+	}
+
+	if byExtension := mime.TypeByExtension(path.Ext(filename)); byExtension != "" {
+		return byExtension
+	}
+
+	return defaultContentType
+}
+
+// uploadFilename returns the filename of a Content-Disposition header without
+// any directories or control characters.  It is empty if there is none.
+func uploadFilename(contentDisposition string) string {
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil {
+		return ""
+	}
+
+	return cleanFilename(params["filename"])
+}
+
+// cleanFilename returns the filename sent by a client without any directories
+// or control characters
+func cleanFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+
+	// Browsers on windows send the full path
+	filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	if filename == "." || filename == "/" || filename == ".." {
+		return ""
+	}
+
+	return filename
+}
+
+// documentETag is the entity tag of a document, it changes with the contents
+func documentETag(document *Document) string {
+	return `"` + document.Checksum + `"`
+}
+
+// contentDisposition returns the header offering the document as a download
+// under its filename
+func contentDisposition(document *Document) string {
+	if document.Filename == "" {
+		return "attachment"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": document.Filename})
+}
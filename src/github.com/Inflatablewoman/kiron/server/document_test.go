@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDocument(t *testing.T) {
+	document := newDocument(1, 2, 3, "hello.txt", []byte("hello world"), time.Now())
+	require.Equal(t, int64(11), document.Size)
+	require.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", document.Checksum)
+	require.Equal(t, "text/plain; charset=utf-8", document.ContentType)
+	require.Equal(t, 3, document.UploadedBy)
+}
+
+func TestDetectContentType(t *testing.T) {
+	require.Equal(t, "application/pdf", detectContentType("scan", []byte("%PDF-1.4 ...")))
+	require.Equal(t, "image/png", detectContentType("scan.pdf", []byte("\x89PNG\x0D\x0A\x1A\x0A")))
+	require.Equal(t, defaultContentType, detectContentType("scan", []byte{0, 1, 2}))
+	require.Equal(t, "image/jpeg", detectContentType("scan.jpg", []byte{0, 1, 2}))
+}
+
+func TestUploadFilename(t *testing.T) {
+	cases := map[string]string{
+		`attachment; filename="passport.pdf"`:         "passport.pdf",
+		`attachment; filename="C:\\scans\\visa.png"`:  "visa.png",
+		`attachment; filename="../../etc/passwd"`:     "passwd",
+		`attachment; filename*=UTF-8''%C3%BCbung.pdf`: "übung.pdf",
+		`attachment; filename="..\\.."`:               "",
+		`attachment`:                                  "",
+		`;;;`:                                         "",
+		"":                                            "",
+	}
+
+	for header, filename := range cases {
+		require.Equal(t, filename, uploadFilename(header), header)
+	}
+}
+
+func TestDocumentUploadAndDownload(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+
+	contents := []byte("%PDF-1.4 my passport")
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	request, err := http.NewRequest("PUT", documentsURL, bytes.NewBuffer(contents))
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+	request.Header.Set("Content-Disposition", `attachment; filename="Reisepass Müller.pdf"`)
+	request.Header.Set("documentTypeID", "1")
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	etag := response.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// The memory repository numbers documents from 1
+	document, err := repo.GetDocument(1)
+	require.NoError(t, err)
+	require.Equal(t, "Reisepass Müller.pdf", document.Filename)
+	require.Equal(t, applicant.ID, document.UploadedBy)
+
+	request, err = http.NewRequest("GET", fmt.Sprintf("%s/%d", documentsURL, document.ID), nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "application/pdf", response.Header.Get("Content-Type"))
+	require.Equal(t, "attachment; filename*=utf-8''Reisepass%20M%C3%BCller.pdf", response.Header.Get("Content-Disposition"))
+	require.Equal(t, fmt.Sprint(len(contents)), response.Header.Get("Content-Length"))
+	require.Equal(t, etag, response.Header.Get("ETag"))
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, contents, body)
+
+	// The listing has the metadata only
+	request, err = http.NewRequest("GET", documentsURL, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var documents []RestDocument
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&documents))
+	require.Len(t, documents, 1)
+	require.Equal(t, document.ID, documents[0].ID)
+	require.Equal(t, 1, documents[0].DocumentTypeID)
+	require.Equal(t, "1refugee status", documents[0].DocumentType)
+	require.Equal(t, "Reisepass Müller.pdf", documents[0].Filename)
+	require.Equal(t, int64(len(contents)), documents[0].Size)
+	require.WithinDuration(t, document.Created, documents[0].Created, time.Second)
+
+	// Documents of other applications are not found
+	request, err = http.NewRequest("GET", fmt.Sprintf("%s/%d", documentsURL, document.ID+1), nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestDocumentUploadType(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	for _, documentTypeID := range []string{"", "passport", "0", "999"} {
+		request, err := http.NewRequest("PUT", documentsURL, strings.NewReader("%PDF-1.4 my passport"))
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+tokenValue)
+		if documentTypeID != "" {
+			request.Header.Set("documentTypeID", documentTypeID)
+		}
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Equal(t, http.StatusBadRequest, response.StatusCode, documentTypeID)
+	}
+
+	documents, err := repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Empty(t, documents)
+}
+
+// putTestDocument uploads contents to the documents of the application
+func putTestDocument(t *testing.T, documentsURL, tokenValue string, contents io.Reader) *http.Response {
+	request, err := http.NewRequest("PUT", documentsURL, contents)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+	request.Header.Set("documentTypeID", "1")
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	return response
+}
+
+func TestDocumentSizeLimits(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	defer func(document, application int64) {
+		maxDocumentSize, maxApplicationSize = document, application
+	}(maxDocumentSize, maxApplicationSize)
+	maxDocumentSize, maxApplicationSize = 10, 15
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	// Known size
+	response := putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(make([]byte, 11)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+
+	// Unknown size, sent chunked
+	response = putTestDocument(t, documentsURL, tokenValue, io.MultiReader(bytes.NewReader(make([]byte, 11))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+
+	documents, err := repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Empty(t, documents)
+
+	response = putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(make([]byte, 10)))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	response = putTestDocument(t, documentsURL, tokenValue, io.MultiReader(bytes.NewReader(make([]byte, 5))))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	// The application is full
+	response = putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(make([]byte, 1)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+
+	documents, err = repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 2)
+	require.Equal(t, int64(5), documents[1].Size)
+}
+
+func TestDocumentRangeDownload(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	contents := []byte("%PDF-1.4 0123456789")
+	response := putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(contents))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	etag := response.Header.Get("ETag")
+
+	download := func(header, value string) (*http.Response, []byte) {
+		request, err := http.NewRequest("GET", documentsURL+"/1", nil)
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+tokenValue)
+		request.Header.Set(header, value)
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response, body
+	}
+
+	response, body := download("Range", "bytes=9-12")
+	require.Equal(t, http.StatusPartialContent, response.StatusCode)
+	require.Equal(t, "bytes 9-12/19", response.Header.Get("Content-Range"))
+	require.Equal(t, "application/pdf", response.Header.Get("Content-Type"))
+	require.Equal(t, "0123", string(body))
+
+	response, _ = download("Range", "bytes=50-")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, response.StatusCode)
+
+	response, _ = download("If-None-Match", etag)
+	require.Equal(t, http.StatusNotModified, response.StatusCode)
+
+	response, body = download("Accept-Ranges", "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "bytes", response.Header.Get("Accept-Ranges"))
+	require.Equal(t, contents, body)
+}
+
+// postTestDocuments uploads the files as multipart/form-data, each with the
+// document type at the same position
+func postTestDocuments(t *testing.T, documentsURL, tokenValue string, documentTypes []string, files map[string][]byte, names []string) *http.Response {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, documentType := range documentTypes {
+		require.NoError(t, form.WriteField("document_type_id", documentType))
+	}
+	for _, name := range names {
+		part, err := form.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = part.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, form.Close())
+
+	request, err := http.NewRequest("POST", documentsURL, &body)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+
+	return response
+}
+
+func TestMultipartDocumentUpload(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	files := map[string][]byte{
+		"passport.pdf": []byte("%PDF-1.4 passport"),
+		"cv.txt":       []byte("curriculum vitae"),
+	}
+	names := []string{"passport.pdf", "cv.txt"}
+
+	response := postTestDocuments(t, documentsURL, tokenValue, []string{"1", "4"}, files, names)
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+
+	var created []RestDocument
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&created))
+	response.Body.Close()
+	require.Len(t, created, 2)
+	require.Equal(t, "passport.pdf", created[0].Filename)
+	require.Equal(t, "application/pdf", created[0].ContentType)
+	require.Equal(t, 1, created[0].DocumentTypeID)
+	require.Equal(t, "1refugee status", created[0].DocumentType)
+	require.Equal(t, "cv.txt", created[1].Filename)
+	require.Equal(t, int64(len(files["cv.txt"])), created[1].Size)
+	require.Equal(t, 4, created[1].DocumentTypeID)
+	require.Equal(t, applicant.ID, created[1].UploadedBy)
+
+	documents, err := repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 2)
+	require.Len(t, blobs.(*memoryBlobStore).blobs, 2)
+
+	// Nothing is stored if one of the files is refused
+	for _, documentTypes := range [][]string{{"1", "1000"}, {"1"}, {"1", "x"}} {
+		response = postTestDocuments(t, documentsURL, tokenValue, documentTypes, files, names)
+		response.Body.Close()
+		require.Equal(t, http.StatusBadRequest, response.StatusCode, "%v", documentTypes)
+	}
+
+	response = postTestDocuments(t, documentsURL, tokenValue, nil, nil, nil)
+	response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	defer func(document int64) {
+		maxDocumentSize = document
+	}(maxDocumentSize)
+	maxDocumentSize = 16
+
+	response = postTestDocuments(t, documentsURL, tokenValue, []string{"1", "4"}, files, names)
+	response.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+
+	documents, err = repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 2)
+	require.Len(t, blobs.(*memoryBlobStore).blobs, 2)
+
+	// Not a form
+	request, err := http.NewRequest("POST", documentsURL, strings.NewReader("{}"))
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+	request.Header.Set("Content-Type", "application/json")
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
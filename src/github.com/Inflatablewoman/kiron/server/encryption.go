@@ -0,0 +1,463 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Documents are encrypted with a data key of their own.  The data key is
+// stored with the document, wrapped by one of the master keys.  The contents
+// are sealed in segments so parts of a document can be read without the rest.
+const (
+	dataKeySize        = 32
+	encryptionSegment  = 64 * 1024
+	encryptionOverhead = 16 // GCM tag per segment
+)
+
+// masterKeys wraps the data keys of new documents.  Without master keys
+// documents are stored unencrypted.
+var masterKeys *keyRing
+
+// ErrUnknownMasterKey is returned for data keys wrapped by a key that is not configured
+var ErrUnknownMasterKey = errors.New("Unknown master key")
+
+// keyRing holds the master keys by id.  New data keys are wrapped with the
+// current key, the others are only used to unwrap.
+type keyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// initMasterKeys reads the master keys from KIRON_MASTER_KEYS,
+// "id:base64,id:base64,...".  The first key is the current one.
+func initMasterKeys() error {
+	config := os.Getenv("KIRON_MASTER_KEYS")
+	if config == "" {
+		log.Println("KIRON_MASTER_KEYS not set, documents are stored unencrypted")
+		masterKeys = nil
+		return nil
+	}
+
+	ring, err := parseKeyRing("Master", config)
+	if err != nil {
+		return err
+	}
+
+	masterKeys = ring
+	return nil
+}
+
+// parseKeyRing reads "id:base64,id:base64,..." of kind keys, the first
+// becomes the current one
+func parseKeyRing(kind, config string) (*keyRing, error) {
+	ring := keyRing{keys: make(map[string][]byte)}
+
+	for _, entry := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s keys have to be given as id:base64,id:base64", kind)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("%s key %s has to be %d bytes, base64 encoded", kind, parts[0], dataKeySize)
+		}
+
+		if _, ok := ring.keys[parts[0]]; ok {
+			return nil, fmt.Errorf("%s key %s is given twice", kind, parts[0])
+		}
+
+		ring.keys[parts[0]] = key
+		if ring.current == "" {
+			ring.current = parts[0]
+		}
+	}
+
+	return &ring, nil
+}
+
+// wrap seals the data key with the current master key
+func (ring *keyRing) wrap(dataKey []byte) (string, []byte, error) {
+	aead, err := newGCM(ring.keys[ring.current])
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return ring.current, aead.Seal(nonce, nonce, dataKey, []byte(ring.current)), nil
+}
+
+// unwrap opens a data key wrapped by the master key keyID
+func (ring *keyRing) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	masterKey, ok := ring.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("Wrapped data key is too short")
+	}
+
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDocumentStore returns the store to put the contents of a new document in
+// and the wrapped data key to keep with the document.  The key id is empty
+// if no master keys are configured.
+func newDocumentStore(store BlobStore, ring *keyRing) (BlobStore, string, []byte, error) {
+	if ring == nil {
+		return store, "", nil, nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	keyID, wrapped, err := ring.wrap(dataKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	encrypted, err := newEncryptedBlobStore(store, dataKey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return encrypted, keyID, wrapped, nil
+}
+
+// documentStore returns the store the contents of the document are read
+// from, decrypting them if they are encrypted
+func documentStore(store BlobStore, ring *keyRing, document *Document) (BlobStore, error) {
+	if document.KeyID == "" {
+		return store, nil
+	}
+
+	if ring == nil {
+		return nil, ErrUnknownMasterKey
+	}
+
+	dataKey, err := ring.unwrap(document.KeyID, document.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unwrap the key of document %d: %v", document.ID, err)
+	}
+
+	return newEncryptedBlobStore(store, dataKey)
+}
+
+// encryptedBlobStore encrypts the blobs of another store with one data key
+type encryptedBlobStore struct {
+	BlobStore
+	aead cipher.AEAD
+}
+
+func newEncryptedBlobStore(store BlobStore, dataKey []byte) (*encryptedBlobStore, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedBlobStore{BlobStore: store, aead: aead}, nil
+}
+
+func (s *encryptedBlobStore) Put(key string, contents io.Reader, size int64) error {
+	return s.BlobStore.Put(key, &encryptingReader{aead: s.aead, contents: contents, size: size}, encryptedSize(size))
+}
+
+func (s *encryptedBlobStore) Get(key string) (Blob, error) {
+	blob, err := s.BlobStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	size, ok := decryptedSize(encrypted)
+	if !ok {
+		blob.Close()
+		return nil, fmt.Errorf("Encrypted blob %s has an invalid size", key)
+	}
+
+	return &decryptingBlob{aead: s.aead, blob: blob, size: size, segment: -1}, nil
+}
+
+// encryptedSize returns the size of size bytes once they are encrypted.
+// Even nothing takes one segment.
+func encryptedSize(size int64) int64 {
+	return size + segments(size)*encryptionOverhead
+}
+
+// decryptedSize is the reverse of encryptedSize
+func decryptedSize(encrypted int64) (int64, bool) {
+	n := (encrypted + encryptionSegment + encryptionOverhead - 1) / (encryptionSegment + encryptionOverhead)
+	size := encrypted - n*encryptionOverhead
+	if size < 0 || encryptedSize(size) != encrypted {
+		return 0, false
+	}
+	return size, true
+}
+
+func segments(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + encryptionSegment - 1) / encryptionSegment
+}
+
+// segmentNonce numbers the segments and marks the last one, so segments can
+// neither be reordered nor cut off.  Every data key encrypts one blob only.
+func segmentNonce(aead cipher.AEAD, segment int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(segment))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader reads size bytes from contents and returns them sealed
+type encryptingReader struct {
+	aead     cipher.AEAD
+	contents io.Reader
+	size     int64
+	read     int64
+	segment  int64
+	sealed   []byte
+	done     bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	if len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n := r.size - r.read
+		if n > encryptionSegment {
+			n = encryptionSegment
+		}
+
+		plain := make([]byte, n)
+		_, err := io.ReadFull(r.contents, plain)
+		if err != nil {
+			return 0, err
+		}
+		r.read += n
+		r.done = r.read == r.size
+
+		r.sealed = r.aead.Seal(nil, segmentNonce(r.aead, r.segment, r.done), plain, nil)
+		r.segment++
+	}
+
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+// decryptingBlob reads an encrypted blob.  Only the segments that are read
+// are decrypted.
+type decryptingBlob struct {
+	aead    cipher.AEAD
+	blob    Blob
+	size    int64
+	offset  int64
+	segment int64
+	plain   []byte
+}
+
+func (b *decryptingBlob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	segment := b.offset / encryptionSegment
+	if segment != b.segment {
+		err := b.load(segment)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, b.plain[b.offset-segment*encryptionSegment:])
+	b.offset += int64(n)
+	return n, nil
+}
+
+// load decrypts one segment
+func (b *decryptingBlob) load(segment int64) error {
+	_, err := b.blob.Seek(segment*(encryptionSegment+encryptionOverhead), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	n := b.size - segment*encryptionSegment
+	if n > encryptionSegment {
+		n = encryptionSegment
+	}
+
+	sealed := make([]byte, n+encryptionOverhead)
+	_, err = io.ReadFull(b.blob, sealed)
+	if err != nil {
+		return err
+	}
+
+	last := segment == segments(b.size)-1
+	b.plain, err = b.aead.Open(sealed[:0], segmentNonce(b.aead, segment, last), sealed, nil)
+	if err != nil {
+		b.segment = -1
+		return errors.New("Unable to decrypt blob, it has been modified")
+	}
+
+	b.segment = segment
+	return nil
+}
+
+func (b *decryptingBlob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("Seek before the start of the blob")
+	}
+
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *decryptingBlob) Close() error {
+	return b.blob.Close()
+}
+
+// rotateKeys wraps the data key of every document with the current master
+// key.  Documents stored before encryption was configured are encrypted.
+// Afterwards the other master keys are no longer needed.
+func rotateKeys(repo DataRepository, store BlobStore, ring *keyRing) (int, error) {
+	documents, err := repo.GetDocumentsToRekey(ring.current)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, document := range documents {
+		var err error
+		if document.KeyID == "" {
+			err = encryptDocument(repo, store, ring, document)
+		} else {
+			err = rewrapDocument(repo, ring, document)
+		}
+		if err == ErrNotFound {
+			// Deleted or rotated by somebody else in the meantime
+			continue
+		}
+		if err != nil {
+			return rotated, fmt.Errorf("Unable to rotate the key of document %d: %v", document.ID, err)
+		}
+
+		rotated++
+	}
+
+	return rotated, nil
+}
+
+// rewrapDocument wraps the data key of the document with the current master key
+func rewrapDocument(repo DataRepository, ring *keyRing, document *Document) error {
+	dataKey, err := ring.unwrap(document.KeyID, document.DataKey)
+	if err != nil {
+		return err
+	}
+
+	updated := *document
+	updated.KeyID, updated.DataKey, err = ring.wrap(dataKey)
+	if err != nil {
+		return err
+	}
+
+	return repo.RekeyDocument(&updated, document.KeyID)
+}
+
+// encryptDocument copies the unencrypted contents of the document to a new,
+// encrypted blob and removes the old one
+func encryptDocument(repo DataRepository, store BlobStore, ring *keyRing, document *Document) error {
+	contents, err := store.Get(document.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	size, err := contents.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = contents.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	encrypted, keyID, dataKey, err := newDocumentStore(store, ring)
+	if err != nil {
+		return err
+	}
+
+	key, err := newBlobKey(document.ApplicationID)
+	if err != nil {
+		return err
+	}
+
+	err = encrypted.Put(key, contents, size)
+	if err != nil {
+		return err
+	}
+
+	updated := *document
+	updated.StorageKey, updated.KeyID, updated.DataKey = key, keyID, dataKey
+
+	err = repo.RekeyDocument(&updated, "")
+	if err != nil {
+		if derr := store.Delete(key); derr != nil {
+			log.Printf("Unable to delete blob %s: %v", key, derr)
+		}
+		return err
+	}
+
+	if err := store.Delete(document.StorageKey); err != nil {
+		log.Printf("Unable to delete unencrypted blob %s: %v", document.StorageKey, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyRing returns a key ring with new random keys, the first is current
+func testKeyRing(t *testing.T, ids ...string) (*keyRing, string) {
+	var entries []string
+	for _, id := range ids {
+		key := make([]byte, dataKeySize)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+
+	config := strings.Join(entries, ",")
+	ring, err := parseKeyRing("Master", config)
+	require.NoError(t, err)
+
+	return ring, config
+}
+
+func TestParseKeyRing(t *testing.T) {
+	ring, config := testKeyRing(t, "2017", "2016")
+	require.Equal(t, "2017", ring.current)
+	require.Len(t, ring.keys, 2)
+
+	for _, invalid := range []string{
+		"2017",
+		":" + base64.StdEncoding.EncodeToString(make([]byte, dataKeySize)),
+		"2017:" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"2017:not base64",
+		config + "," + strings.Split(config, ",")[0],
+	} {
+		_, err := parseKeyRing("Master", invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestKeyRingWrap(t *testing.T) {
+	ring, _ := testKeyRing(t, "new", "old")
+
+	dataKey := []byte(GetRandomString(dataKeySize, ""))
+	keyID, wrapped, err := ring.wrap(dataKey)
+	require.NoError(t, err)
+	require.Equal(t, "new", keyID)
+	require.False(t, bytes.Contains(wrapped, dataKey))
+
+	unwrapped, err := ring.unwrap(keyID, wrapped)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+
+	// The key id is authenticated too
+	_, err = ring.unwrap("old", wrapped)
+	require.Error(t, err)
+
+	_, err = ring.unwrap("unknown", wrapped)
+	require.Equal(t, ErrUnknownMasterKey, err)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = ring.unwrap(keyID, wrapped)
+	require.Error(t, err)
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	plain := newMemoryBlobStore()
+	dataKey := []byte(GetRandomString(dataKeySize, ""))
+	store, err := newEncryptedBlobStore(plain, dataKey)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, encryptionSegment - 1, encryptionSegment, encryptionSegment + 1, 3*encryptionSegment + 5} {
+		contents := make([]byte, size)
+		_, err := rand.Read(contents)
+		require.NoError(t, err)
+
+		key := fmt.Sprintf("documents/1/%d", size)
+		err = store.Put(key, bytes.NewReader(contents), int64(size))
+		require.NoError(t, err)
+
+		sealed := plain.blobs[key]
+		require.Equal(t, encryptedSize(int64(size)), int64(len(sealed)))
+		decrypted, ok := decryptedSize(int64(len(sealed)))
+		require.True(t, ok)
+		require.Equal(t, int64(size), decrypted)
+		if size > 16 {
+			require.False(t, bytes.Contains(sealed, contents[:16]))
+		}
+
+		blob, err := store.Get(key)
+		require.NoError(t, err)
+		stored, err := ioutil.ReadAll(blob)
+		require.NoError(t, err)
+		require.Equal(t, contents, stored, "%d bytes", size)
+
+		// Reading across the end of a segment
+		if size > encryptionSegment+3 {
+			_, err = blob.Seek(encryptionSegment-3, io.SeekStart)
+			require.NoError(t, err)
+			part := make([]byte, 6)
+			_, err = io.ReadFull(blob, part)
+			require.NoError(t, err)
+			require.Equal(t, contents[encryptionSegment-3:encryptionSegment+3], part)
+		}
+		require.NoError(t, blob.Close())
+	}
+
+	// Modified and shortened blobs are refused
+	key := fmt.Sprintf("documents/1/%d", 3*encryptionSegment+5)
+	sealed := plain.blobs[key]
+
+	plain.blobs[key] = append([]byte{}, sealed...)
+	plain.blobs[key][10] ^= 1
+	blob, err := store.Get(key)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(blob)
+	require.Error(t, err)
+
+	plain.blobs[key] = sealed[:2*(encryptionSegment+encryptionOverhead)]
+	blob, err = store.Get(key)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(blob)
+	require.Error(t, err)
+
+	plain.blobs[key] = sealed[:10]
+	_, err = store.Get(key)
+	require.Error(t, err)
+
+	// Another data key does not fit
+	other, err := newEncryptedBlobStore(plain, []byte(GetRandomString(dataKeySize, "")))
+	require.NoError(t, err)
+	blob, err = other.Get("documents/1/1")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(blob)
+	require.Error(t, err)
+}
+
+func TestEncryptedDocuments(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	defer func(ring *keyRing) {
+		masterKeys = ring
+	}(masterKeys)
+	masterKeys = nil
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	download := func(documentID int) []byte {
+		request, err := http.NewRequest("GET", fmt.Sprintf("%s/%d", documentsURL, documentID), nil)
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+tokenValue)
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		return body
+	}
+
+	// Stored before encryption was configured
+	old := []byte("%PDF-1.4 stored in plaintext")
+	response := putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(old))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	masterKeys, _ = testKeyRing(t, "2016")
+
+	contents := []byte("%PDF-1.4 " + strings.Repeat("asylum application ", 5000))
+	response = putTestDocument(t, documentsURL, tokenValue, bytes.NewReader(contents))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	response = putTestDocument(t, documentsURL, tokenValue, io.MultiReader(bytes.NewReader(contents)))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	stored := blobs.(*memoryBlobStore).blobs
+	for _, documentID := range []int{2, 3} {
+		document, err := repo.GetDocument(documentID)
+		require.NoError(t, err)
+		require.Equal(t, "2016", document.KeyID)
+		require.NotEmpty(t, document.DataKey)
+		require.Equal(t, scanClean, document.ScanStatus)
+		require.Equal(t, int64(len(contents)), document.Size)
+		require.False(t, bytes.Contains(stored[document.StorageKey], []byte("asylum")))
+		require.Equal(t, contents, download(documentID))
+	}
+	require.Equal(t, old, download(1))
+
+	// Rotate to a new master key, the old one is still needed to unwrap
+	oldKeys := masterKeys
+	masterKeys, _ = testKeyRing(t, "2017")
+	masterKeys.keys["2016"] = oldKeys.keys["2016"]
+
+	rotated, err := rotateKeys(repo, blobs, masterKeys)
+	require.NoError(t, err)
+	require.Equal(t, 3, rotated)
+
+	rotated, err = rotateKeys(repo, blobs, masterKeys)
+	require.NoError(t, err)
+	require.Equal(t, 0, rotated)
+
+	// Afterwards it is not
+	delete(masterKeys.keys, "2016")
+
+	documents, err := repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 3)
+	for _, document := range documents {
+		require.Equal(t, "2017", document.KeyID)
+	}
+	require.Equal(t, old, download(1))
+	require.Equal(t, contents, download(2))
+	require.Equal(t, contents, download(3))
+
+	// The plaintext blob is gone
+	require.Len(t, stored, 3)
+	for _, blob := range stored {
+		require.False(t, bytes.Contains(blob, []byte("plaintext")))
+	}
+}
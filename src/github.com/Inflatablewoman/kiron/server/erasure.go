@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Erased records stay in place so statistics and references keep working,
+// their personal fields are replaced with these tombstones.
+const (
+	// erasedContents replaces comments about an erased applicant
+	erasedContents = "[erased]"
+
+	// erasedPassword looks like a bcrypt hash but no password matches it
+	erasedPassword = "$2a$10$erased"
+)
+
+// erasedEmail is the unique address an erased user is left with
+func erasedEmail(userID int) string {
+	return fmt.Sprintf("erased-%d@invalid", userID)
+}
+
+// eraseUser tombstones the user and their application on the spot, the
+// tombstones keep the aggregate statistics
+func eraseUser(user *User) {
+	user.EmailAddress = erasedEmail(user.ID)
+	user.FirstName = ""
+	user.LastName = ""
+	user.Password = erasedPassword
+}
+
+// eraseApplication keeps the status, education level and dates
+func eraseApplication(app *Application) {
+	*app = Application{
+		ID:              app.ID,
+		UserID:          app.UserID,
+		EducationLevel:  app.EducationLevel,
+		Status:          app.Status,
+		StatusChangedBy: app.StatusChangedBy,
+		StatusChangedAt: app.StatusChangedAt,
+		BlockExpires:    app.BlockExpires,
+		Created:         app.Created,
+		Edited:          app.Edited,
+	}
+}
+
+// erase records an erasure request and erases the user.  If the erasure
+// fails the request stays open.
+func erase(repo DataRepository, store BlobStore, userID, requestedBy int, requested time.Time) (*ErasureRequest, error) {
+	request := ErasureRequest{SubjectID: userID, RequestedBy: requestedBy, Requested: requested}
+	err := repo.AddErasureRequest(&request)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to record erasure request: %v", err)
+	}
+
+	documents, families, err := repo.EraseUser(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The documents are gone from the database, a blob left behind is
+	// unreachable and only logged
+	for _, document := range documents {
+		if document.StorageKey == "" {
+			continue
+		}
+		if err := store.Delete(document.StorageKey); err != nil {
+			log.Printf("Unable to delete blob %s of erased user %d: %v", document.StorageKey, userID, err)
+		}
+	}
+
+	// Stored tokens are gone with the user, signed ones are revoked.  The
+	// user is erased either way, a failure leaves them valid until they
+	// expire.
+	for _, family := range families {
+		if err := revokeFamily(family); err != nil {
+			return &request, fmt.Errorf("Unable to revoke token family %s of erased user %d: %v", family, userID, err)
+		}
+	}
+
+	return &request, nil
+}
+
+// RestErasureRequest ...
+type RestErasureRequest struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	RequestedBy int       `json:"requested_by"`
+	Requested   time.Time `json:"requested_at"`
+	Completed   time.Time `json:"completed_at"`
+}
+
+// eraseUserData erases the personal data of a user on behalf of an admin
+func eraseUserData(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, *RestErasureRequest, error) {
+	var err error
+	defer CatchPanic(&err, "eraseUserData")
+
+	log.Println("eraseUserData Started")
+
+	userID, err := strconv.Atoi(u.Query().Get("userID"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("Invalid user id")
+	}
+
+	_, err = repository.GetUser(userID)
+	if err == ErrNotFound {
+		return http.StatusNotFound, nil, nil, errors.New("User not found")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	request, err := erase(repository, blobs, userID, context.User.ID, time.Now().UTC())
+	if err != nil {
+		log.Printf("Unable to erase user %d: %v", userID, err)
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	log.Printf("Erased user %d for user %d", userID, context.User.ID)
+
+	// All good!
+	return http.StatusOK, nil, &RestErasureRequest{ID: request.ID, UserID: request.SubjectID, RequestedBy: request.RequestedBy, Requested: request.Requested, Completed: request.Completed}, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseUser(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+
+	admin := createTestUser(t, repo, RoleAdmin)
+	adminToken := loginTestUser(t, repo, admin)
+
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+	response := putTestDocument(t, documentsURL, tokenValue, strings.NewReader("%PDF-1.4 passport"))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	document, err := repo.GetDocument(1)
+	require.NoError(t, err)
+	_, err = blobs.Get(document.StorageKey)
+	require.NoError(t, err)
+
+	request, err := http.NewRequest("DELETE", fmt.Sprintf("%s/api/v1/users/%d", server.URL, applicant.ID), nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+adminToken)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var erasure RestErasureRequest
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&erasure))
+	require.Equal(t, applicant.ID, erasure.UserID)
+	require.Equal(t, admin.ID, erasure.RequestedBy)
+	require.False(t, erasure.Completed.IsZero())
+
+	// The contents are gone with the document
+	_, err = blobs.Get(document.StorageKey)
+	require.Error(t, err)
+
+	// So is the session
+	response = doTestRequest(t, "GET", fmt.Sprintf("%s/api/v1/users/%d/application", server.URL, applicant.ID), tokenValue, "")
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	user, err := repo.GetUser(applicant.ID)
+	require.NoError(t, err)
+	require.Equal(t, erasedEmail(applicant.ID), user.EmailAddress)
+
+	repoAppl, err := repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, appl.Status, repoAppl.Status)
+	require.Empty(t, repoAppl.PhoneNumber)
+
+	response = doTestRequest(t, "DELETE", fmt.Sprintf("%s/api/v1/users/%d", server.URL, 1000000), adminToken, "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestEraseSignedUser(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	useSigningKeys(t, "2017")
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	status, login := postTestSession(t, fmt.Sprintf("%s/api/v1/login", server.URL), loginRequest{EmailAddress: applicant.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, isSignedToken(login.Token))
+
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, applicant.ID)
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+
+	admin := createTestUser(t, repo, RoleAdmin)
+	require.Equal(t, http.StatusOK, doTestRequest(t, "DELETE", userURL, loginTestUser(t, repo, admin), "").StatusCode)
+
+	// Signed tokens cannot be deleted, they are revoked with the user
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+	status, _ = postTestSession(t, fmt.Sprintf("%s/api/v1/token/refresh", server.URL), refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rcrowley/go-tigertonic"
+)
+
+// exportDataFile is the name of the JSON dump in an export archive
+const exportDataFile = "data.json"
+
+// RestExport is everything kiron keeps about a user, as given to them
+type RestExport struct {
+	Exported      time.Time             `json:"exported_at"`
+	User          *RestUser             `json:"user"`
+	Application   *RestApplication      `json:"application"`
+	Comments      []*RestComment        `json:"comments"`
+	StatusHistory []*RestStatusChange   `json:"status_history"`
+	Documents     []*RestExportDocument `json:"documents"`
+}
+
+// RestComment ...
+type RestComment struct {
+	ID            int       `json:"id"`
+	ApplicationID int       `json:"application_id"`
+	UserID        int       `json:"user_id"`
+	Contents      string    `json:"contents"`
+	Created       time.Time `json:"created_at"`
+}
+
+// RestExportDocument is the metadata of a document and where its contents
+// are in the archive.  File is empty if the contents are not included.
+type RestExportDocument struct {
+	*RestDocument
+	File string `json:"file,omitempty"`
+}
+
+// ExportHandler hands a user all their data as a ZIP archive
+type ExportHandler struct {
+}
+
+// NewExportHandler ...
+func NewExportHandler() ExportHandler {
+	return ExportHandler{}
+}
+
+// ServeHTTP writes the archive.  The export is recorded in the audit trail
+// before anything is sent.
+func (handler ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer CatchPanic(&err, "ExportHandler")
+
+	context := tigertonic.Context(r).(*AuthContext)
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("userID"))
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	user, err := repository.GetUser(userID)
+	if err == ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	export, documents, err := collectExport(user)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	event := AuditEvent{UserID: context.User.ID, SubjectID: user.ID, Action: auditExport, RemoteAddr: RequestAddr(r), Created: export.Exported}
+	err = repository.AddAuditEvent(&event)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	log.Printf("Export of user %d for user %d", user.ID, context.User.ID)
+
+	header := w.Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kiron-export-%d.zip"`, user.ID))
+	w.WriteHeader(http.StatusOK)
+
+	// Once the archive is started errors cannot be reported any more, the
+	// client is left with an archive without its directory
+	err = writeExport(w, export, documents)
+	if err != nil {
+		log.Printf("Export of user %d failed: %v", user.ID, err)
+		return
+	}
+
+	log.Println("Export complete")
+}
+
+// collectExport gathers the data of user.  It returns the documents whose
+// contents go into the archive along with the dump.
+func collectExport(user *User) (*RestExport, []*Document, error) {
+	export := RestExport{
+		Exported:      time.Now().UTC(),
+		User:          user.ToRestUser(),
+		Comments:      []*RestComment{},
+		StatusHistory: []*RestStatusChange{},
+		Documents:     []*RestExportDocument{},
+	}
+
+	application, err := repository.GetApplicationOf(user.ID)
+	if err == ErrNotFound {
+		return &export, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	export.Application = application.ToRestApplication()
+
+	comments, err := repository.GetComments(application.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, comment := range comments {
+		// Only what the user could read anyway
+		if comment.UserID != user.ID && !allowed(user, resourceComment, actionRead, user.ID) {
+			continue
+		}
+		export.Comments = append(export.Comments, &RestComment{ID: comment.ID, ApplicationID: comment.ApplicationID, UserID: comment.UserID, Contents: comment.Contents, Created: comment.Created})
+	}
+
+	history, err := repository.GetStatusHistory(application.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, change := range history {
+		export.StatusHistory = append(export.StatusHistory, &RestStatusChange{ID: change.ID, ApplicationID: change.ApplicationID, From: change.From, To: change.To, UserID: change.UserID, Reason: change.Reason, Changed: change.Changed})
+	}
+
+	documents, err := repository.GetDocuments(application.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*Document
+	for _, document := range documents {
+		restDocument := RestExportDocument{RestDocument: document.ToRestDocument()}
+
+		// Like downloads, quarantined and unscanned contents are not handed out
+		if document.ScanStatus == scanClean && document.StorageKey != "" {
+			restDocument.File = exportFilename(document)
+			files = append(files, document)
+		}
+
+		export.Documents = append(export.Documents, &restDocument)
+	}
+
+	return &export, files, nil
+}
+
+// exportFilename is where the contents of a document are in the archive.
+// The id keeps documents with the same filename apart.
+func exportFilename(document *Document) string {
+	if document.Filename == "" {
+		return fmt.Sprintf("documents/%d", document.ID)
+	}
+	return fmt.Sprintf("documents/%d-%s", document.ID, document.Filename)
+}
+
+// writeExport writes the archive with the dump and the contents of documents
+func writeExport(w io.Writer, export *RestExport, documents []*Document) error {
+	archive := zip.NewWriter(w)
+
+	data, err := archive.CreateHeader(&zip.FileHeader{Name: exportDataFile, Method: zip.Deflate, Modified: export.Exported})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(data)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(export)
+	if err != nil {
+		return err
+	}
+
+	for _, document := range documents {
+		err = writeExportDocument(archive, document)
+		if err != nil {
+			return fmt.Errorf("Unable to add document %d: %v", document.ID, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+func writeExportDocument(archive *zip.Writer, document *Document) error {
+	// Decrypts the contents if they are encrypted
+	store, err := documentStore(blobs, masterKeys, document)
+	if err != nil {
+		return err
+	}
+
+	contents, err := store.Get(document.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: exportFilename(document), Method: zip.Deflate, Modified: document.Created})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, contents)
+	return err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getTestExport downloads the export of the user and returns the files in it
+func getTestExport(t *testing.T, exportURL, tokenValue string) map[string][]byte {
+	request, err := http.NewRequest("GET", exportURL, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+tokenValue)
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "application/zip", response.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	require.NoError(t, err)
+
+	files := make(map[string][]byte)
+	for _, file := range archive.File {
+		contents, err := file.Open()
+		require.NoError(t, err)
+		files[file.Name], err = ioutil.ReadAll(contents)
+		require.NoError(t, err)
+		contents.Close()
+	}
+
+	return files
+}
+
+func TestExport(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+
+	admin := createTestUser(t, repo, RoleAdmin)
+	adminToken := loginTestUser(t, repo, admin)
+
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+	response := postTestDocuments(t, documentsURL, tokenValue, []string{"1", "2"},
+		map[string][]byte{"passport.pdf": []byte("%PDF-1.4 passport"), "notes.sh": []byte("#!/bin/sh")}, []string{"passport.pdf", "notes.sh"})
+	response.Body.Close()
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+
+	change, err := newStatusChange(appl, statusConfirmed, admin, "", time.Now().UTC())
+	require.NoError(t, err)
+	require.NoError(t, repo.TransitionApplication(change))
+
+	// Comments of the helpers are not for the applicant
+	comment := Comment{Created: time.Now().UTC(), ApplicationID: appl.ID, UserID: admin.ID, Contents: "looks fake"}
+	require.NoError(t, repo.SetComment(&comment))
+
+	exportURL := fmt.Sprintf("%s/api/v1/users/%d/export", server.URL, applicant.ID)
+	files := getTestExport(t, exportURL, tokenValue)
+	require.Len(t, files, 2)
+	require.Equal(t, "%PDF-1.4 passport", string(files[fmt.Sprintf("documents/%d-passport.pdf", 1)]))
+
+	var export RestExport
+	require.NoError(t, json.Unmarshal(files[exportDataFile], &export))
+	require.Equal(t, applicant.ID, export.User.ID)
+	require.Equal(t, applicant.EmailAddress, export.User.EmailAddress)
+	require.Equal(t, appl.ID, export.Application.ID)
+	require.Equal(t, appl.PhoneNumber, export.Application.PhoneNumber)
+	require.Empty(t, export.Comments)
+	require.Len(t, export.StatusHistory, 1)
+	require.Equal(t, string(statusConfirmed), export.StatusHistory[0].To)
+
+	// The quarantined document is listed without its contents
+	require.Len(t, export.Documents, 2)
+	require.Equal(t, "documents/1-passport.pdf", export.Documents[0].File)
+	require.Equal(t, "notes.sh", export.Documents[1].Filename)
+	require.Equal(t, scanQuarantined, export.Documents[1].ScanStatus)
+	require.Empty(t, export.Documents[1].File)
+	require.False(t, strings.Contains(string(files[exportDataFile]), "looks fake"))
+
+	// Admins get the same archive
+	files = getTestExport(t, exportURL, adminToken)
+	require.Len(t, files, 2)
+
+	events, err := repo.GetAuditEvents(applicant.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, applicant.ID, events[0].UserID)
+	require.Equal(t, admin.ID, events[1].UserID)
+	require.Equal(t, auditExport, events[1].Action)
+
+	// A user without an application still gets their data
+	helper := createTestUser(t, repo, RoleTrustedHelper)
+	files = getTestExport(t, fmt.Sprintf("%s/api/v1/users/%d/export", server.URL, helper.ID), loginTestUser(t, repo, helper))
+
+	export = RestExport{}
+	require.NoError(t, json.Unmarshal(files[exportDataFile], &export))
+	require.Equal(t, helper.ID, export.User.ID)
+	require.Nil(t, export.Application)
+
+	response = doTestRequest(t, "GET", fmt.Sprintf("%s/api/v1/users/%d/export", server.URL, 1000000), adminToken, "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
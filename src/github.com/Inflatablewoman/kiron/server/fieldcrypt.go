@@ -0,0 +1,382 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sensitive application fields are encrypted by the postgres repository
+// with a key derived from the current master key.  They are stored as
+// "enc:<key id>:<base64 of nonce and ciphertext>", anything else is a value
+// from before encryption was configured.
+const encryptedFieldPrefix = "enc:"
+
+// birthdayFormat is how birthdays are kept in the now text birthday column
+const birthdayFormat = "2006-01-02"
+
+// indexKey computes the blind indexes that allow looking up encrypted
+// fields by exact value.  Unlike the master keys it cannot be rotated
+// without recomputing every index, "kiron applications rotate-keys" does so.
+var indexKey []byte
+
+// initIndexKey reads KIRON_INDEX_KEY, 32 random bytes base64 encoded.  It is
+// required once master keys are configured.
+func initIndexKey() error {
+	config := os.Getenv("KIRON_INDEX_KEY")
+	if config == "" {
+		if masterKeys != nil {
+			return errors.New("KIRON_INDEX_KEY has to be set together with KIRON_MASTER_KEYS")
+		}
+		indexKey = nil
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config)
+	if err != nil || len(key) != dataKeySize {
+		return fmt.Errorf("KIRON_INDEX_KEY has to be %d bytes, base64 encoded", dataKeySize)
+	}
+
+	indexKey = key
+	return nil
+}
+
+// sensitiveFields are the application columns that are stored encrypted
+type sensitiveFields struct {
+	Birthday     string
+	Phone        string
+	Nationality  string
+	Address      string
+	AddressExtra string
+	Survey       string
+}
+
+// columns pairs the fields with their column names, which are authenticated
+// with the values so they cannot be swapped
+func (f *sensitiveFields) columns() map[string]*string {
+	return map[string]*string{
+		"birthday":                  &f.Birthday,
+		"phone":                     &f.Phone,
+		"nationality":               &f.Nationality,
+		"address":                   &f.Address,
+		"address_extra":             &f.AddressExtra,
+		"first_page_of_survey_data": &f.Survey,
+	}
+}
+
+// sensitiveFieldsOf returns the sensitive fields of the application
+func sensitiveFieldsOf(app *Application) sensitiveFields {
+	return sensitiveFields{
+		Birthday:     app.Birthday.Format(birthdayFormat),
+		Phone:        app.PhoneNumber,
+		Nationality:  app.Nationality,
+		Address:      app.Address,
+		AddressExtra: app.AddressExtra,
+		Survey:       app.FirstPageOfSurveyData,
+	}
+}
+
+// apply sets the sensitive fields of the application.  Erased applications
+// have no birthday.
+func (f sensitiveFields) apply(app *Application) error {
+	var birthday time.Time
+	if f.Birthday != "" {
+		var err error
+		birthday, err = time.Parse(birthdayFormat, f.Birthday)
+		if err != nil {
+			return fmt.Errorf("Invalid birthday of application %d", app.ID)
+		}
+	}
+
+	app.Birthday = birthday
+	app.PhoneNumber = f.Phone
+	app.Nationality = f.Nationality
+	app.Address = f.Address
+	app.AddressExtra = f.AddressExtra
+	app.FirstPageOfSurveyData = f.Survey
+	return nil
+}
+
+// seal encrypts every field with the current master key.  Without master
+// keys the fields are returned as they are.
+func (f sensitiveFields) seal(ring *keyRing) (sensitiveFields, error) {
+	sealed := f
+	for column, value := range sealed.columns() {
+		var err error
+		*value, err = encryptField(ring, column, *value)
+		if err != nil {
+			return sealed, err
+		}
+	}
+	return sealed, nil
+}
+
+// open decrypts the encrypted fields
+func (f sensitiveFields) open(ring *keyRing) (sensitiveFields, error) {
+	opened := f
+	for column, value := range opened.columns() {
+		var err error
+		*value, err = decryptField(ring, column, *value)
+		if err != nil {
+			return opened, err
+		}
+	}
+	return opened, nil
+}
+
+// sealedWith returns true if every non empty field is encrypted with the master key keyID
+func (f sensitiveFields) sealedWith(keyID string) bool {
+	for _, value := range f.columns() {
+		if *value != "" && !strings.HasPrefix(*value, encryptedFieldPrefix+keyID+":") {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldKey derives the key for the application fields from a master key
+func (ring *keyRing) fieldKey(keyID string) ([]byte, error) {
+	masterKey, ok := ring.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+
+	key := make([]byte, dataKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte("kiron application fields")), key)
+	return key, err
+}
+
+// encryptField encrypts value of column with the current master key
+func encryptField(ring *keyRing, column, value string) (string, error) {
+	if ring == nil || value == "" {
+		return value, nil
+	}
+
+	key, err := ring.fieldKey(ring.current)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(column))
+	return encryptedFieldPrefix + ring.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptField returns the plain value of column.  Values that are not
+// encrypted are returned as they are.
+func decryptField(ring *keyRing, column, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedFieldPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedFieldPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid encrypted %s", column)
+	}
+
+	if ring == nil {
+		return "", ErrUnknownMasterKey
+	}
+
+	key, err := ring.fieldKey(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("Invalid encrypted %s", column)
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("Unable to decrypt %s: %v", column, err)
+	}
+
+	return string(plain), nil
+}
+
+// blindIndex returns a keyed hash of the normalized value of column that can
+// be compared in the database without revealing the value.  It is nil if
+// there is no index key or no value.
+func blindIndex(key []byte, column, value string) interface{} {
+	if key == nil || value == "" {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(column + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// normalizePhone drops everything but the digits and a leading + so
+// "+49 (30) 123-45" and "+4930 12345" are the same number
+func normalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || r == '+' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// normalizeNationality ignores case and surrounding space
+func normalizeNationality(nationality string) string {
+	return strings.ToLower(strings.TrimSpace(nationality))
+}
+
+// Applications runs an application maintenance command against the postgres
+// database in DBCONN.
+//
+//	rotate-keys  encrypt the sensitive fields of every application with the
+//	             first of KIRON_MASTER_KEYS and recompute the blind indexes
+func Applications(args []string) error {
+	if len(args) == 0 || args[0] != "rotate-keys" {
+		return errors.New("Usage: kiron applications rotate-keys")
+	}
+
+	err := initMasterKeys()
+	if err != nil {
+		return err
+	}
+	if masterKeys == nil {
+		return errors.New("KIRON_MASTER_KEYS is not set")
+	}
+
+	err = initIndexKey()
+	if err != nil {
+		return err
+	}
+
+	db, err := openPostgres()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rotated, err := rotateApplicationKeys(db, masterKeys, indexKey)
+	log.Printf("Rotated the keys of %d applications to master key %s", rotated, masterKeys.current)
+
+	return err
+}
+
+// rotateApplicationKeys encrypts the sensitive fields of every application
+// that is not encrypted with the current master key yet, one application at
+// a time.  It can be stopped and run again.
+func rotateApplicationKeys(db *sql.DB, ring *keyRing, index []byte) (int, error) {
+	rows, err := db.Query("SELECT id FROM applications ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, id := range ids {
+		changed, err := rotateApplicationKey(db, ring, index, id)
+		if err != nil {
+			return rotated, fmt.Errorf("Unable to rotate the keys of application %d: %v", id, err)
+		}
+		if changed {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+func rotateApplicationKey(db *sql.DB, ring *keyRing, index []byte, applicationID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		stored                       sensitiveFields
+		phoneIndex, nationalityIndex sql.NullString
+	)
+	err = tx.QueryRow(`SELECT birthday, coalesce(phone, ''), nationality, coalesce(address, ''), coalesce(address_extra, ''), coalesce(first_page_of_survey_data, ''), phone_bidx, nationality_bidx
+		FROM applications WHERE id=$1 FOR UPDATE`, applicationID).Scan(
+		&stored.Birthday, &stored.Phone, &stored.Nationality, &stored.Address, &stored.AddressExtra, &stored.Survey, &phoneIndex, &nationalityIndex)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	plain, err := stored.open(ring)
+	if err != nil {
+		return false, err
+	}
+
+	newPhoneIndex := blindIndex(index, "phone", normalizePhone(plain.Phone))
+	newNationalityIndex := blindIndex(index, "nationality", normalizeNationality(plain.Nationality))
+	if stored.sealedWith(ring.current) && phoneIndex.String == indexString(newPhoneIndex) && nationalityIndex.String == indexString(newNationalityIndex) {
+		return false, nil
+	}
+
+	sealed, err := plain.seal(ring)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE applications SET birthday=$1, phone=$2, nationality=$3, address=$4, address_extra=$5, first_page_of_survey_data=$6, phone_bidx=$7, nationality_bidx=$8
+		WHERE id=$9`, sealed.Birthday, sealed.Phone, sealed.Nationality, sealed.Address, sealed.AddressExtra, sealed.Survey, newPhoneIndex, newNationalityIndex, applicationID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// indexString returns a blind index as it is read from the database
+func indexString(index interface{}) string {
+	if index == nil {
+		return ""
+	}
+	return index.(string)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptField(t *testing.T) {
+	ring, _ := testKeyRing(t, "2017", "2016")
+
+	sealed, err := encryptField(ring, "phone", "+49 30 12345")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(sealed, "enc:2017:"))
+	require.NotContains(t, sealed, "12345")
+
+	again, err := encryptField(ring, "phone", "+49 30 12345")
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, again)
+
+	plain, err := decryptField(ring, "phone", sealed)
+	require.NoError(t, err)
+	require.Equal(t, "+49 30 12345", plain)
+
+	// Values cannot be moved to another column
+	_, err = decryptField(ring, "address", sealed)
+	require.Error(t, err)
+
+	_, err = decryptField(nil, "phone", sealed)
+	require.Equal(t, ErrUnknownMasterKey, err)
+
+	_, err = decryptField(ring, "phone", "enc:2017:broken")
+	require.Error(t, err)
+
+	// Nothing to do without keys, for empty values or values from before
+	sealed, err = encryptField(nil, "phone", "12345")
+	require.NoError(t, err)
+	require.Equal(t, "12345", sealed)
+
+	sealed, err = encryptField(ring, "phone", "")
+	require.NoError(t, err)
+	require.Empty(t, sealed)
+
+	plain, err = decryptField(ring, "phone", "12345")
+	require.NoError(t, err)
+	require.Equal(t, "12345", plain)
+}
+
+func TestSensitiveFields(t *testing.T) {
+	ring, _ := testKeyRing(t, "2017")
+
+	appl := Application{
+		Birthday:              time.Date(1990, 4, 1, 0, 0, 0, 0, time.UTC),
+		PhoneNumber:           "555",
+		Nationality:           "marsian",
+		Address:               "1 crater road",
+		FirstPageOfSurveyData: "survey",
+	}
+
+	sealed, err := sensitiveFieldsOf(&appl).seal(ring)
+	require.NoError(t, err)
+	require.True(t, sealed.sealedWith("2017"))
+	require.False(t, sealed.sealedWith("2016"))
+	require.Empty(t, sealed.AddressExtra)
+	for column, value := range sealed.columns() {
+		require.NotContains(t, *value, "555", column)
+		require.NotContains(t, *value, "marsian", column)
+	}
+
+	opened, err := sealed.open(ring)
+	require.NoError(t, err)
+
+	var read Application
+	require.NoError(t, opened.apply(&read))
+	require.Equal(t, appl, read)
+
+	require.False(t, sensitiveFieldsOf(&appl).sealedWith("2017"))
+}
+
+func TestBlindIndex(t *testing.T) {
+	key := []byte(GetRandomString(dataKeySize, ""))
+
+	require.Equal(t, blindIndex(key, "phone", normalizePhone("+49 (30) 123-45")), blindIndex(key, "phone", normalizePhone("+4930 12345")))
+	require.NotEqual(t, blindIndex(key, "phone", "12345"), blindIndex(key, "phone", "12346"))
+	require.NotEqual(t, blindIndex(key, "phone", "12345"), blindIndex(key, "nationality", "12345"))
+	require.NotEqual(t, blindIndex(key, "phone", "12345"), blindIndex([]byte(GetRandomString(dataKeySize, "")), "phone", "12345"))
+	require.Nil(t, blindIndex(nil, "phone", "12345"))
+	require.Nil(t, blindIndex(key, "phone", ""))
+
+	require.Equal(t, "syrian", normalizeNationality(" Syrian "))
+}
+
+func TestPostgresFieldEncryption(t *testing.T) {
+	requirePostgres(t)
+
+	pdb, err := openPostgres()
+	require.NoError(t, err)
+	defer pdb.Close()
+
+	// Work in a schema of our own, rotating must not touch the real applications
+	schema := fmt.Sprintf("fields_test_%s", strings.ToLower(GetRandomString(8, "alpha")))
+	_, err = pdb.Exec("CREATE SCHEMA " + schema)
+	require.NoError(t, err)
+	defer pdb.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	db, err := sql.Open("postgres", os.Getenv("DBCONN")+" search_path="+schema)
+	require.NoError(t, err)
+	defer db.Close()
+
+	m, err := newMigrator(db, migrations)
+	require.NoError(t, err)
+	require.NoError(t, m.up(len(migrations)))
+
+	defer func(ring *keyRing, index []byte) {
+		masterKeys, indexKey = ring, index
+	}(masterKeys, indexKey)
+	masterKeys, indexKey = nil, []byte(GetRandomString(dataKeySize, ""))
+
+	repo := postgresRepository{db: db}
+
+	// Stored before encryption was configured
+	plainAppl := createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+
+	masterKeys, _ = testKeyRing(t, "2016")
+	appl := createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+	appl.PhoneNumber = "+49 (30) 123-45"
+	require.NoError(t, repo.UpdateApplication(appl))
+
+	raw := func(id int) (string, string) {
+		var phone, nationality string
+		err := db.QueryRow("SELECT phone, nationality FROM applications WHERE id=$1", id).Scan(&phone, &nationality)
+		require.NoError(t, err)
+		return phone, nationality
+	}
+
+	phone, nationality := raw(appl.ID)
+	require.True(t, strings.HasPrefix(phone, "enc:2016:"))
+	require.True(t, strings.HasPrefix(nationality, "enc:2016:"))
+	phone, nationality = raw(plainAppl.ID)
+	require.Equal(t, "555", phone)
+	require.Equal(t, "marsian", nationality)
+
+	repoAppl, err := repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, "+49 (30) 123-45", repoAppl.PhoneNumber)
+	require.Equal(t, "marsian", repoAppl.Nationality)
+	require.Equal(t, appl.Birthday.Format(birthdayFormat), repoAppl.Birthday.Format(birthdayFormat))
+
+	page, _, err := repo.GetApplications(ApplicationQuery{Phone: "+493012345"})
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, appl.ID, page[0].ID)
+
+	// Encrypted and plain values are both found
+	_, total, err := repo.GetApplications(ApplicationQuery{Nationality: "Marsian"})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+
+	// Rotate to a new master key, the old one is still needed to decrypt
+	oldKeys := masterKeys
+	masterKeys, _ = testKeyRing(t, "2017")
+	masterKeys.keys["2016"] = oldKeys.keys["2016"]
+
+	rotated, err := rotateApplicationKeys(db, masterKeys, indexKey)
+	require.NoError(t, err)
+	require.Equal(t, 2, rotated)
+
+	rotated, err = rotateApplicationKeys(db, masterKeys, indexKey)
+	require.NoError(t, err)
+	require.Equal(t, 0, rotated)
+
+	delete(masterKeys.keys, "2016")
+
+	for _, id := range []int{appl.ID, plainAppl.ID} {
+		phone, nationality = raw(id)
+		require.True(t, strings.HasPrefix(phone, "enc:2017:"))
+		require.True(t, strings.HasPrefix(nationality, "enc:2017:"))
+
+		repoAppl, err = repo.GetApplication(id)
+		require.NoError(t, err)
+		require.Equal(t, "marsian", repoAppl.Nationality)
+	}
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Nationality: "marsian"})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,15 +15,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-tigertonic"
 )
 
 // AuthContext information for Marshaled calls
 type AuthContext struct {
-	UserAgent  string
-	RemoteAddr string
-	User       *User
-	TokenValue string
+	UserAgent   string
+	RemoteAddr  string
+	User        *User
+	TokenValue  string
+	TokenFamily string
+
+	// claims of a signed access token, nil for stored ones
+	claims *tokenClaims
 }
 
 // getContext is used check the Auth of a user
@@ -40,6 +46,11 @@ func getContext(r *http.Request) (http.Header, error) {
 		return nil, tigertonic.Unauthorized{Err: errors.New("Access denied")}
 	}
 
+	// Signed tokens are checked without the repository
+	if isSignedToken(tokenValue) {
+		return nil, signedContext(r, tokenValue)
+	}
+
 	// Check token is valid
 	token, err := repository.GetToken(tokenValue)
 	if err != nil {
@@ -52,6 +63,8 @@ func getContext(r *http.Request) (http.Header, error) {
 		return nil, tigertonic.Unauthorized{Err: errors.New("Access denied")}
 	}
 
+	tigertonic.Context(r).(*AuthContext).TokenFamily = token.Family
+
 	// Get user
 	user, err := repository.GetUser(token.UserID)
 	if err != nil {
@@ -70,6 +83,29 @@ func getContext(r *http.Request) (http.Header, error) {
 	return nil, nil
 }
 
+// signedContext checks a signed access token and adds the user it names to
+// the context.  Only the id and role of the user are known, changes to the
+// user take effect with the next token.
+func signedContext(r *http.Request, tokenValue string) error {
+	claims, err := verifyToken(tokenValue)
+	if err != nil {
+		log.Printf("Error verifying signed token: %v", err)
+		return tigertonic.Unauthorized{Err: errors.New("Access denied")}
+	}
+
+	if revocations.isRevoked(claims.ID, claims.Family) {
+		log.Printf("Signed token of user %d has been revoked", claims.UserID)
+		return tigertonic.Unauthorized{Err: errors.New("Access denied")}
+	}
+
+	context := tigertonic.Context(r).(*AuthContext)
+	context.TokenFamily = claims.Family
+	context.claims = claims
+	context.User = &User{ID: claims.UserID, Role: roleFromID(claims.RoleID)}
+
+	return nil
+}
+
 // BasicContext information for Marshaled calls
 type BasicContext struct {
 	UserAgent  string
@@ -91,38 +127,78 @@ func RegisterHTTPHandlers(mux *tigertonic.TrieServeMux) {
 	// Login User
 	mux.Handle("POST", "/api/v1/login", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(login)), BasicContext{}))
 
+	// Exchange a refresh token for new tokens
+	mux.Handle("POST", "/api/v1/token/refresh", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(refreshSession)), BasicContext{}))
+
 	// Logout
 	mux.Handle("POST", "/api/v1/logout", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(logout)), AuthContext{}))
 
+	// Mail a link to reset a forgotten password
+	mux.Handle("POST", "/api/v1/password/forgot", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(forgotPassword)), BasicContext{}))
+
+	// Set a new password with the link from the mail
+	mux.Handle("POST", "/api/v1/password/reset", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(resetPassword)), BasicContext{}))
+
 	// Create user
 	mux.Handle("POST", "/api/v1/users", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(createUser)), BasicContext{}))
 
+	// Verify the email address of a new user
+	mux.Handle("POST", "/api/v1/users/verify", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(verifyEmail)), BasicContext{}))
+
+	// Mail another verification link
+	mux.Handle("POST", "/api/v1/users/verify/resend", tigertonic.WithContext(tigertonic.If(getBasicContext, tigertonic.Marshaled(resendVerification)), BasicContext{}))
+
 	// Get users
-	mux.Handle("GET", "/api/v1/users", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(getUsers)), AuthContext{}))
+	mux.Handle("GET", "/api/v1/users", authorized(resourceUser, actionRead, tigertonic.Marshaled(getUsers)))
 
 	// Get single user
-	mux.Handle("GET", "/api/v1/users/{userID}", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(getUser)), AuthContext{}))
+	mux.Handle("GET", "/api/v1/users/{userID}", authorized(resourceUser, actionRead, tigertonic.Marshaled(getUser)))
+
+	// Erase the personal data of a user
+	mux.Handle("DELETE", "/api/v1/users/{userID}", authorized(resourceUser, actionDelete, tigertonic.Marshaled(eraseUserData)))
+
+	// Let a user log in again after too many failed logins
+	mux.Handle("DELETE", "/api/v1/users/{userID}/lockout", authorized(resourceLockout, actionDelete, tigertonic.Marshaled(unlockUser)))
+
+	// Export everything about a user
+	mux.Handle("GET", "/api/v1/users/{userID}/export", authorized(resourceExport, actionRead, NewExportHandler()))
 
 	// Get applications
-	mux.Handle("GET", "/api/v1/applications", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(getApplications)), AuthContext{}))
+	mux.Handle("GET", "/api/v1/applications", authorized(resourceApplication, actionRead, tigertonic.Marshaled(getApplications)))
+
+	// Search applications
+	mux.Handle("GET", "/api/v1/search", authorized(resourceApplication, actionRead, tigertonic.Marshaled(searchApplications)))
 
 	// Get single application
-	mux.Handle("GET", "/api/v1/users/{userID}/application", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(getApplication)), AuthContext{}))
+	mux.Handle("GET", "/api/v1/users/{userID}/application", authorized(resourceApplication, actionRead, tigertonic.Marshaled(getApplication)))
 
 	// Create application
-	mux.Handle("POST", "/api/v1/users/{userID}/application", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(createApplication)), AuthContext{}))
+	mux.Handle("POST", "/api/v1/users/{userID}/application", authorized(resourceApplication, actionCreate, tigertonic.Marshaled(createApplication)))
+
+	// Change application status
+	mux.Handle("POST", "/api/v1/users/{userID}/application/status", authorized(resourceApplication, actionUpdate, tigertonic.Marshaled(changeApplicationStatus)))
+
+	// Get status history
+	mux.Handle("GET", "/api/v1/users/{userID}/application/history", authorized(resourceHistory, actionRead, tigertonic.Marshaled(getStatusHistory)))
 
 	// Get documents
-	mux.Handle("GET", "/api/v1/users/{userID}/application/{applicationID}/documents", NewFileDownloadHandler())
+	mux.Handle("GET", "/api/v1/users/{userID}/application/{applicationID}/documents", authorized(resourceDocument, actionRead, tigertonic.Marshaled(getDocuments)))
+
+	// Download document
+	mux.Handle("GET", "/api/v1/users/{userID}/application/{applicationID}/documents/{documentID}", authorized(resourceDocument, actionRead, NewFileDownloadHandler()))
 
 	// Create documents
-	mux.Handle("PUT", "/api/v1/users/{userID}/application/{applicationID}/documents", NewRawUploadHandler())
+	mux.Handle("PUT", "/api/v1/users/{userID}/application/{applicationID}/documents", authorized(resourceDocument, actionCreate, NewRawUploadHandler()))
+	mux.Handle("POST", "/api/v1/users/{userID}/application/{applicationID}/documents", authorized(resourceDocument, actionCreate, NewMultipartUploadHandler()))
 
 	// Get comments
-	mux.Handle("GET", "/api/v1/users/{userID}/application/{applicationID}/comments", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(getComments)), AuthContext{}))
+	mux.Handle("GET", "/api/v1/users/{userID}/application/{applicationID}/comments", authorized(resourceComment, actionRead, tigertonic.Marshaled(getComments)))
 
 	// Create comment
-	mux.Handle("POST", "/api/v1/users/{userID}/application/{applicationID}/comments", tigertonic.WithContext(tigertonic.If(getContext, tigertonic.Marshaled(createComment)), AuthContext{}))
+	mux.Handle("POST", "/api/v1/users/{userID}/application/{applicationID}/comments", authorized(resourceComment, actionCreate, tigertonic.Marshaled(createComment)))
+
+	// Metrics such as what the retention policy purged
+	mux.Handle("GET", "/api/v1/metrics", authorized(resourceMetrics, actionRead, http.HandlerFunc(getMetrics)))
 
 }
 
@@ -148,42 +224,58 @@ func login(u *url.URL, h http.Header, request *loginRequest, context *BasicConte
 		return http.StatusBadRequest, nil, nil, errors.New("You must provide a password")
 	}
 
-	user, err := repository.GetUserByEmail(request.EmailAddress)
+	attempt, wait, err := startLogin(clock.Now(), request.EmailAddress, context.RemoteAddr)
 	if err != nil {
+		log.Printf("Error:  Unable to count failed logins: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+	if wait > 0 {
+		log.Printf("Error:  Too many failed logins, retry in %s", wait)
+		loginBlockedCount.Inc(1)
+		// tigertonic drops the headers of errors, so there is no body
+		seconds := int((wait + time.Second - 1) / time.Second)
+		return http.StatusTooManyRequests, http.Header{"Retry-After": {strconv.Itoa(seconds)}}, nil, nil
+	}
+
+	user, err := repository.GetUserByEmail(request.EmailAddress)
+	if err != nil && err != ErrNotFound {
 		log.Printf("Error:  Unable to get user from repo: %v", err)
-		return http.StatusUnauthorized, nil, nil, errors.New("Invalid password or unknown user")
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
 	}
 
-	match, _ := MatchPassword(request.Password, user.Password)
+	var match bool
+	if user != nil {
+		match, _ = MatchPassword(request.Password, user.Password)
+	} else {
+		matchNoPassword(request.Password)
+	}
 	if !match {
-		log.Println("Error:  Password is incorrect")
+		log.Println("Error:  Password is incorrect or user is unknown")
+		attempt.failed()
 		return http.StatusUnauthorized, nil, nil, errors.New("Invalid password or unknown user")
 	}
 
-	tokenValue := GetRandomString(16, "")
-	expires := time.Now().UTC().Add(time.Duration(1 * time.Hour))
+	// The account starts over, the address does not
+	err = attempt.succeeded()
+	if err != nil {
+		log.Printf("Error:  Unable to reset failed logins: %v", err)
+	}
 
-	t := Token{UserID: user.ID, Value: tokenValue, Expires: expires}
+	// Only the user learns that the password was right
+	if user.Verified.IsZero() {
+		log.Printf("Error:  Email address of user %d is not verified", user.ID)
+		return http.StatusForbidden, nil, nil, errors.New("Email address not verified")
+	}
 
-	// Save token to database
-	err = repository.SetToken(&t)
+	// Every login starts a new family of refresh tokens
+	lResp, err := newSession(user, GetRandomString(16, ""))
 	if err != nil {
-		log.Printf("Error:  Unable to get token from repo: %v", err)
+		log.Printf("Error:  Unable to store tokens: %v", err)
 		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
 	}
 
-	expiresSeconds := 3600 // seconds in 1 hour
-	lr := LoginResult{ID: user.ID,
-		EmailAddress: user.EmailAddress,
-		FirstName:    user.FirstName,
-		LastName:     user.LastName,
-		Role:         user.Role}
-	lResp := LoginResponse{Token: tokenValue,
-		TokenExpiry: expiresSeconds,
-		Result:      lr}
-
 	// All good!
-	return http.StatusOK, nil, &lResp, nil
+	return http.StatusOK, nil, lResp, nil
 }
 
 // logout will logout a session
@@ -191,14 +283,27 @@ func logout(u *url.URL, h http.Header, _ *emptyRequest, context *AuthContext) (i
 	var err error
 	defer CatchPanic(&err, "logout")
 
-	log.Printf("Going to logout: %v", context.User.EmailAddress)
+	log.Printf("Going to logout: %d", context.User.ID)
 
-	err = repository.DelToken(context.TokenValue)
+	if context.claims != nil {
+		err = revoke(context.claims.ID, time.Unix(context.claims.Expires, 0).UTC())
+	} else {
+		err = repository.DelToken(context.TokenValue)
+	}
 	if err != nil {
 		log.Printf("Error deleting token: %v", err)
 		return http.StatusInternalServerError, nil, nil, errors.New("Unable to delete token")
 	}
 
+	// The refresh tokens of the session cannot be used any more either
+	if context.TokenFamily != "" {
+		err = revokeFamily(context.TokenFamily)
+		if err != nil {
+			log.Printf("Error revoking token family: %v", err)
+			return http.StatusInternalServerError, nil, nil, errors.New("Unable to delete token")
+		}
+	}
+
 	return http.StatusOK, nil, nil, nil
 }
 
@@ -210,6 +315,7 @@ type RestUser struct {
 	LastName     string    `json:"lastname"`
 	Created      time.Time `json:"created"`
 	Role         role      `json:"role"`
+	Verified     bool      `json:"verified"`
 }
 
 type createUserRequest struct {
@@ -226,8 +332,17 @@ func createUser(u *url.URL, h http.Header, request *createUserRequest, context *
 
 	log.Printf("createUser called by: %s %s", context.RemoteAddr, context.UserAgent)
 
+	if !isPlainEmailAddress(request.EmailAddress) {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a valid email address")
+	}
+
+	if request.Password == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a password")
+	}
+
+	// The user cannot log in before the email address is verified
 	hashedPassword, _ := createHashedPassword(request.Password)
-	user := User{EmailAddress: request.EmailAddress, Password: hashedPassword, FirstName: request.Name, LastName: request.LastName, Role: RoleAdmin}
+	user := User{EmailAddress: request.EmailAddress, Password: hashedPassword, FirstName: request.Name, LastName: request.LastName, Created: time.Now().UTC(), Role: RoleApplication}
 
 	err = repository.SetUser(&user)
 
@@ -236,6 +351,12 @@ func createUser(u *url.URL, h http.Header, request *createUserRequest, context *
 		return http.StatusInternalServerError, nil, nil, nil
 	}
 
+	// Another mail can be asked for, so the user is created anyway
+	err = sendEmailVerification(&user)
+	if err != nil {
+		log.Printf("Unable to send email verification: %v", err)
+	}
+
 	ru := user.ToRestUser()
 
 	// All good!
@@ -251,11 +372,6 @@ func getUser(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (in
 
 	userID, err := strconv.Atoi(u.Query().Get("userID"))
 
-	// logged in applicant trying to view other user's profile
-	if context.User.Role == RoleApplication && context.User.ID != userID {
-		return http.StatusUnauthorized, nil, nil, errors.New("Access denied")
-	}
-
 	user, err := repository.GetUser(userID)
 
 	if err != nil {
@@ -266,49 +382,57 @@ func getUser(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (in
 	return http.StatusOK, nil, user.ToRestUser(), nil
 }
 
-// getUsers will get a user
-func getUsers(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []User, error) {
+// getUsers will get all users
+func getUsers(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*RestUser, error) {
 	var err error
 	defer CatchPanic(&err, "getUsers")
 
 	log.Println("getUsers Started")
 
-	if context.User.Role != RoleAdmin && context.User.Role != RoleSubAdmin {
-		return http.StatusUnauthorized, nil, nil, errors.New("Access denied")
-	}
-
 	users, err := repository.GetUsers()
 
 	if err != nil {
 		return http.StatusInternalServerError, nil, nil, nil
 	}
 
+	var restUsers []*RestUser
+
+	for _, user := range users {
+		restUsers = append(restUsers, user.ToRestUser())
+	}
+
 	// All good!
-	return http.StatusOK, nil, users, nil
+	return http.StatusOK, nil, restUsers, nil
 }
 
-// getApplications will get a list of all (???) applications
+// getApplications will get a page of the applications matching the query
 func getApplications(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*RestApplication, error) {
 	var err error
 	defer CatchPanic(&err, "getApplications")
 
 	log.Println("getApplications Started")
 
-	// Logged in applicant is trying to access a list of applications
-	if context.User.Role == RoleApplication {
-		return http.StatusUnauthorized, nil, nil, errors.New("Access denied")
+	query, err := parseApplicationQuery(u.Query(), context.User.Role)
+	if err == ErrHiddenApplicationField {
+		return http.StatusForbidden, nil, nil, err
+	}
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
 	}
 
-	applications, err := repository.GetApplications()
+	applications, total, err := repository.GetApplications(query)
 
 	if err != nil {
 		return http.StatusInternalServerError, nil, nil, nil
 	}
 
-	var restApplications []*RestApplication
+	restApplications := []*RestApplication{}
 
 	for _, application := range applications {
 		restApplication := application.ToRestApplication()
+		if restApplication == nil {
+			continue
+		}
 
 		if context.User.Role == RoleLimitedHelper {
 			trimForLimitedHelper(restApplication)
@@ -317,8 +441,197 @@ func getApplications(u *url.URL, h http.Header, _ interface{}, context *AuthCont
 		restApplications = append(restApplications, restApplication)
 	}
 
+	headers := http.Header{}
+	headers.Set("X-Total-Count", strconv.Itoa(total))
+
+	// All good!
+	return http.StatusOK, headers, restApplications, nil
+}
+
+// RestSearchResult ...
+type RestSearchResult struct {
+	Application *RestApplication `json:"application"`
+	Rank        float64          `json:"rank"`
+	Snippet     string           `json:"snippet"`
+}
+
+// searchApplications finds the applications matching the words in q, best match first
+func searchApplications(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*RestSearchResult, error) {
+	var err error
+	defer CatchPanic(&err, "searchApplications")
+
+	log.Println("searchApplications Started")
+
+	text := u.Query().Get("q")
+	if len(searchTerms(text)) == 0 {
+		return http.StatusBadRequest, nil, nil, errors.New("Nothing to search for")
+	}
+
+	limit := defaultSearchLimit
+	if u.Query().Get("limit") != "" {
+		limit, err = strconv.Atoi(u.Query().Get("limit"))
+		if err != nil || limit < 1 {
+			return http.StatusBadRequest, nil, nil, errors.New("Invalid limit")
+		}
+		if limit > maxSearchLimit {
+			limit = maxSearchLimit
+		}
+	}
+
+	// Limited helpers can neither find nor see the fields trimmed for them
+	limited := context.User.Role == RoleLimitedHelper
+
+	results, err := repository.SearchApplications(SearchQuery{Text: text, Private: !limited, Limit: limit})
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	restResults := []*RestSearchResult{}
+	for _, result := range results {
+		restApplication := result.Application.ToRestApplication()
+		if restApplication == nil {
+			continue
+		}
+
+		if limited {
+			trimForLimitedHelper(restApplication)
+		}
+
+		restResults = append(restResults, &RestSearchResult{Application: restApplication, Rank: result.Rank, Snippet: result.Snippet})
+	}
+
 	// All good!
-	return http.StatusOK, nil, restApplications, nil
+	return http.StatusOK, nil, restResults, nil
+}
+
+// Page sizes of the application listing
+const (
+	defaultApplicationLimit = 50
+	maxApplicationLimit     = 200
+)
+
+// ErrHiddenApplicationField is returned when a limited helper filters or sorts
+// the application listing by a field trimmed for them
+var ErrHiddenApplicationField = errors.New("Limited helpers cannot filter or sort by this field")
+
+// limitedHelperHiddenFilters are the filters on fields trimmed for limited
+// helpers.  The matches and the total count would give the values away.
+var limitedHelperHiddenFilters = []string{"nationality", "phone", "country", "gender", "education_level_id"}
+
+// parseApplicationQuery reads the filters, sort order and page of the
+// application listing from the URL.  Dates are RFC 3339 timestamps or plain
+// days, a plain day in created_to or edited_to includes the whole day.
+// Limited helpers may not use the fields trimmed for them.
+func parseApplicationQuery(values url.Values, r role) (ApplicationQuery, error) {
+	if r == RoleLimitedHelper {
+		for _, name := range limitedHelperHiddenFilters {
+			if values.Get(name) != "" {
+				return ApplicationQuery{}, ErrHiddenApplicationField
+			}
+		}
+	}
+
+	query := ApplicationQuery{
+		Status:      values.Get("status"),
+		Nationality: values.Get("nationality"),
+		Phone:       values.Get("phone"),
+		Country:     values.Get("country"),
+		Gender:      values.Get("gender"),
+		Limit:       defaultApplicationLimit,
+	}
+
+	if query.Status != "" && !validStatus(status(query.Status)) {
+		return query, ErrUnknownStatus
+	}
+
+	if query.Gender != "" && query.Gender != "male" && query.Gender != "female" {
+		return query, errors.New("Unknown gender")
+	}
+
+	var err error
+	integers := []struct {
+		name  string
+		value *int
+		min   int
+	}{
+		{"education_level_id", &query.EducationLevel, 1},
+		{"limit", &query.Limit, 1},
+		{"offset", &query.Offset, 0},
+	}
+	for _, i := range integers {
+		if values.Get(i.name) == "" {
+			continue
+		}
+		*i.value, err = strconv.Atoi(values.Get(i.name))
+		if err != nil || *i.value < i.min {
+			return query, fmt.Errorf("Invalid %s", i.name)
+		}
+	}
+
+	if query.Limit > maxApplicationLimit {
+		query.Limit = maxApplicationLimit
+	}
+
+	dates := []struct {
+		name  string
+		value *time.Time
+		end   bool
+	}{
+		{"created_from", &query.CreatedFrom, false},
+		{"created_to", &query.CreatedTo, true},
+		{"edited_from", &query.EditedFrom, false},
+		{"edited_to", &query.EditedTo, true},
+	}
+	for _, d := range dates {
+		*d.value, err = parseQueryDate(values.Get(d.name), d.end)
+		if err != nil {
+			return query, fmt.Errorf("Invalid %s", d.name)
+		}
+	}
+
+	// sort=-created_at sorts descending
+	query.Sort = values.Get("sort")
+	if strings.HasPrefix(query.Sort, "-") {
+		query.Sort = query.Sort[1:]
+		query.Descending = true
+	}
+	if query.Sort != "" {
+		known := false
+		for _, allowed := range allowedApplicationSorts {
+			known = known || query.Sort == allowed
+		}
+		if !known {
+			return query, errors.New("Unknown sort field")
+		}
+		if r == RoleLimitedHelper && query.Sort == sortByCountry {
+			return query, ErrHiddenApplicationField
+		}
+	}
+
+	return query, nil
+}
+
+// parseQueryDate parses a timestamp or a day.  If end is set a day is
+// returned as the start of the next day.
+func parseQueryDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return day, nil
 }
 
 // getApplication will get an application
@@ -330,11 +643,6 @@ func getApplication(u *url.URL, h http.Header, _ interface{}, context *AuthConte
 
 	userID, err := strconv.Atoi(u.Query().Get("userID"))
 
-	// Logged in applicant is trying to view another user's application
-	if context.User.Role == RoleApplication && context.User.ID != userID {
-		return http.StatusUnauthorized, nil, nil, errors.New("Access denied")
-	}
-
 	application, err := repository.GetApplicationOf(userID)
 
 	if err != nil {
@@ -369,6 +677,9 @@ type RestApplication struct {
 	Gender                string    `json:"gender"`
 	EducationLevel        int       `json:"education_level_id"`
 	Status                string    `json:"status"`
+	StatusChangedBy       int       `json:"status_changed_by"`
+	StatusChangedAt       time.Time `json:"status_changed_at"`
+	StatusReason          string    `json:"status_reason"`
 	Created               time.Time `json:"created_at"`
 	Edited                time.Time `json:"edited_at"`
 }
@@ -410,7 +721,8 @@ func createApplication(u *url.URL, h http.Header, request *createApplicationRequ
 
 	userID, err := strconv.Atoi(u.Query().Get("userID"))
 
-	application := Application{Birthday: request.Birthday, PhoneNumber: request.PhoneNumber, Nationality: request.Nationality, Country: request.Country, City: request.City, Zip: request.Zip, AddressExtra: request.AddressExtra, FirstPageOfSurveyData: request.FirstPageOfSurveyData, Gender: request.Gender, UserID: userID, EducationLevel: request.EducationLevel}
+	now := time.Now().UTC()
+	application := Application{Birthday: request.Birthday, PhoneNumber: request.PhoneNumber, Nationality: request.Nationality, Country: request.Country, City: request.City, Zip: request.Zip, Address: request.Address, AddressExtra: request.AddressExtra, FirstPageOfSurveyData: request.FirstPageOfSurveyData, Gender: request.Gender, UserID: userID, EducationLevel: request.EducationLevel, Status: string(statusReceived), Created: now, Edited: now}
 
 	err = repository.SetApplication(&application)
 
@@ -422,7 +734,100 @@ func createApplication(u *url.URL, h http.Header, request *createApplicationRequ
 	return http.StatusCreated, nil, application.ToRestApplication(), nil
 }
 
-func getDocuments(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, [][]byte, error) {
+type changeStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// changeApplicationStatus moves an application to another status of the workflow
+func changeApplicationStatus(u *url.URL, h http.Header, request *changeStatusRequest, context *AuthContext) (int, http.Header, *RestApplication, error) {
+	var err error
+	defer CatchPanic(&err, "changeApplicationStatus")
+
+	log.Println("changeApplicationStatus Started")
+
+	userID, err := strconv.Atoi(u.Query().Get("userID"))
+
+	application, err := repository.GetApplicationOf(userID)
+	if err != nil {
+		return http.StatusNotFound, nil, nil, errors.New("Application not found")
+	}
+
+	change, err := newStatusChange(application, status(request.Status), context.User, request.Reason, time.Now().UTC())
+	switch err {
+	case nil:
+	case ErrUnknownStatus, ErrReasonRequired:
+		return http.StatusBadRequest, nil, nil, err
+	case ErrTransitionNotPermitted:
+		return http.StatusForbidden, nil, nil, err
+	default:
+		return http.StatusConflict, nil, nil, err
+	}
+
+	err = repository.TransitionApplication(change)
+	if err == ErrStatusConflict {
+		return http.StatusConflict, nil, nil, err
+	}
+	if err != nil {
+		log.Printf("Unable to change status: %v", err)
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	application, err = repository.GetApplication(application.ID)
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	restApplication := application.ToRestApplication()
+
+	if context.User.Role == RoleLimitedHelper {
+		trimForLimitedHelper(restApplication)
+	}
+
+	// All good!
+	return http.StatusOK, nil, restApplication, nil
+}
+
+// RestStatusChange ...
+type RestStatusChange struct {
+	ID            int       `json:"id"`
+	ApplicationID int       `json:"application_id"`
+	From          string    `json:"old_status"`
+	To            string    `json:"new_status"`
+	UserID        int       `json:"user_id"`
+	Reason        string    `json:"reason"`
+	Changed       time.Time `json:"changed_at"`
+}
+
+// getStatusHistory returns every status change of an application, oldest first
+func getStatusHistory(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*RestStatusChange, error) {
+	var err error
+	defer CatchPanic(&err, "getStatusHistory")
+
+	log.Println("getStatusHistory Started")
+
+	userID, err := strconv.Atoi(u.Query().Get("userID"))
+
+	application, err := repository.GetApplicationOf(userID)
+	if err != nil {
+		return http.StatusNotFound, nil, nil, errors.New("Application not found")
+	}
+
+	history, err := repository.GetStatusHistory(application.ID)
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	restHistory := []*RestStatusChange{}
+	for _, change := range history {
+		restHistory = append(restHistory, &RestStatusChange{ID: change.ID, ApplicationID: change.ApplicationID, From: change.From, To: change.To, UserID: change.UserID, Reason: change.Reason, Changed: change.Changed})
+	}
+
+	// All good!
+	return http.StatusOK, nil, restHistory, nil
+}
+
+func getDocuments(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*RestDocument, error) {
 	var err error
 	defer CatchPanic(&err, "getDocuments")
 
@@ -436,8 +841,13 @@ func getDocuments(u *url.URL, h http.Header, _ interface{}, context *AuthContext
 		return http.StatusInternalServerError, nil, nil, nil
 	}
 
+	restDocuments := []*RestDocument{}
+	for _, document := range documents {
+		restDocuments = append(restDocuments, document.ToRestDocument())
+	}
+
 	// All good!
-	return http.StatusOK, nil, documents, nil
+	return http.StatusOK, nil, restDocuments, nil
 }
 
 func createDocuments(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, []*Document, error) {
@@ -472,7 +882,6 @@ func getComments(u *url.URL, h http.Header, _ interface{}, context *AuthContext)
 }
 
 type createCommentRequest struct {
-	UserID   int    `json:"user_id"`
 	Contents string `json:"contents"`
 }
 
@@ -483,7 +892,7 @@ func createComment(u *url.URL, h http.Header, request *createCommentRequest, con
 	log.Println("createComment Started")
 
 	applicationID, err := strconv.Atoi(u.Query().Get("applicationID"))
-	comment := Comment{ApplicationID: applicationID, UserID: request.UserID, Contents: request.Contents}
+	comment := Comment{Created: time.Now().UTC(), ApplicationID: applicationID, UserID: context.User.ID, Contents: request.Contents}
 
 	err = repository.SetComment(&comment)
 
@@ -504,43 +913,300 @@ func NewRawUploadHandler() RawUploadHandler {
 	return RawUploadHandler{}
 }
 
-// ServeHTTP ...
+// ServeHTTP streams the body to the blobs.  Uploads larger than the size
+// limits are refused with 413, before they are read if the size is known.
 func (handler RawUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 	defer CatchPanic(&err, "BlockRawUploadHandler")
 	log.Println("Got PUT upload request")
 
-	_, err = getContext(r)
+	context := tigertonic.Context(r).(*AuthContext)
+
+	// The application comes from the route so it has been checked by authorize
+	applicationID, err := strconv.Atoi(r.URL.Query().Get("applicationID"))
+
+	defer r.Body.Close()
+
+	// Check the document type before anything is read or stored
+	documentTypeID, err := strconv.Atoi(r.Header.Get("documentTypeID"))
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		http.Error(w, "Invalid documentTypeID", http.StatusBadRequest)
 		return
 	}
 
-	// Can I do this?
-	//context := tigertonic.Context(r).(*AuthContext)
+	documentTypes, err := repository.GetDocumentTypes()
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
 
-	applicationID, err := strconv.Atoi(r.Header.Get("applicationID"))
-	documentTypeID, err := strconv.Atoi(r.Header.Get("documentTypeID"))
+	documentTypeName := ""
+	for _, documentType := range documentTypes {
+		if documentType.ID == documentTypeID {
+			documentTypeName = documentType.Name
+		}
+	}
+	if documentTypeName == "" {
+		http.Error(w, fmt.Sprintf("Unknown documentTypeID %d", documentTypeID), http.StatusBadRequest)
+		return
+	}
 
-	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+	documents, err := repository.GetDocuments(applicationID)
 	if err != nil {
 		HandleErrorWithResponse(w, err)
 		return
 	}
 
-	document := Document{ApplicationID: applicationID, DocumentTypeID: documentTypeID, Contents: body}
+	limit, limitMessage := uploadLimit(documents)
+	if r.ContentLength > limit {
+		http.Error(w, limitMessage, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key, err := newBlobKey(applicationID)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
 
-	err = repository.StoreDocument(&document)
+	store, keyID, dataKey, err := newDocumentStore(blobs, masterKeys)
 	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	digest := newDocumentDigest()
+	contents := io.TeeReader(r.Body, digest)
+
+	if r.ContentLength >= 0 {
+		err = store.Put(key, contents, r.ContentLength)
+	} else {
+		err = putSpooled(store, key, contents, limit)
+	}
+	if err == errDocumentTooLarge {
+		http.Error(w, limitMessage, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	filename := uploadFilename(r.Header.Get("Content-Disposition"))
+	document := digest.document(applicationID, documentTypeID, context.User.ID, filename, time.Now().UTC())
+	document.DocumentType = documentTypeName
+	document.StorageKey = key
+	document.KeyID, document.DataKey = keyID, dataKey
+
+	err = repository.StoreDocument(document)
+	if err != nil {
+		// Do not leave contents behind that no document points to
+		if err := blobs.Delete(document.StorageKey); err != nil {
+			log.Printf("Unable to delete blob %s: %v", document.StorageKey, err)
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// The document stays pending if the scanners cannot be reached
+	err = checkDocument(repository, blobs, documentScanner, document)
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("ETag", documentETag(document))
+	w.Header().Set("X-Scan-Status", document.ScanStatus)
 	w.WriteHeader(http.StatusCreated)
 
 }
 
+// RestDocument ...
+type RestDocument struct {
+	ID             int       `json:"id"`
+	ApplicationID  int       `json:"application_id"`
+	DocumentTypeID int       `json:"document_type_id"`
+	DocumentType   string    `json:"document_type"`
+	Filename       string    `json:"filename"`
+	ContentType    string    `json:"content_type"`
+	Size           int64     `json:"size"`
+	Checksum       string    `json:"sha256"`
+	UploadedBy     int       `json:"uploaded_by"`
+	Created        time.Time `json:"uploaded_at"`
+	ScanStatus     string    `json:"scan_status"`
+	ScanResult     string    `json:"scan_result,omitempty"`
+}
+
+// maxDocumentsPerUpload is the number of files a multipart upload may contain
+const maxDocumentsPerUpload = 20
+
+// MultipartUploadHandler handles POST operations with multipart/form-data.
+// Every "file" field is a document, its type is the "document_type_id" field
+// at the same position.
+type MultipartUploadHandler struct {
+}
+
+// NewMultipartUploadHandler ...
+func NewMultipartUploadHandler() MultipartUploadHandler {
+	return MultipartUploadHandler{}
+}
+
+// ServeHTTP streams every file to the blobs and stores the documents if all
+// of them are fine.  Otherwise nothing is kept.
+func (handler MultipartUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	defer CatchPanic(&err, "MultipartUploadHandler")
+	log.Println("Got multipart upload request")
+
+	context := tigertonic.Context(r).(*AuthContext)
+
+	// The application comes from the route so it has been checked by authorize
+	applicationID, err := strconv.Atoi(r.URL.Query().Get("applicationID"))
+
+	defer r.Body.Close()
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := repository.GetDocuments(applicationID)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	var (
+		documentTypeIDs []int
+		documents       []*Document
+		stored          bool
+	)
+
+	// Remove the blobs again unless all documents are stored
+	defer func() {
+		if stored {
+			return
+		}
+		for _, document := range documents {
+			if err := blobs.Delete(document.StorageKey); err != nil {
+				log.Printf("Unable to delete blob %s: %v", document.StorageKey, err)
+			}
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart/form-data", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "document_type_id":
+			value, err := ioutil.ReadAll(io.LimitReader(part, 32))
+			documentTypeID, cerr := strconv.Atoi(strings.TrimSpace(string(value)))
+			if err != nil || cerr != nil {
+				http.Error(w, "Invalid document_type_id", http.StatusBadRequest)
+				return
+			}
+			documentTypeIDs = append(documentTypeIDs, documentTypeID)
+
+		case "file":
+			if len(documents) == maxDocumentsPerUpload {
+				http.Error(w, fmt.Sprintf("At most %d files can be uploaded at once", maxDocumentsPerUpload), http.StatusBadRequest)
+				return
+			}
+
+			key, err := newBlobKey(applicationID)
+			if err != nil {
+				HandleErrorWithResponse(w, err)
+				return
+			}
+
+			// The files before this one count against the quota too
+			limit, limitMessage := uploadLimit(append(existing, documents...))
+
+			store, keyID, dataKey, err := newDocumentStore(blobs, masterKeys)
+			if err != nil {
+				HandleErrorWithResponse(w, err)
+				return
+			}
+
+			digest := newDocumentDigest()
+			err = putSpooled(store, key, io.TeeReader(part, digest), limit)
+			if err == errDocumentTooLarge {
+				http.Error(w, limitMessage, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				HandleErrorWithResponse(w, err)
+				return
+			}
+
+			document := digest.document(applicationID, 0, context.User.ID, cleanFilename(part.FileName()), time.Now().UTC())
+			document.StorageKey = key
+			document.KeyID, document.DataKey = keyID, dataKey
+			documents = append(documents, document)
+		}
+
+		part.Close()
+	}
+
+	if len(documents) == 0 {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+
+	if len(documentTypeIDs) != len(documents) {
+		http.Error(w, "Every file needs a document_type_id", http.StatusBadRequest)
+		return
+	}
+
+	documentTypes, err := repository.GetDocumentTypes()
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+
+	names := make(map[int]string)
+	for _, documentType := range documentTypes {
+		names[documentType.ID] = documentType.Name
+	}
+
+	for i, document := range documents {
+		name, ok := names[documentTypeIDs[i]]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown document_type_id %d", documentTypeIDs[i]), http.StatusBadRequest)
+			return
+		}
+		document.DocumentTypeID = documentTypeIDs[i]
+		document.DocumentType = name
+	}
+
+	err = repository.StoreDocuments(documents)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+	stored = true
+
+	restDocuments := []*RestDocument{}
+	for _, document := range documents {
+		err = checkDocument(repository, blobs, documentScanner, document)
+		if err != nil {
+			log.Println(err)
+		}
+		restDocuments = append(restDocuments, document.ToRestDocument())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(restDocuments)
+}
+
 // FileDownloadHandler ...
 type FileDownloadHandler struct {
 }
@@ -555,33 +1221,75 @@ func (handler FileDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 	var err error
 	defer CatchPanic(&err, "FileDownloadHandler")
 
-	_, err = getContext(r)
+	documentID, err := strconv.Atoi(r.URL.Query().Get("documentID"))
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		HandleErrorWithResponse(w, err)
 		return
 	}
 
-	documentID, err := strconv.Atoi(r.URL.Query().Get("documentID"))
+	document, err := repository.GetDocument(documentID)
 	if err != nil {
 		HandleErrorWithResponse(w, err)
 		return
 	}
 
-	document, err := repository.GetDocument(documentID)
+	log.Printf("Download Document [%v]", documentID)
+
+	// Nothing is handed out before the scanners let it through
+	switch document.ScanStatus {
+	case scanClean:
+	case scanQuarantined:
+		http.Error(w, "Document is quarantined: "+document.ScanResult, http.StatusConflict)
+		return
+	default:
+		http.Error(w, "Document has not been scanned yet", http.StatusConflict)
+		return
+	}
+
+	if document.StorageKey == "" {
+		HandleErrorWithResponse(w, errors.New("Document contents have not been moved to the blob store, run 'kiron documents migrate-blobs'"))
+		return
+	}
+
+	// Decrypts the contents if they are encrypted
+	store, err := documentStore(blobs, masterKeys, document)
 	if err != nil {
 		HandleErrorWithResponse(w, err)
 		return
 	}
 
-	log.Printf("Download Document [%v]", documentID)
+	contents, err := store.Get(document.StorageKey)
+	if err != nil {
+		HandleErrorWithResponse(w, err)
+		return
+	}
+	defer contents.Close()
+
+	contentType := document.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
 
 	header := w.Header()
-	header["Content-Type"] = []string{"application/octet-stream"}
-	w.Write(document.Contents)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", contentDisposition(document))
+	header.Set("X-Content-Type-Options", "nosniff")
+	if document.Checksum != "" {
+		header.Set("ETag", documentETag(document))
+	}
+
+	// Takes care of Range, If-Range and If-None-Match
+	http.ServeContent(w, r, "", document.Created, contents)
 
 	log.Println("Download complete")
 }
 
+// getMetrics writes the current value of every metric as JSON
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	metrics.WriteJSONOnce(metrics.DefaultRegistry, w)
+}
+
 // checkClose is used to check the return from Close in a defer
 // statement.
 func checkClose(c io.Closer, err *error) {
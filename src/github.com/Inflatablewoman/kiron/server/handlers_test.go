@@ -6,30 +6,36 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-tigertonic"
 	"github.com/stretchr/testify/require"
 )
 
 var client = http.DefaultClient
 
-func TestCreateAndLoginUser(t *testing.T) {
+// newTestServer starts the handlers on a local listener backed by an in-memory
+// repository and blob store
+func newTestServer(t *testing.T) (*httptest.Server, DataRepository) {
+	repo, err := getMemoryDB()
+	require.NoError(t, err)
 
-	host := os.Getenv("KIRON_HOST")
-	if host == "" {
-		host = "localhost"
-	}
+	repository = repo
+	blobs = newMemoryBlobStore()
+	mailer = newTestMailer()
 
-	port := os.Getenv("KIRON_PORT")
-	if port == "" {
-		port = "80"
-	}
+	mux := tigertonic.NewTrieServeMux()
+	RegisterHTTPHandlers(mux)
 
-	// Create an admin in the database...
-	repo, err := getPostgresDB()
-	require.NoError(t, err)
+	return httptest.NewServer(mux), repo
+}
+
+func TestCreateAndLoginUser(t *testing.T) {
+
+	server, repo := newTestServer(t)
+	defer server.Close()
 
 	emailAddress := fmt.Sprintf("test_admin_%s@%s.com", GetRandomString(5, ""), GetRandomString(5, ""))
 	firstName := "Admin"
@@ -40,7 +46,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	bcryptPassword, err := createHashedPassword(password)
 	t.Logf("hashPassword: %s", bcryptPassword)
 	require.NoError(t, err)
-	user := User{EmailAddress: emailAddress, FirstName: firstName, LastName: lastName, Password: bcryptPassword, Created: created, Role: RoleAdmin}
+	user := User{EmailAddress: emailAddress, FirstName: firstName, LastName: lastName, Password: bcryptPassword, Created: created, Role: RoleAdmin, Verified: created}
 
 	t.Logf("Adding user: %v", user)
 
@@ -55,7 +61,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	requestBytes, err := json.Marshal(lr)
 	require.NoError(t, err)
 
-	lurURL := fmt.Sprintf("http://%s:%s/api/v1/login", host, port)
+	lurURL := fmt.Sprintf("%s/api/v1/login", server.URL)
 
 	request, err := http.NewRequest("POST", lurURL, bytes.NewBuffer(requestBytes))
 	require.NoError(t, err)
@@ -82,7 +88,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	require.Len(t, loginResp.Token, 16)
 	require.Equal(t, loginResp.TokenExpiry, 3600)
 
-	curURL := fmt.Sprintf("http://%s:%s/api/v1/users", host, port)
+	curURL := fmt.Sprintf("%s/api/v1/users", server.URL)
 
 	emailAddress = fmt.Sprintf("test_user_%s@%s.com", GetRandomString(5, ""), GetRandomString(5, ""))
 	firstName = "bob"
@@ -118,6 +124,13 @@ func TestCreateAndLoginUser(t *testing.T) {
 	require.Equal(t, emailAddress, repoUser.EmailAddress)
 	require.Equal(t, firstName, repoUser.FirstName)
 	require.Equal(t, lastName, repoUser.LastName)
+	require.False(t, repoUser.Verified)
+
+	// The new user verifies the email address before logging in
+	require.Equal(t, http.StatusForbidden, postTestLogin(t, server.URL, emailAddress, password).StatusCode)
+	mail := nextTestMail(t)
+	require.Equal(t, emailAddress, mail.To)
+	require.Equal(t, http.StatusOK, postTestVerify(t, server.URL, tokenFromMail(t, "/verify", mail)))
 
 	lr = loginRequest{EmailAddress: emailAddress, Password: password}
 
@@ -126,7 +139,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	requestBytes, err = json.Marshal(lr)
 	require.NoError(t, err)
 
-	lurURL = fmt.Sprintf("http://%s:%s/api/v1/login", host, port)
+	lurURL = fmt.Sprintf("%s/api/v1/login", server.URL)
 
 	request, err = http.NewRequest("POST", lurURL, bytes.NewBuffer(requestBytes))
 	require.NoError(t, err)
@@ -175,7 +188,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	requestBytes, err = json.Marshal(createAppReq)
 	require.NoError(t, err)
 
-	cAppURL := fmt.Sprintf("http://%s:%s/api/v1/users/%v/application", host, port, repoUser.ID)
+	cAppURL := fmt.Sprintf("%s/api/v1/users/%v/application", server.URL, repoUser.ID)
 
 	request, err = http.NewRequest("POST", cAppURL, bytes.NewBuffer(requestBytes))
 	require.NoError(t, err)
@@ -186,7 +199,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 	response, err = client.Do(request)
 	require.NoError(t, err)
 
-	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, http.StatusCreated, response.StatusCode)
 
 	body, err = ioutil.ReadAll(response.Body)
 	require.NoError(t, err)
@@ -218,7 +231,7 @@ func TestCreateAndLoginUser(t *testing.T) {
 
 	// Download
 
-	lurURL = fmt.Sprintf("http://%s:%s/api/v1/logout", host, port)
+	lurURL = fmt.Sprintf("%s/api/v1/logout", server.URL)
 
 	er := emptyRequest{}
 	requestBytes, err = json.Marshal(er)
@@ -236,3 +249,68 @@ func TestCreateAndLoginUser(t *testing.T) {
 	require.Equal(t, http.StatusOK, response.StatusCode)*/
 
 }
+
+func TestGetApplications(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	helperToken := loginTestUser(t, repo, createTestUser(t, repo, RoleLimitedHelper))
+	trustedToken := loginTestUser(t, repo, createTestUser(t, repo, RoleTrustedHelper))
+
+	for i := 0; i < 3; i++ {
+		createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+	}
+
+	listURL := fmt.Sprintf("%s/api/v1/applications?limit=2&offset=1&sort=-id&nationality=Marsian", server.URL)
+
+	request, err := http.NewRequest("GET", listURL, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+trustedToken)
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "3", response.Header.Get("X-Total-Count"))
+
+	var applications []RestApplication
+	err = json.NewDecoder(response.Body).Decode(&applications)
+	require.NoError(t, err)
+	require.Len(t, applications, 2)
+	require.True(t, applications[0].ID > applications[1].ID)
+	require.Equal(t, "marsian", applications[0].Nationality)
+
+	// Limited helpers still only see the trimmed applications
+	request, err = http.NewRequest("GET", server.URL+"/api/v1/applications?limit=2&sort=-id", nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+helperToken)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	applications = nil
+	err = json.NewDecoder(response.Body).Decode(&applications)
+	require.NoError(t, err)
+	require.Len(t, applications, 2)
+	for _, a := range applications {
+		require.Empty(t, a.Nationality)
+		require.Empty(t, a.PhoneNumber)
+	}
+
+	// ... and can not narrow the listing by the trimmed fields either
+	for _, query := range []string{"nationality=marsian", "phone=555", "country=for+old+men", "gender=female", "education_level_id=2", "sort=country", "sort=-country"} {
+		response = doTestRequest(t, "GET", server.URL+"/api/v1/applications?"+query, helperToken, "")
+		require.Equal(t, http.StatusForbidden, response.StatusCode, query)
+
+		response = doTestRequest(t, "GET", server.URL+"/api/v1/applications?"+query, trustedToken, "")
+		require.Equal(t, http.StatusOK, response.StatusCode, query)
+	}
+
+	for _, query := range []string{"limit=0", "offset=-1", "status=lost", "gender=x", "sort=password", "created_from=yesterday"} {
+		response = doTestRequest(t, "GET", server.URL+"/api/v1/applications?"+query, trustedToken, "")
+		require.Equal(t, http.StatusBadRequest, response.StatusCode, query)
+	}
+}
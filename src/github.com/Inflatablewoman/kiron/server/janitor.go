@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultJanitorInterval is the time between two purges of expired tokens
+// unless KIRON_TOKEN_JANITOR_INTERVAL says otherwise
+const defaultJanitorInterval = 10 * time.Minute
+
+// StartTokenJanitor deletes expired tokens from the repository in the
+// background.  Expired tokens are refused anyway, the janitor only keeps
+// them from piling up, and so do failed logins that are forgotten.  With
+// signed tokens it also reloads the revocation list.
+func StartTokenJanitor() (*Task, error) {
+	interval := defaultJanitorInterval
+	if value := os.Getenv("KIRON_TOKEN_JANITOR_INTERVAL"); value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval < time.Second {
+			return nil, errors.New("KIRON_TOKEN_JANITOR_INTERVAL has to be a duration of at least a second")
+		}
+	}
+
+	return startTask("token janitor", interval, func(now time.Time) {
+		// Failures are tried again next time
+		err := repository.DelExpiredTokens()
+		if err != nil {
+			log.Printf("Unable to delete expired tokens: %v", err)
+		}
+
+		err = repository.DelExpiredLoginFailures(now.Add(-loginFailureWindow))
+		if err != nil {
+			log.Printf("Unable to delete expired login failures: %v", err)
+		}
+
+		// Pick up the revocations of other kiron processes
+		if signingKeys != nil {
+			err = loadRevocations()
+			if err != nil {
+				log.Printf("Unable to load revoked tokens: %v", err)
+			}
+		}
+	}), nil
+}
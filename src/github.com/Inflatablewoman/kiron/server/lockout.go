@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Failed logins are counted per account and per address.  After a few
+// failures every attempt has to wait twice as long as the one before, an
+// account is locked for a while after many.  Accounts are counted by the
+// email address given, known or not, so the responses do not tell which
+// addresses have an account.
+type loginLimits struct {
+	FreeAttempts    int           // failures before the backoff starts
+	MaxDelay        time.Duration // longest wait between two attempts
+	LockoutAttempts int           // failures that lock, 0 never locks
+	Lockout         time.Duration
+}
+
+var (
+	accountLoginLimits = loginLimits{FreeAttempts: 3, MaxDelay: 5 * time.Minute, LockoutAttempts: 10, Lockout: 15 * time.Minute}
+
+	// Many applicants may log in from the address of the same shelter, so
+	// addresses are only slowed down
+	addressLoginLimits = loginLimits{FreeAttempts: 20, MaxDelay: 5 * time.Minute}
+
+	// loginFailureWindow forgets the failures of an account or address that
+	// has not failed for so long.  It has to be longer than the lockout.
+	loginFailureWindow = time.Hour
+)
+
+// Failed logins, the attempts refused while waiting and the lockouts are
+// counted with go-metrics
+var (
+	loginFailuresCount = metrics.GetOrRegisterCounter("login.failures", metrics.DefaultRegistry)
+	loginBlockedCount  = metrics.GetOrRegisterCounter("login.blocked", metrics.DefaultRegistry)
+	loginLockoutsCount = metrics.GetOrRegisterCounter("login.lockouts", metrics.DefaultRegistry)
+)
+
+// loginKey is what failures are counted by.  It is keyed with the token key
+// like the tokens, so the repository holds no email or IP addresses.
+func loginKey(kind, value string) string {
+	return kind + ":" + hashToken(strings.ToLower(strings.TrimSpace(value)))
+}
+
+func accountLoginKey(emailAddress string) string {
+	return loginKey("account", emailAddress)
+}
+
+func addressLoginKey(remoteAddr string) string {
+	return loginKey("address", remoteAddr)
+}
+
+// blockedUntil returns when the next attempt is allowed after the failures
+func (l loginLimits) blockedUntil(failures *LoginFailures) time.Time {
+	if failures.Failures < l.FreeAttempts {
+		return time.Time{}
+	}
+
+	if l.LockoutAttempts > 0 && failures.Failures >= l.LockoutAttempts {
+		return failures.LastFailure.Add(l.Lockout)
+	}
+
+	delay := l.MaxDelay
+	if shift := uint(failures.Failures - l.FreeAttempts); shift < 32 && time.Second<<shift < delay {
+		delay = time.Second << shift
+	}
+	return failures.LastFailure.Add(delay)
+}
+
+// loginKeys pairs the keys of an attempt with their limits
+func loginKeys(emailAddress, remoteAddr string) map[string]loginLimits {
+	return map[string]loginLimits{
+		accountLoginKey(emailAddress): accountLoginLimits,
+		addressLoginKey(remoteAddr):   addressLoginLimits,
+	}
+}
+
+// loginAttempt is a login that is counted as failed until its password
+// matched.  Checking a password takes a while, so parallel attempts would
+// all pass the limits before any of them failed if they were only counted
+// afterwards.
+type loginAttempt struct {
+	now      time.Time
+	account  string
+	address  string
+	previous map[string]*LoginFailures // before the attempt, by key
+	failures map[string]*LoginFailures // with the attempt, by key
+	limits   map[string]loginLimits
+}
+
+// startLogin counts the attempt of the account from the address as failed.
+// It returns how long to wait instead if the account or the address have to
+// wait, or another attempt came first.
+func startLogin(now time.Time, emailAddress, remoteAddr string) (*loginAttempt, time.Duration, error) {
+	attempt := loginAttempt{now: now,
+		account:  accountLoginKey(emailAddress),
+		address:  addressLoginKey(remoteAddr),
+		previous: make(map[string]*LoginFailures),
+		failures: make(map[string]*LoginFailures),
+		limits:   loginKeys(emailAddress, remoteAddr)}
+
+	forgetBefore := now.Add(-loginFailureWindow)
+	var until time.Time
+	for key, limits := range attempt.limits {
+		failures, err := repository.GetLoginFailures(key)
+		if err == ErrNotFound || (err == nil && failures.LastFailure.Before(forgetBefore)) {
+			failures = &LoginFailures{Key: key}
+			err = nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		attempt.previous[key] = failures
+		if blocked := limits.blockedUntil(failures); blocked.After(until) {
+			until = blocked
+		}
+	}
+	if until.After(now) {
+		return nil, until.Sub(now), nil
+	}
+
+	for key, limits := range attempt.limits {
+		failures, err := repository.AddLoginFailure(key, now, forgetBefore)
+		if err != nil {
+			return nil, 0, err
+		}
+		attempt.failures[key] = failures
+
+		// Beyond the free attempts only the first of parallel attempts may
+		// go on, the others have to wait for its backoff
+		if failures.Failures > limits.FreeAttempts && failures.Failures != attempt.previous[key].Failures+1 {
+			if blocked := limits.blockedUntil(&LoginFailures{Failures: failures.Failures - 1, LastFailure: now}); blocked.After(until) {
+				until = blocked
+			}
+		}
+	}
+	if until.After(now) {
+		return nil, until.Sub(now), nil
+	}
+
+	return &attempt, 0, nil
+}
+
+// failed keeps the attempt counted as failed
+func (a *loginAttempt) failed() {
+	loginFailuresCount.Inc(1)
+
+	// Attempts are refused while locked, so every failure from here on is
+	// the last before a lockout
+	for key, failures := range a.failures {
+		limits := a.limits[key]
+		if limits.LockoutAttempts > 0 && failures.Failures >= limits.LockoutAttempts {
+			log.Printf("Locking an account for %s after %d failed logins", limits.Lockout, failures.Failures)
+			loginLockoutsCount.Inc(1)
+		}
+	}
+}
+
+// succeeded starts the account over and takes the attempt back from the
+// address, whose earlier failures are kept
+func (a *loginAttempt) succeeded() error {
+	err := repository.DelLoginFailures(a.account)
+	if err != nil {
+		return err
+	}
+
+	return repository.UndoLoginFailure(a.address, a.now, a.previous[a.address].LastFailure)
+}
+
+var (
+	noPasswordOnce sync.Once
+	noPassword     string
+)
+
+// matchNoPassword takes as long as checking the password of a user, so
+// unknown email addresses cannot be told by the time a login takes
+func matchNoPassword(password string) {
+	noPasswordOnce.Do(func() {
+		noPassword, _ = createHashedPassword(GetRandomString(16, ""))
+	})
+
+	MatchPassword(password, noPassword)
+}
+
+// unlockUser forgets the failed logins of the user's account so it can log
+// in right away.  Failures of the addresses it was tried from are kept.
+func unlockUser(u *url.URL, h http.Header, _ interface{}, context *AuthContext) (int, http.Header, interface{}, error) {
+	var err error
+	defer CatchPanic(&err, "unlockUser")
+
+	userID, err := strconv.Atoi(u.Query().Get("userID"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("Invalid user id")
+	}
+
+	user, err := repository.GetUser(userID)
+	if err == ErrNotFound {
+		return http.StatusNotFound, nil, nil, errors.New("User not found")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	err = repository.DelLoginFailures(accountLoginKey(user.EmailAddress))
+	if err != nil {
+		log.Printf("Unable to unlock user %d: %v", userID, err)
+		return http.StatusInternalServerError, nil, nil, nil
+	}
+
+	log.Printf("Unlocked user %d for user %d", userID, context.User.ID)
+
+	// All good!
+	return http.StatusOK, nil, nil, nil
+}
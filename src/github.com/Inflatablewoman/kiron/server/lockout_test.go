@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockedUntil(t *testing.T) {
+	last := time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+	limits := loginLimits{FreeAttempts: 3, MaxDelay: 10 * time.Second, LockoutAttempts: 8, Lockout: 15 * time.Minute}
+
+	for failures, wait := range []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 15 * time.Minute, 15 * time.Minute} {
+		until := limits.blockedUntil(&LoginFailures{Failures: failures, LastFailure: last})
+		if wait == 0 {
+			require.True(t, until.IsZero(), "%d failures", failures)
+			continue
+		}
+		require.Equal(t, last.Add(wait), until, "%d failures", failures)
+	}
+
+	// Without lockout the wait does not grow beyond the maximum
+	limits.LockoutAttempts = 0
+	require.Equal(t, last.Add(10*time.Second), limits.blockedUntil(&LoginFailures{Failures: 100, LastFailure: last}))
+}
+
+// postTestLogin tries to log in and returns the response
+func postTestLogin(t *testing.T, serverURL, emailAddress, password string) *http.Response {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/login", "", fmt.Sprintf(`{"email": %q, "password": %q}`, emailAddress, password))
+}
+
+func TestLoginLockout(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+
+	// All requests come from the same address, which is tested on its own
+	defer func(limits loginLimits) { addressLoginLimits = limits }(addressLoginLimits)
+	addressLoginLimits.FreeAttempts = 100
+
+	user := createTestUser(t, repo, RoleTrustedHelper)
+	unknown := fmt.Sprintf("unknown_%s@example.com", GetRandomString(5, ""))
+	failures := loginFailuresCount.Count()
+	lockouts := loginLockoutsCount.Count()
+
+	// Known and unknown accounts look the same from outside
+	for _, emailAddress := range []string{user.EmailAddress, unknown} {
+		for i := 0; i < accountLoginLimits.FreeAttempts; i++ {
+			require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, emailAddress, "wrong").StatusCode)
+		}
+
+		// Backing off, even with the right password
+		for i := 0; accountLoginLimits.FreeAttempts+i < accountLoginLimits.LockoutAttempts; i++ {
+			wait := time.Second << uint(i)
+			response := postTestLogin(t, server.URL, emailAddress, "westEndGirls")
+			require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+			require.Equal(t, fmt.Sprint(int(wait/time.Second)), response.Header.Get("Retry-After"))
+
+			fake.Advance(wait)
+			require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, emailAddress, "wrong").StatusCode)
+		}
+
+		// Locked
+		response := postTestLogin(t, server.URL, emailAddress, "westEndGirls")
+		require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+		require.Equal(t, "900", response.Header.Get("Retry-After"))
+	}
+
+	require.Equal(t, failures+2*int64(accountLoginLimits.LockoutAttempts), loginFailuresCount.Count())
+	require.Equal(t, lockouts+2, loginLockoutsCount.Count())
+
+	// Other accounts are not affected
+	other := createTestUser(t, repo, RoleTrustedHelper)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, other.EmailAddress, "westEndGirls").StatusCode)
+
+	// An admin unlocks the account
+	admin := createTestUser(t, repo, RoleAdmin)
+	unlockURL := fmt.Sprintf("%s/api/v1/users/%d/lockout", server.URL, user.ID)
+	require.Equal(t, http.StatusOK, doTestRequest(t, "DELETE", unlockURL, loginTestUser(t, repo, admin), "").StatusCode)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+	require.Equal(t, http.StatusNotFound, doTestRequest(t, "DELETE", fmt.Sprintf("%s/api/v1/users/%d/lockout", server.URL, 999999), loginTestUser(t, repo, admin), "").StatusCode)
+
+	// The lockout ends by itself, and one more failure locks again
+	fake.Advance(accountLoginLimits.Lockout)
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, unknown, "wrong").StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, postTestLogin(t, server.URL, unknown, "wrong").StatusCode)
+
+	// Until the failures are forgotten
+	fake.Advance(loginFailureWindow + time.Second)
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, unknown, "wrong").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, unknown, "wrong").StatusCode)
+
+	// Logging in resets the account
+	for i := 0; i < accountLoginLimits.FreeAttempts-1; i++ {
+		require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, user.EmailAddress, "wrong").StatusCode)
+	}
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, user.EmailAddress, "wrong").StatusCode)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+}
+
+func TestLoginAddressBackoff(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+
+	defer func(limits loginLimits) { addressLoginLimits = limits }(addressLoginLimits)
+	addressLoginLimits = loginLimits{FreeAttempts: 4, MaxDelay: time.Minute}
+
+	// One failure each for many accounts from the same address
+	for i := 0; i < addressLoginLimits.FreeAttempts; i++ {
+		emailAddress := fmt.Sprintf("guess_%d@example.com", i)
+		require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, emailAddress, "wrong").StatusCode)
+	}
+
+	user := createTestUser(t, repo, RoleApplication)
+	response := postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls")
+	require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	require.Equal(t, "1", response.Header.Get("Retry-After"))
+
+	fake.Advance(time.Second)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+
+	// The address is not reset by a login
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, user.EmailAddress, "wrong").StatusCode)
+	response = postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls")
+	require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	require.Equal(t, "2", response.Header.Get("Retry-After"))
+}
+
+func TestParallelLoginAttempts(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	useFakeClock(t, time.Now().UTC())
+
+	defer func(limits loginLimits) { addressLoginLimits = limits }(addressLoginLimits)
+	addressLoginLimits.FreeAttempts = 100
+
+	user := createTestUser(t, repo, RoleTrustedHelper)
+	failures := loginFailuresCount.Count()
+
+	// All attempts pass the limits before the first password is checked
+	// unless they are counted up front
+	const attempts = 20
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- postTestLogin(t, server.URL, user.EmailAddress, "wrong").StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	require.Equal(t, accountLoginLimits.FreeAttempts, counts[http.StatusUnauthorized])
+	require.Equal(t, attempts-accountLoginLimits.FreeAttempts, counts[http.StatusTooManyRequests])
+	require.Equal(t, failures+int64(accountLoginLimits.FreeAttempts), loginFailuresCount.Count())
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mailer sends the mails of kiron, such as password reset links
+var mailer Mailer
+
+// publicURL is where users find kiron, links in mails start with it
+var publicURL = "http://localhost:1979"
+
+// Mailer sends mails.  KIRON_MAILER selects it.
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+// Mail is a plain text mail to a single recipient
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// InitMailer will create the mailer selected by KIRON_MAILER, "smtp" for a
+// mail server or "file" for a directory on the local disk.  The mails hold
+// password reset links, so there is no default.
+func InitMailer() error {
+	if value := os.Getenv("KIRON_PUBLIC_URL"); value != "" {
+		publicURL = strings.TrimRight(value, "/")
+	}
+
+	from := os.Getenv("KIRON_MAIL_FROM")
+	if from == "" {
+		from = "kiron@localhost"
+	}
+
+	switch kind := os.Getenv("KIRON_MAILER"); kind {
+	case "smtp":
+		m, err := newSMTPMailerFromEnv(from)
+		if err != nil {
+			return err
+		}
+		mailer = m
+		return nil
+
+	case "file":
+		dir := os.Getenv("KIRON_MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+
+		log.Printf("Mails are written to %s and not sent, use this for development only", dir)
+		m, err := newFileMailer(dir, from)
+		if err != nil {
+			return err
+		}
+		mailer = m
+		return nil
+
+	case "":
+		return errors.New("KIRON_MAILER has to be smtp or file")
+
+	default:
+		return fmt.Errorf("Unknown mailer %q, KIRON_MAILER has to be smtp or file", kind)
+	}
+}
+
+// message returns the mail as sent, with headers
+func (m *Mail) message(from string) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", m.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", clock.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+
+	return message.Bytes()
+}
+
+// validMailAddress refuses addresses that could add headers
+func validMailAddress(address string) bool {
+	return address != "" && !strings.ContainsAny(address, "\r\n")
+}
+
+// smtpMailer sends mails with a mail server
+type smtpMailer struct {
+	address string
+	auth    smtp.Auth
+	from    string
+}
+
+// newSMTPMailerFromEnv reads the server from KIRON_SMTP_ADDRESS, host:port,
+// and KIRON_SMTP_USERNAME and KIRON_SMTP_PASSWORD if it needs them
+func newSMTPMailerFromEnv(from string) (*smtpMailer, error) {
+	address := os.Getenv("KIRON_SMTP_ADDRESS")
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.New("KIRON_SMTP_ADDRESS has to be host:port")
+	}
+
+	m := smtpMailer{address: address, from: from}
+	if username := os.Getenv("KIRON_SMTP_USERNAME"); username != "" {
+		m.auth = smtp.PlainAuth("", username, os.Getenv("KIRON_SMTP_PASSWORD"), host)
+	}
+
+	log.Printf("Sending mails with %s", address)
+	return &m, nil
+}
+
+func (m *smtpMailer) Send(mail *Mail) error {
+	if !validMailAddress(mail.To) {
+		return errors.New("Invalid mail address")
+	}
+
+	return smtp.SendMail(m.address, m.auth, m.from, []string{mail.To}, mail.message(m.from))
+}
+
+// fileMailer writes every mail to a file of its own instead of sending it,
+// for development and tests
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func newFileMailer(dir, from string) (*fileMailer, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMailer{dir: dir, from: from}, nil
+}
+
+func (m *fileMailer) Send(mail *Mail) error {
+	if !validMailAddress(mail.To) {
+		return errors.New("Invalid mail address")
+	}
+
+	random := make([]byte, 4)
+	_, err := rand.Read(random)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", clock.Now().Format("20060102T150405"), hex.EncodeToString(random))
+	return ioutil.WriteFile(filepath.Join(m.dir, name), mail.message(m.from), 0600)
+}
+
+// sendMail sends the mail in the background, so a response does not take
+// longer for users that get a mail.  Failures are only logged.
+func sendMail(mail *Mail) {
+	m := mailer
+	go func() {
+		err := m.Send(mail)
+		if err != nil {
+			log.Printf("Unable to send mail %q: %v", mail.Subject, err)
+		}
+	}()
+}
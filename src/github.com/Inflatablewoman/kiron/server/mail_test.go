@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMailer hands the mails sent to the test
+type testMailer struct {
+	mails chan *Mail
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{mails: make(chan *Mail, 16)}
+}
+
+func (m *testMailer) Send(mail *Mail) error {
+	m.mails <- mail
+	return nil
+}
+
+// nextTestMail waits for the next mail sent with the test mailer
+func nextTestMail(t *testing.T) *Mail {
+	select {
+	case mail := <-mailer.(*testMailer).mails:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("No mail sent")
+		return nil
+	}
+}
+
+// requireNoTestMail makes sure the test mailer has not sent a mail
+func requireNoTestMail(t *testing.T) {
+	select {
+	case mail := <-mailer.(*testMailer).mails:
+		t.Fatalf("Unexpected mail %q to %s", mail.Subject, mail.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// tokenFromMail returns the token of the link to path in a mail
+func tokenFromMail(t *testing.T, path string, mail *Mail) string {
+	link := regexp.MustCompile(`http\S+`).FindString(mail.Body)
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	require.Equal(t, path, u.Path)
+
+	return u.Query().Get("token")
+}
+
+func TestFileMailer(t *testing.T) {
+	useFakeClock(t, time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC))
+
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := newFileMailer(dir, "kiron@example.com")
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(&Mail{To: "neil@example.com", Subject: "Grüße", Body: "one\ntwo"}))
+	require.Error(t, m.Send(&Mail{To: "neil@example.com\r\nBcc: chris@example.com", Subject: "Hi"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.True(t, strings.HasPrefix(filepath.Base(files[0]), "20170401T120000-"))
+
+	message, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Contains(t, string(message), "From: kiron@example.com\r\n")
+	require.Contains(t, string(message), "To: neil@example.com\r\n")
+	require.Contains(t, string(message), "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	require.True(t, strings.HasSuffix(string(message), "\r\n\r\none\r\ntwo"))
+}
+
+func TestInitMailer(t *testing.T) {
+	defer func(m Mailer, url string) { mailer, publicURL = m, url }(mailer, publicURL)
+
+	// Mails are only written to files when asked for
+	t.Setenv("KIRON_MAILER", "")
+	require.Error(t, InitMailer())
+	t.Setenv("KIRON_MAILER", "sendmail")
+	require.Error(t, InitMailer())
+
+	t.Setenv("KIRON_MAILER", "file")
+	t.Setenv("KIRON_MAIL_DIR", filepath.Join(t.TempDir(), "mail"))
+	t.Setenv("KIRON_PUBLIC_URL", "https://kiron.example.com/")
+	require.NoError(t, InitMailer())
+	require.IsType(t, &fileMailer{}, mailer)
+	require.Equal(t, "https://kiron.example.com", publicURL)
+
+	t.Setenv("KIRON_MAILER", "smtp")
+	t.Setenv("KIRON_SMTP_ADDRESS", "localhost:25")
+	require.NoError(t, InitMailer())
+	require.IsType(t, &smtpMailer{}, mailer)
+
+	t.Setenv("KIRON_SMTP_ADDRESS", "localhost")
+	require.Error(t, InitMailer())
+}
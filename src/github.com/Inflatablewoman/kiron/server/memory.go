@@ -0,0 +1,1288 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryRepository keeps everything in maps.  It is meant for tests and local
+// development, nothing survives a restart.
+type memoryRepository struct {
+	mu sync.RWMutex
+
+	applications    map[int]*Application
+	comments        map[int]*Comment
+	users           map[int]*User
+	documents       map[int]*Document
+	tokens          map[string]*Token        // by hashToken of the value
+	refreshTokens   map[string]*RefreshToken // by hashToken of the value
+	revokedTokens   map[string]time.Time
+	loginFailures   map[string]*LoginFailures
+	passwordResets  map[string]*PasswordReset     // by hashToken of the value
+	verifications   map[string]*EmailVerification // by hashToken of the value
+	history         []*StatusChange
+	auditEvents     []*AuditEvent
+	erasureRequests map[int]*ErasureRequest
+
+	// documentTypes are the same as in the initial migration
+	documentTypes []DocumentType
+
+	lastApplicationID    int
+	lastCommentID        int
+	lastUserID           int
+	lastDocumentID       int
+	lastHistoryID        int
+	lastAuditEventID     int
+	lastErasureRequestID int
+	lastPasswordResetID  int
+	lastVerificationID   int
+}
+
+func getMemoryDB() (DataRepository, error) {
+	log.Println("Using in-memory repository.  Data will be lost on restart.")
+
+	mr := &memoryRepository{
+		applications:    make(map[int]*Application),
+		comments:        make(map[int]*Comment),
+		users:           make(map[int]*User),
+		documents:       make(map[int]*Document),
+		tokens:          make(map[string]*Token),
+		refreshTokens:   make(map[string]*RefreshToken),
+		revokedTokens:   make(map[string]time.Time),
+		loginFailures:   make(map[string]*LoginFailures),
+		passwordResets:  make(map[string]*PasswordReset),
+		verifications:   make(map[string]*EmailVerification),
+		erasureRequests: make(map[int]*ErasureRequest),
+		documentTypes: []DocumentType{
+			{1, "1refugee status"},
+			{2, "unhcr refugee status"},
+			{3, "asylum application"},
+			{4, "refugee camp"},
+			{5, "aufenthaltserlaubnis"},
+			{6, "aufenthaltsgestattung"},
+			{7, "duldung"},
+			{8, "subsidiary protection status"},
+			{9, "our-certification"},
+		},
+	}
+
+	return mr, nil
+}
+
+func (r *memoryRepository) GetApplications(query ApplicationQuery) ([]*Application, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var apps []*Application
+	for _, app := range r.applications {
+		if !matchesApplicationQuery(app, query) {
+			continue
+		}
+		a := *app
+		apps = append(apps, &a)
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		c := compareApplications(apps[i], apps[j], query.Sort)
+		if c == 0 {
+			c = apps[i].ID - apps[j].ID
+		}
+		if query.Descending {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	total := len(apps)
+
+	if query.Offset >= len(apps) {
+		return []*Application{}, total, nil
+	}
+	apps = apps[query.Offset:]
+
+	if query.Limit > 0 && query.Limit < len(apps) {
+		apps = apps[:query.Limit]
+	}
+
+	return apps, total, nil
+}
+
+func (r *memoryRepository) SearchApplications(query SearchQuery) ([]*SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return []*SearchResult{}, nil
+	}
+
+	comments := make(map[int][]*Comment)
+	for _, comment := range r.comments {
+		comments[comment.ApplicationID] = append(comments[comment.ApplicationID], comment)
+	}
+
+	results := []*SearchResult{}
+	for _, app := range r.applications {
+		user, ok := r.users[app.UserID]
+		if !ok {
+			continue
+		}
+
+		sort.Slice(comments[app.ID], func(i, j int) bool { return comments[app.ID][i].ID < comments[app.ID][j].ID })
+		var contents []string
+		for _, comment := range comments[app.ID] {
+			contents = append(contents, comment.Contents)
+		}
+
+		fields := []searchField{
+			{strings.Join([]string{user.FirstName, user.LastName, user.EmailAddress}, " "), searchWeightName},
+			{app.StudyProgram, searchWeightDetails},
+			{strings.Join(contents, " "), searchWeightComment},
+		}
+		if query.Private {
+			fields = append(fields, searchField{app.City, searchWeightDetails})
+		}
+
+		rank := rankSearch(fields, terms)
+		nationality := searchNationality(query) != "" && normalizeNationality(app.Nationality) == searchNationality(query)
+		if nationality {
+			rank += searchWeightDetails
+		}
+		if rank == 0 {
+			continue
+		}
+
+		var text []string
+		for _, field := range fields {
+			if field.Text != "" {
+				text = append(text, field.Text)
+			}
+		}
+
+		snippet := highlight(strings.Join(text, " "), terms)
+		if nationality {
+			snippet = markNationality(app.Nationality, snippet)
+		}
+
+		a := *app
+		results = append(results, &SearchResult{Application: &a, Rank: rank, Snippet: snippet})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Application.ID < results[j].Application.ID
+	})
+
+	if query.Limit > 0 && query.Limit < len(results) {
+		results = results[:query.Limit]
+	}
+
+	return results, nil
+}
+
+// matchesApplicationQuery returns true if app passes all filters of the query
+func matchesApplicationQuery(app *Application, query ApplicationQuery) bool {
+	switch {
+	case query.Status != "" && app.Status != query.Status:
+		return false
+	case query.Nationality != "" && normalizeNationality(app.Nationality) != normalizeNationality(query.Nationality):
+		return false
+	case query.Phone != "" && normalizePhone(app.PhoneNumber) != normalizePhone(query.Phone):
+		return false
+	case query.Country != "" && !strings.EqualFold(app.Country, query.Country):
+		return false
+	case query.Gender != "" && app.Gender != query.Gender:
+		return false
+	case query.EducationLevel != 0 && app.EducationLevel != query.EducationLevel:
+		return false
+	case !query.CreatedFrom.IsZero() && app.Created.Before(query.CreatedFrom):
+		return false
+	case !query.CreatedTo.IsZero() && !app.Created.Before(query.CreatedTo):
+		return false
+	case !query.EditedFrom.IsZero() && app.Edited.Before(query.EditedFrom):
+		return false
+	case !query.EditedTo.IsZero() && !app.Edited.Before(query.EditedTo):
+		return false
+	}
+	return true
+}
+
+// compareApplications orders a and b by the sort field the way postgres does.
+// Stati are ordered by the workflow, not alphabetically.
+func compareApplications(a, b *Application, field string) int {
+	switch field {
+	case sortByCreated:
+		return compareTimes(a.Created, b.Created)
+	case sortByEdited:
+		return compareTimes(a.Edited, b.Edited)
+	case sortByStatus:
+		return statusRank(status(a.Status)) - statusRank(status(b.Status))
+	case sortByCountry:
+		return strings.Compare(a.Country, b.Country)
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func (r *memoryRepository) GetApplication(applicationID int) (*Application, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	app, ok := r.applications[applicationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	a := *app
+	return &a, nil
+}
+
+func (r *memoryRepository) GetApplicationOf(userID int) (*Application, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, app := range r.applications {
+		if app.UserID == userID {
+			a := *app
+			return &a, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (r *memoryRepository) SetApplication(application *Application) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[application.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+
+	for _, app := range r.applications {
+		if app.UserID == application.UserID {
+			return errors.New("User already has an application")
+		}
+	}
+
+	r.lastApplicationID++
+	application.ID = r.lastApplicationID
+
+	a := *application
+	r.applications[a.ID] = &a
+
+	return nil
+}
+
+func (r *memoryRepository) UpdateApplication(application *Application) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.applications[application.ID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	// The status only changes with TransitionApplication
+	a := *application
+	a.Status = stored.Status
+	a.StatusChangedBy = stored.StatusChangedBy
+	a.StatusChangedAt = stored.StatusChangedAt
+	a.StatusReason = stored.StatusReason
+	r.applications[a.ID] = &a
+
+	return nil
+}
+
+func (r *memoryRepository) TransitionApplication(change *StatusChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	app, ok := r.applications[change.ApplicationID]
+	if !ok || app.Status != change.From {
+		return ErrStatusConflict
+	}
+
+	app.Status = change.To
+	app.StatusChangedBy = change.UserID
+	app.StatusChangedAt = change.Changed
+	app.StatusReason = change.Reason
+	app.Edited = change.Changed
+
+	r.lastHistoryID++
+	change.ID = r.lastHistoryID
+
+	c := *change
+	r.history = append(r.history, &c)
+
+	return nil
+}
+
+func (r *memoryRepository) GetStatusHistory(applicationID int) ([]*StatusChange, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var history []*StatusChange
+	for _, change := range r.history {
+		if change.ApplicationID != applicationID {
+			continue
+		}
+		c := *change
+		history = append(history, &c)
+	}
+
+	return history, nil
+}
+
+func (r *memoryRepository) DeleteApplication(applicationID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.applications, applicationID)
+
+	return nil
+}
+
+func (r *memoryRepository) GetComments(applicationID int) ([]*Comment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var comments []*Comment
+	for _, comment := range r.comments {
+		if comment.ApplicationID != applicationID {
+			continue
+		}
+		c := *comment
+		comments = append(comments, &c)
+	}
+
+	sort.Slice(comments, func(i, j int) bool { return comments[i].ID < comments[j].ID })
+
+	return comments, nil
+}
+
+func (r *memoryRepository) GetComment(commentID int) (*Comment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	comment, ok := r.comments[commentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	c := *comment
+	return &c, nil
+}
+
+func (r *memoryRepository) SetComment(comment *Comment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.applications[comment.ApplicationID]; !ok {
+		return errors.New("Unknown application")
+	}
+
+	if _, ok := r.users[comment.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+
+	r.lastCommentID++
+	comment.ID = r.lastCommentID
+
+	c := *comment
+	r.comments[c.ID] = &c
+
+	return nil
+}
+
+func (r *memoryRepository) UpdateComment(comment *Comment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.comments[comment.ID]; !ok {
+		return ErrNotFound
+	}
+
+	c := *comment
+	r.comments[c.ID] = &c
+
+	return nil
+}
+
+func (r *memoryRepository) DeleteComment(commentID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.comments, commentID)
+
+	return nil
+}
+
+func (r *memoryRepository) GetUsers() ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var users []User
+	for _, user := range r.users {
+		users = append(users, *user)
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users, nil
+}
+
+func (r *memoryRepository) GetUser(userID int) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	u := *user
+	return &u, nil
+}
+
+func (r *memoryRepository) GetUserByEmail(emailAddress string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.EmailAddress == emailAddress {
+			u := *user
+			return &u, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (r *memoryRepository) SetUser(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkPassword(user); err != nil {
+		return err
+	}
+
+	for _, u := range r.users {
+		if u.EmailAddress == user.EmailAddress {
+			return errors.New("Email address already in use")
+		}
+	}
+
+	r.lastUserID++
+	user.ID = r.lastUserID
+
+	u := *user
+	r.users[u.ID] = &u
+
+	return nil
+}
+
+func (r *memoryRepository) UpdateUser(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[user.ID]; !ok {
+		return ErrNotFound
+	}
+
+	if err := r.checkPassword(user); err != nil {
+		return err
+	}
+
+	for _, u := range r.users {
+		if u.ID != user.ID && u.EmailAddress == user.EmailAddress {
+			return errors.New("Email address already in use")
+		}
+	}
+
+	u := *user
+	r.users[u.ID] = &u
+
+	return nil
+}
+
+// checkPassword mirrors the password_in_bcrypt constraint of the users table
+func (r *memoryRepository) checkPassword(user *User) error {
+	if !strings.HasPrefix(user.Password, "$2a$") && !strings.HasPrefix(user.Password, "$2b$") {
+		return errors.New("Password is not a bcrypt hash")
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) DeleteUser(userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.users, userID)
+
+	return nil
+}
+
+func (r *memoryRepository) GetDocuments(applicationID int) ([]*Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	documents := []*Document{}
+	for _, document := range r.documents {
+		if document.ApplicationID != applicationID {
+			continue
+		}
+		d := *document
+		d.DocumentType, _ = r.documentTypeName(d.DocumentTypeID)
+		documents = append(documents, &d)
+	}
+
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+
+	return documents, nil
+}
+
+func (r *memoryRepository) StoreDocument(document *Document) error {
+	return r.StoreDocuments([]*Document{document})
+}
+
+func (r *memoryRepository) StoreDocuments(documents []*Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check everything first so either all or none are stored
+	keys := make(map[string]bool)
+	for _, stored := range r.documents {
+		keys[stored.StorageKey] = true
+	}
+
+	for _, document := range documents {
+		if _, ok := r.applications[document.ApplicationID]; !ok {
+			return errors.New("Unknown application")
+		}
+
+		if _, ok := r.users[document.UploadedBy]; document.UploadedBy != 0 && !ok {
+			return errors.New("Unknown user")
+		}
+
+		if _, ok := r.documentTypeName(document.DocumentTypeID); !ok {
+			return errors.New("Unknown document type")
+		}
+
+		if document.StorageKey != "" && keys[document.StorageKey] {
+			return errors.New("Storage key already in use")
+		}
+		keys[document.StorageKey] = true
+	}
+
+	for _, document := range documents {
+		r.lastDocumentID++
+		document.ID = r.lastDocumentID
+		if document.ScanStatus == "" {
+			document.ScanStatus = scanPending
+		}
+
+		d := *document
+		r.documents[d.ID] = &d
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) documentTypeName(documentTypeID int) (string, bool) {
+	for _, documentType := range r.documentTypes {
+		if documentType.ID == documentTypeID {
+			return documentType.Name, true
+		}
+	}
+	return "", false
+}
+
+func (r *memoryRepository) GetDocumentTypes() ([]*DocumentType, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var documentTypes []*DocumentType
+	for _, documentType := range r.documentTypes {
+		d := documentType
+		documentTypes = append(documentTypes, &d)
+	}
+
+	return documentTypes, nil
+}
+
+func (r *memoryRepository) GetDocument(documentID int) (*Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	document, ok := r.documents[documentID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	d := *document
+	d.DocumentType, _ = r.documentTypeName(d.DocumentTypeID)
+	return &d, nil
+}
+
+func (r *memoryRepository) GetPendingDocuments() ([]*Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	documents := []*Document{}
+	for _, document := range r.documents {
+		if document.ScanStatus != scanPending || document.StorageKey == "" {
+			continue
+		}
+		d := *document
+		d.DocumentType, _ = r.documentTypeName(d.DocumentTypeID)
+		documents = append(documents, &d)
+	}
+
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+
+	return documents, nil
+}
+
+func (r *memoryRepository) SetDocumentScan(documentID int, status, result string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	document, ok := r.documents[documentID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	document.ScanStatus = status
+	document.ScanResult = result
+
+	return nil
+}
+
+func (r *memoryRepository) GetDocumentsToRekey(keyID string) ([]*Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	documents := []*Document{}
+	for _, document := range r.documents {
+		if document.KeyID == keyID || document.StorageKey == "" {
+			continue
+		}
+		d := *document
+		d.DocumentType, _ = r.documentTypeName(d.DocumentTypeID)
+		documents = append(documents, &d)
+	}
+
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+
+	return documents, nil
+}
+
+func (r *memoryRepository) RekeyDocument(document *Document, oldKeyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.documents[document.ID]
+	if !ok || stored.KeyID != oldKeyID {
+		return ErrNotFound
+	}
+
+	stored.StorageKey = document.StorageKey
+	stored.KeyID = document.KeyID
+	stored.DataKey = document.DataKey
+
+	return nil
+}
+
+func (r *memoryRepository) DeleteDocument(documentID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.documents, documentID)
+
+	return nil
+}
+
+func (r *memoryRepository) GetToken(tokenValue string) (*Token, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	token, ok := r.tokens[hashToken(tokenValue)]
+	if !ok || !token.Expires.After(clock.Now()) {
+		return nil, ErrNotFound
+	}
+
+	t := *token
+	t.Value = tokenValue
+	return &t, nil
+}
+
+func (r *memoryRepository) SetToken(token *Token) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[token.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+
+	// Like the database only the hash is kept
+	t := *token
+	t.Value = ""
+	r.tokens[hashToken(token.Value)] = &t
+
+	return nil
+}
+
+func (r *memoryRepository) DelToken(tokenValue string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tokens, hashToken(tokenValue))
+
+	return nil
+}
+
+func (r *memoryRepository) DelExpiredTokens() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := clock.Now()
+	for value, token := range r.tokens {
+		if !token.Expires.After(now) {
+			delete(r.tokens, value)
+		}
+	}
+	for value, token := range r.refreshTokens {
+		if !token.Expires.After(now) {
+			delete(r.refreshTokens, value)
+		}
+	}
+	for id, expires := range r.revokedTokens {
+		if !expires.After(now) {
+			delete(r.revokedTokens, id)
+		}
+	}
+	for value, reset := range r.passwordResets {
+		if !reset.Expires.After(now) {
+			delete(r.passwordResets, value)
+		}
+	}
+	for value, verification := range r.verifications {
+		if !verification.Expires.After(now) {
+			delete(r.verifications, value)
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) SetRefreshToken(token *RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[token.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+	hash := hashToken(token.Value)
+	if _, ok := r.refreshTokens[hash]; ok {
+		return errors.New("Duplicate refresh token")
+	}
+
+	t := *token
+	t.Value = ""
+	r.refreshTokens[hash] = &t
+
+	return nil
+}
+
+func (r *memoryRepository) UseRefreshToken(tokenValue string) (*RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := clock.Now()
+	token, ok := r.refreshTokens[hashToken(tokenValue)]
+	if !ok || !token.Expires.After(now) {
+		return nil, ErrNotFound
+	}
+
+	t := *token
+	t.Value = tokenValue
+	if !token.Used.IsZero() {
+		return &t, ErrRefreshTokenReused
+	}
+
+	token.Used = now
+	t.Used = now
+	return &t, nil
+}
+
+func (r *memoryRepository) RevokeTokenFamily(family string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Tokens without a family are not related
+	if family == "" {
+		return nil
+	}
+
+	for value, token := range r.tokens {
+		if token.Family == family {
+			delete(r.tokens, value)
+		}
+	}
+	for value, token := range r.refreshTokens {
+		if token.Family == family {
+			delete(r.refreshTokens, value)
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) RevokeToken(token *RevokedToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if token.Expires.After(r.revokedTokens[token.ID]) {
+		r.revokedTokens[token.ID] = token.Expires
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) GetRevokedTokens() ([]*RevokedToken, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := clock.Now()
+	var tokens []*RevokedToken
+	for id, expires := range r.revokedTokens {
+		if expires.After(now) {
+			tokens = append(tokens, &RevokedToken{ID: id, Expires: expires})
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	return tokens, nil
+}
+
+func (r *memoryRepository) AddPasswordReset(reset *PasswordReset) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[reset.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+
+	r.lastPasswordResetID++
+	reset.ID = r.lastPasswordResetID
+
+	p := *reset
+	p.Value = ""
+	r.passwordResets[hashToken(reset.Value)] = &p
+
+	return nil
+}
+
+func (r *memoryRepository) GetLastPasswordReset(userID int) (*PasswordReset, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var last *PasswordReset
+	for _, reset := range r.passwordResets {
+		if reset.UserID != userID {
+			continue
+		}
+		if last == nil || reset.Created.After(last.Created) || (reset.Created.Equal(last.Created) && reset.ID > last.ID) {
+			last = reset
+		}
+	}
+	if last == nil {
+		return nil, ErrNotFound
+	}
+
+	p := *last
+	return &p, nil
+}
+
+func (r *memoryRepository) ResetPassword(tokenValue, hashedPassword string) (*PasswordReset, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reset, ok := r.passwordResets[hashToken(tokenValue)]
+	if !ok || !reset.Expires.After(clock.Now()) {
+		return nil, nil, ErrNotFound
+	}
+
+	user, ok := r.users[reset.UserID]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	changed := *user
+	changed.Password = hashedPassword
+	if err := r.checkPassword(&changed); err != nil {
+		return nil, nil, err
+	}
+	user.Password = hashedPassword
+
+	for value, other := range r.passwordResets {
+		if other.UserID == user.ID {
+			delete(r.passwordResets, value)
+		}
+	}
+	families := r.delUserTokens(user.ID)
+
+	p := *reset
+	p.Value = tokenValue
+	return &p, families, nil
+}
+
+func (r *memoryRepository) AddEmailVerification(verification *EmailVerification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[verification.UserID]; !ok {
+		return errors.New("Unknown user")
+	}
+
+	r.lastVerificationID++
+	verification.ID = r.lastVerificationID
+
+	v := *verification
+	v.Value = ""
+	r.verifications[hashToken(verification.Value)] = &v
+
+	return nil
+}
+
+func (r *memoryRepository) GetLastEmailVerification(userID int) (*EmailVerification, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var last *EmailVerification
+	for _, verification := range r.verifications {
+		if verification.UserID != userID {
+			continue
+		}
+		if last == nil || verification.Created.After(last.Created) || (verification.Created.Equal(last.Created) && verification.ID > last.ID) {
+			last = verification
+		}
+	}
+	if last == nil {
+		return nil, ErrNotFound
+	}
+
+	v := *last
+	return &v, nil
+}
+
+func (r *memoryRepository) VerifyEmail(tokenValue string) (*EmailVerification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := clock.Now()
+	verification, ok := r.verifications[hashToken(tokenValue)]
+	if !ok || !verification.Expires.After(now) {
+		return nil, ErrNotFound
+	}
+
+	user, ok := r.users[verification.UserID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if user.Verified.IsZero() {
+		user.Verified = now
+	}
+
+	for value, other := range r.verifications {
+		if other.UserID == user.ID {
+			delete(r.verifications, value)
+		}
+	}
+
+	v := *verification
+	v.Value = tokenValue
+	return &v, nil
+}
+
+// delUserTokens deletes the tokens of the user and returns the families of
+// its refresh tokens
+func (r *memoryRepository) delUserTokens(userID int) []string {
+	for value, token := range r.tokens {
+		if token.UserID == userID {
+			delete(r.tokens, value)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var families []string
+	for value, token := range r.refreshTokens {
+		if token.UserID != userID {
+			continue
+		}
+		if !seen[token.Family] {
+			seen[token.Family] = true
+			families = append(families, token.Family)
+		}
+		delete(r.refreshTokens, value)
+	}
+	sort.Strings(families)
+
+	return families
+}
+
+func (r *memoryRepository) GetLoginFailures(key string) (*LoginFailures, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	failures, ok := r.loginFailures[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	f := *failures
+	return &f, nil
+}
+
+func (r *memoryRepository) AddLoginFailure(key string, at, forgetBefore time.Time) (*LoginFailures, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failures, ok := r.loginFailures[key]
+	if !ok || failures.LastFailure.Before(forgetBefore) {
+		failures = &LoginFailures{Key: key}
+		r.loginFailures[key] = failures
+	}
+	failures.Failures++
+	failures.LastFailure = at
+
+	f := *failures
+	return &f, nil
+}
+
+func (r *memoryRepository) UndoLoginFailure(key string, at, previous time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failures, ok := r.loginFailures[key]
+	if !ok {
+		return nil
+	}
+
+	failures.Failures--
+	if failures.Failures <= 0 {
+		delete(r.loginFailures, key)
+		return nil
+	}
+	if failures.LastFailure.Equal(at) {
+		failures.LastFailure = previous
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) DelLoginFailures(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.loginFailures, key)
+
+	return nil
+}
+
+func (r *memoryRepository) DelExpiredLoginFailures(before time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, failures := range r.loginFailures {
+		if failures.LastFailure.Before(before) {
+			delete(r.loginFailures, key)
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRepository) AddAuditEvent(event *AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastAuditEventID++
+	event.ID = r.lastAuditEventID
+
+	e := *event
+	r.auditEvents = append(r.auditEvents, &e)
+
+	return nil
+}
+
+func (r *memoryRepository) GetAuditEvents(subjectID int) ([]*AuditEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var events []*AuditEvent
+	for _, event := range r.auditEvents {
+		if event.SubjectID != subjectID {
+			continue
+		}
+		e := *event
+		events = append(events, &e)
+	}
+
+	return events, nil
+}
+
+func (r *memoryRepository) AddErasureRequest(request *ErasureRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastErasureRequestID++
+	request.ID = r.lastErasureRequestID
+
+	e := *request
+	r.erasureRequests[request.ID] = &e
+
+	return nil
+}
+
+func (r *memoryRepository) EraseUser(request *ErasureRequest) ([]*Document, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[request.SubjectID]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	stored, ok := r.erasureRequests[request.ID]
+	if !ok || stored.SubjectID != request.SubjectID {
+		return nil, nil, ErrNotFound
+	}
+
+	eraseUser(user)
+
+	families := r.delUserTokens(user.ID)
+	for value, reset := range r.passwordResets {
+		if reset.UserID == user.ID {
+			delete(r.passwordResets, value)
+		}
+	}
+	for value, verification := range r.verifications {
+		if verification.UserID == user.ID {
+			delete(r.verifications, value)
+		}
+	}
+
+	documents := []*Document{}
+	for _, app := range r.applications {
+		if app.UserID != user.ID {
+			continue
+		}
+
+		eraseApplication(app)
+
+		for _, comment := range r.comments {
+			if comment.ApplicationID == app.ID {
+				comment.Contents = erasedContents
+			}
+		}
+		for _, change := range r.history {
+			if change.ApplicationID == app.ID {
+				change.Reason = ""
+			}
+		}
+		for id, document := range r.documents {
+			if document.ApplicationID == app.ID {
+				documents = append(documents, document)
+				delete(r.documents, id)
+			}
+		}
+	}
+
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+
+	request.Completed = time.Now().UTC()
+	stored.Completed = request.Completed
+
+	return documents, families, nil
+}
+
+func (r *memoryRepository) GetRejectedDocuments(rejectedBefore time.Time) ([]*Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	documents := []*Document{}
+	for _, document := range r.documents {
+		app, ok := r.applications[document.ApplicationID]
+		if !ok || app.Status != string(statusRejected) {
+			continue
+		}
+
+		rejected := app.StatusChangedAt
+		if rejected.IsZero() {
+			rejected = app.Edited
+		}
+		if !rejected.Before(rejectedBefore) {
+			continue
+		}
+
+		d := *document
+		d.DocumentType, _ = r.documentTypeName(d.DocumentTypeID)
+		documents = append(documents, &d)
+	}
+
+	sort.Slice(documents, func(i, j int) bool { return documents[i].ID < documents[j].ID })
+
+	return documents, nil
+}
+
+func (r *memoryRepository) GetInactiveApplicants(inactiveSince time.Time) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	erased := make(map[int]bool)
+	for _, request := range r.erasureRequests {
+		if !request.Completed.IsZero() {
+			erased[request.SubjectID] = true
+		}
+	}
+
+	active := make(map[int]time.Time)
+	for _, app := range r.applications {
+		active[app.UserID] = app.Edited
+	}
+
+	applicants := []int{}
+	for _, user := range r.users {
+		if user.Role != RoleApplication || erased[user.ID] {
+			continue
+		}
+
+		lastActive, ok := active[user.ID]
+		if !ok {
+			lastActive = user.Created
+		}
+		if lastActive.Before(inactiveSince) {
+			applicants = append(applicants, user.ID)
+		}
+	}
+
+	sort.Ints(applicants)
+
+	return applicants, nil
+}
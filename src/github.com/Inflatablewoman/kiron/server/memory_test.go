@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	repo, err := getMemoryDB()
+	require.NoError(t, err)
+
+	testRepository(t, repo)
+}
+
+func TestMemoryRepositoryConcurrentWrites(t *testing.T) {
+	repo, err := getMemoryDB()
+	require.NoError(t, err)
+
+	bcryptPassword, err := createHashedPassword("westEndGirls")
+	require.NoError(t, err)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ids  = make(map[int]bool)
+		errs = make(chan error, 20)
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := User{EmailAddress: fmt.Sprintf("user%d@example.org", i), Password: bcryptPassword, Created: time.Now().UTC(), Role: RoleApplication}
+			if err := repo.SetUser(&user); err != nil {
+				errs <- err
+				return
+			}
+
+			appl := Application{UserID: user.ID, Status: "received"}
+			if err := repo.SetApplication(&appl); err != nil {
+				errs <- err
+				return
+			}
+
+			mu.Lock()
+			ids[user.ID] = true
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Len(t, ids, 20)
+
+	users, err := repo.GetUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 20)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is a numbered schema change with the statements to apply and revert it
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrationState is a row of the schema_migrations table
+type migrationState struct {
+	Version   int
+	Name      string
+	Dirty     bool
+	AppliedAt time.Time
+}
+
+const migrationTable = `create table if not exists schema_migrations (
+  version integer primary key,
+  name text not null,
+  dirty boolean not null,
+  applied_at timestamp not null
+)`
+
+// migrator applies migrations to a postgres database and keeps track of them
+// in the schema_migrations table.
+type migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB, migrations []migration) (*migrator, error) {
+	err := checkMigrations(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(migrationTable)
+	if err != nil {
+		return nil, err
+	}
+
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// checkMigrations makes sure versions start at 1 without gaps and every
+// migration can be reverted
+func checkMigrations(migrations []migration) error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("Migration %q has version %d, expected %d", m.Name, m.Version, i+1)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return fmt.Errorf("Migration %04d needs both up and down statements", m.Version)
+		}
+	}
+
+	return nil
+}
+
+// Migrate runs a migration command against the postgres database in DBCONN.
+//
+//	up [n]         apply all (or the next n) pending migrations
+//	down [n]       revert the last (or the last n) applied migrations
+//	status         list every migration and whether it is applied
+//	force VERSION  mark VERSION as applied and clean without running anything
+//	seed           insert sample records for development
+func Migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: kiron migrate up [n] | down [n] | status | force VERSION | seed")
+	}
+
+	db, err := openPostgres()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	m, err := newMigrator(db, migrations)
+	if err != nil {
+		return err
+	}
+
+	count := func(all int) (int, error) {
+		if len(args) < 2 {
+			return all, nil
+		}
+		return strconv.Atoi(args[1])
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := count(len(migrations))
+		if err != nil {
+			return err
+		}
+		return m.up(n)
+	case "down":
+		n, err := count(1)
+		if err != nil {
+			return err
+		}
+		return m.down(n)
+	case "status":
+		states, err := m.states()
+		if err != nil {
+			return err
+		}
+		applied := make(map[int]migrationState)
+		for _, s := range states {
+			applied[s.Version] = s
+		}
+		for _, mig := range migrations {
+			s, ok := applied[mig.Version]
+			switch {
+			case !ok:
+				log.Printf("%04d %s: pending", mig.Version, mig.Name)
+			case s.Dirty:
+				log.Printf("%04d %s: dirty since %v", mig.Version, mig.Name, s.AppliedAt)
+			default:
+				log.Printf("%04d %s: applied %v", mig.Version, mig.Name, s.AppliedAt)
+			}
+		}
+		return nil
+	case "force":
+		if len(args) < 2 {
+			return errors.New("Usage: kiron migrate force VERSION")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return m.force(version)
+	case "seed":
+		return m.seed()
+	}
+
+	return fmt.Errorf("Unknown migrate command %q", args[0])
+}
+
+// states returns the rows of schema_migrations ordered by version
+func (m *migrator) states() ([]migrationState, error) {
+	rows, err := m.db.Query("SELECT version, name, dirty, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var states []migrationState
+	for rows.Next() {
+		var s migrationState
+		err := rows.Scan(&s.Version, &s.Name, &s.Dirty, &s.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// version returns the highest applied version.  It refuses to report anything
+// while a migration is dirty because the schema is then in an unknown state.
+func (m *migrator) version() (int, error) {
+	states, err := m.states()
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for _, s := range states {
+		if s.Dirty {
+			return 0, fmt.Errorf("Migration %04d is dirty.  Fix the database by hand, then run 'kiron migrate force VERSION' with the last good version", s.Version)
+		}
+		version = s.Version
+	}
+
+	if version > len(m.migrations) {
+		return 0, fmt.Errorf("Database is at version %04d but this binary only knows %04d", version, len(m.migrations))
+	}
+
+	return version, nil
+}
+
+// up applies the next n pending migrations
+func (m *migrator) up(n int) error {
+	version, err := m.version()
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range m.migrations[version:] {
+		if n <= 0 {
+			break
+		}
+		n--
+
+		log.Printf("Applying migration %04d %s", mig.Version, mig.Name)
+
+		// Mark the version dirty first so a crash half way is noticed
+		_, err = m.db.Exec("INSERT INTO schema_migrations(version, name, dirty, applied_at) VALUES($1, $2, true, $3)", mig.Version, mig.Name, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		err = m.inTransaction(mig.Up, "UPDATE schema_migrations SET dirty=false, applied_at=$2 WHERE version=$1", mig.Version, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Migration %04d failed: %v", mig.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// down reverts the last n applied migrations
+func (m *migrator) down(n int) error {
+	version, err := m.version()
+	if err != nil {
+		return err
+	}
+
+	for ; version > 0 && n > 0; version, n = version-1, n-1 {
+		mig := m.migrations[version-1]
+
+		log.Printf("Reverting migration %04d %s", mig.Version, mig.Name)
+
+		_, err = m.db.Exec("UPDATE schema_migrations SET dirty=true WHERE version=$1", mig.Version)
+		if err != nil {
+			return err
+		}
+
+		err = m.inTransaction(mig.Down, "DELETE FROM schema_migrations WHERE version=$1", mig.Version)
+		if err != nil {
+			return fmt.Errorf("Reverting migration %04d failed: %v", mig.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// force marks version as the clean current state.  Use it after repairing a
+// dirty migration by hand, or with 1 on a database created from the old kiron.sql.
+func (m *migrator) force(version int) error {
+	if version < 0 || version > len(m.migrations) {
+		return fmt.Errorf("Unknown version %d", version)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM schema_migrations")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, mig := range m.migrations[:version] {
+		_, err = tx.Exec("INSERT INTO schema_migrations(version, name, dirty, applied_at) VALUES($1, $2, false, $3)", mig.Version, mig.Name, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	log.Printf("Forced schema to version %04d", version)
+
+	return tx.Commit()
+}
+
+// seed inserts the sample records
+func (m *migrator) seed() error {
+	version, err := m.version()
+	if err != nil {
+		return err
+	}
+
+	if version < len(m.migrations) {
+		return errors.New("Run 'kiron migrate up' before seeding")
+	}
+
+	return m.inTransaction(seed, "")
+}
+
+// inTransaction runs statements and the bookkeeping query in a single transaction
+func (m *migrator) inTransaction(statements string, bookkeeping string, args ...interface{}) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(statements)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if bookkeeping != "" {
+		_, err = tx.Exec(bookkeeping, args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
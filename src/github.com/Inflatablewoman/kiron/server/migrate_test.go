@@ -0,0 +1,98 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationsAreNumbered(t *testing.T) {
+	err := checkMigrations(migrations)
+	require.NoError(t, err)
+
+	for _, m := range migrations {
+		// Applying a migration must never throw existing data away
+		require.NotContains(t, strings.ToLower(m.Up), "cascade", "migration %04d", m.Version)
+	}
+
+	err = checkMigrations([]migration{{Version: 1, Up: "select 1", Down: "select 1"}, {Version: 3, Up: "select 1", Down: "select 1"}})
+	require.Error(t, err)
+
+	err = checkMigrations([]migration{{Version: 1, Up: "select 1"}})
+	require.Error(t, err)
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	requirePostgres(t)
+
+	db, err := openPostgres()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Work in a schema of our own so the real tables are left alone
+	schema := fmt.Sprintf("migrate_test_%s", strings.ToLower(GetRandomString(8, "alpha")))
+	_, err = db.Exec("CREATE SCHEMA " + schema)
+	require.NoError(t, err)
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	sdb, err := sql.Open("postgres", os.Getenv("DBCONN")+" search_path="+schema)
+	require.NoError(t, err)
+	defer sdb.Close()
+
+	m, err := newMigrator(sdb, migrations)
+	require.NoError(t, err)
+
+	version, err := m.version()
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	// Seeding needs the schema
+	require.Error(t, m.seed())
+
+	require.NoError(t, m.up(len(migrations)))
+
+	version, err = m.version()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+
+	// Nothing left to do
+	require.NoError(t, m.up(len(migrations)))
+
+	require.NoError(t, m.seed())
+	require.NoError(t, m.seed())
+
+	var users int
+	err = sdb.QueryRow("SELECT count(*) FROM users WHERE email='foo@example.org'").Scan(&users)
+	require.NoError(t, err)
+	require.Equal(t, 1, users)
+
+	require.NoError(t, m.down(len(migrations)))
+
+	version, err = m.version()
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	// A failing migration leaves the database dirty and blocks everything
+	broken := append(append([]migration(nil), migrations...), migration{Version: len(migrations) + 1, Name: "broken", Up: "select * from nowhere", Down: "select 1"})
+	m, err = newMigrator(sdb, broken)
+	require.NoError(t, err)
+
+	require.Error(t, m.up(len(broken)))
+
+	_, err = m.version()
+	require.Error(t, err)
+	require.Error(t, m.up(1))
+	require.Error(t, m.down(1))
+
+	require.NoError(t, m.force(len(migrations)))
+
+	version, err = m.version()
+	require.NoError(t, err)
+	require.Equal(t, len(migrations), version)
+
+	require.NoError(t, m.down(len(migrations)))
+}
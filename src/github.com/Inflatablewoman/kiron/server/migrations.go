@@ -0,0 +1,497 @@
+package server
+
+// migrations is the list of schema changes in the order they have to be applied.
+// Never change a migration that has been released, add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+create type gender as enum ('male', 'female');
+
+create type status as enum (
+  'received',
+  'confirmed',
+  'in verification',
+  'verified',
+  'waiting for response',
+  'rejected',
+  'accepted'
+);
+
+create table education_levels (
+  id serial primary key,
+  education_level text unique not null
+);
+
+insert into education_levels (education_level) values
+('none'),
+('elementary'),
+('secondary'),
+('associate'),
+('bachelor');
+
+create table roles (
+  id serial primary key,
+  role text unique not null
+);
+
+insert into roles (role) values
+('admin'),
+('sub-admin'),
+('trusted helper'),
+('limited helper'),
+('applicant');
+
+create table users (
+  id serial primary key,
+  email text not null unique,
+  name text not null,
+  lastname text not null,
+  password text not null,
+  -- make sure that the password is hashed with bcrypt. see also
+  -- https://en.wikipedia.org/wiki/Bcrypt
+  constraint password_in_bcrypt check (
+    password like '$2a$%' or
+    password like '$2b$%'
+  ),
+  created_at timestamp not null,
+  role_id integer references roles not null
+);
+
+create table auth_tokens (
+  user_id integer references users not null,
+  token text not null,
+  expires timestamp not null
+);
+
+create table applications (
+  id serial primary key,
+  birthday date not null,
+  phone text,
+  nationality text not null,
+  country text not null,  -- address
+  city text not null,     -- address
+  zip text not null,      -- address
+  address text,
+  address_extra text,
+  first_page_of_survey_data text,
+  gender gender not null,
+  study_program text,
+  user_id integer references users not null unique,
+  education_level_id integer references education_levels not null,
+  status status not null default 'received',
+  blocked_until timestamp,
+  created_at timestamp not null,
+  edited_at timestamp not null
+);
+
+create table document_types (
+  id serial primary key,
+  document_type text unique not null
+);
+
+insert into document_types (document_type) values
+('1refugee status'),
+('unhcr refugee status'),
+('asylum application'),
+('refugee camp'),
+('aufenthaltserlaubnis'),
+('aufenthaltsgestattung'),
+('duldung'),
+('subsidiary protection status'),
+('our-certification');
+
+create table documents (
+  id serial primary key,
+  application_id integer references applications not null,
+  document_type_id integer references document_types not null,
+  contents bytea not null -- document itself
+);
+
+create table comments (
+  id serial primary key,
+  created_at timestamp not null,
+  application_id integer references applications not null,
+  user_id integer references users not null,
+  contents text not null
+);
+`,
+		Down: `
+drop table comments;
+drop table documents;
+drop table document_types;
+drop table applications;
+drop table auth_tokens;
+drop table users;
+drop table roles;
+drop table education_levels;
+drop type status;
+drop type gender;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "application status changes",
+		Up: `
+alter table applications
+  add column status_changed_by integer references users,
+  add column status_changed_at timestamp,
+  add column status_reason text;
+`,
+		Down: `
+alter table applications
+  drop column status_changed_by,
+  drop column status_changed_at,
+  drop column status_reason;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "application status history",
+		Up: `
+create table application_status_history (
+  id serial primary key,
+  application_id integer references applications not null,
+  old_status status not null,
+  new_status status not null,
+  user_id integer references users not null,
+  reason text,
+  changed_at timestamp not null
+);
+
+create index application_status_history_application on application_status_history (application_id, changed_at);
+`,
+		Down: `
+drop table application_status_history;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "document metadata",
+		Up: `
+alter table documents
+  add column filename text not null default '',
+  add column content_type text not null default 'application/octet-stream',
+  add column size bigint not null default 0,
+  add column checksum text not null default '',
+  add column uploaded_by integer references users,
+  add column created_at timestamp;
+
+update documents set
+  size = octet_length(contents),
+  checksum = encode(sha256(contents), 'hex'),
+  created_at = now();
+
+alter table documents alter column created_at set not null;
+`,
+		Down: `
+alter table documents
+  drop column filename,
+  drop column content_type,
+  drop column size,
+  drop column checksum,
+  drop column uploaded_by,
+  drop column created_at;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "document blob storage",
+		// Existing contents stay until "kiron documents migrate-blobs" moves them
+		Up: `
+alter table documents add column storage_key text unique;
+alter table documents alter column contents drop not null;
+`,
+		// Fails once contents have been moved out, they have to be moved back by hand
+		Down: `
+alter table documents alter column contents set not null;
+alter table documents drop column storage_key;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "document scanning",
+		// Existing documents are pending until "kiron documents scan" checks them
+		Up: `
+alter table documents
+  add column scan_status text not null default 'pending'
+    check (scan_status in ('pending', 'clean', 'quarantined')),
+  add column scan_result text;
+`,
+		Down: `
+alter table documents
+  drop column scan_status,
+  drop column scan_result;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "document encryption",
+		// Documents without a key are unencrypted, "kiron documents rotate-keys" encrypts them
+		Up: `
+alter table documents
+  add column key_id text,
+  add column data_key bytea,
+  add constraint documents_data_key check ((key_id is null) = (data_key is null));
+`,
+		Down: `
+alter table documents
+  drop column key_id,
+  drop column data_key;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "application field encryption",
+		// Fields stay readable until "kiron applications rotate-keys" encrypts them
+		Up: `
+alter table applications alter column birthday type text using to_char(birthday, 'YYYY-MM-DD');
+alter table applications
+  add column phone_bidx text,
+  add column nationality_bidx text;
+create index applications_phone_bidx on applications (phone_bidx);
+create index applications_nationality_bidx on applications (nationality_bidx);
+`,
+		// Fails once fields have been encrypted, they have to be decrypted by hand
+		Down: `
+alter table applications
+  drop column phone_bidx,
+  drop column nationality_bidx;
+alter table applications alter column birthday type date using birthday::date;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "audit trail",
+		// No foreign keys, the trail has to outlive the users
+		Up: `
+create table audit_events (
+  id serial primary key,
+  user_id integer not null,
+  subject_id integer not null,
+  action text not null,
+  remote_addr text not null default '',
+  created_at timestamp not null
+);
+
+create index audit_events_subject on audit_events (subject_id, created_at);
+`,
+		Down: `
+drop table audit_events;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "erasure requests",
+		// Erased applications keep no gender
+		Up: `
+create table erasure_requests (
+  id serial primary key,
+  subject_id integer not null,
+  requested_by integer not null,
+  requested_at timestamp not null,
+  completed_at timestamp
+);
+
+create index erasure_requests_subject on erasure_requests (subject_id);
+
+alter table applications alter column gender drop not null;
+`,
+		// Fails once applications have been erased
+		Down: `
+alter table applications alter column gender set not null;
+
+drop table erasure_requests;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "token expiry",
+		// Tokens are looked up on every request and purged by the janitor
+		Up: `
+create index auth_tokens_token on auth_tokens (token);
+create index auth_tokens_expires on auth_tokens (expires);
+`,
+		Down: `
+drop index auth_tokens_token;
+drop index auth_tokens_expires;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "refresh tokens",
+		// Used refresh tokens are kept until they expire to notice when they are used again
+		Up: `
+create table refresh_tokens (
+  id serial primary key,
+  user_id integer references users not null,
+  token text not null unique,
+  family text not null,
+  expires timestamp not null,
+  used_at timestamp
+);
+
+create index refresh_tokens_family on refresh_tokens (family);
+create index refresh_tokens_expires on refresh_tokens (expires);
+
+alter table auth_tokens add column family text;
+create index auth_tokens_family on auth_tokens (family);
+`,
+		Down: `
+alter table auth_tokens drop column family;
+
+drop table refresh_tokens;
+`,
+	},
+	{
+		Version: 13,
+		Name:    "hashed tokens",
+		// Tokens are only kept as keyed hashes, the plaintext ones are
+		// dropped and everybody has to log in again
+		Up: `
+delete from auth_tokens;
+delete from refresh_tokens;
+
+alter table auth_tokens rename column token to token_hash;
+alter index auth_tokens_token rename to auth_tokens_token_hash;
+alter table refresh_tokens rename column token to token_hash;
+`,
+		Down: `
+delete from auth_tokens;
+delete from refresh_tokens;
+
+alter table refresh_tokens rename column token_hash to token;
+alter index auth_tokens_token_hash rename to auth_tokens_token;
+alter table auth_tokens rename column token_hash to token;
+`,
+	},
+	{
+		Version: 14,
+		Name:    "revoked tokens",
+		// Signed access tokens are not stored, logging out puts them here
+		Up: `
+create table revoked_tokens (
+  id text primary key,
+  expires timestamp not null
+);
+
+create index revoked_tokens_expires on revoked_tokens (expires);
+`,
+		Down: `
+drop table revoked_tokens;
+`,
+	},
+	{
+		Version: 15,
+		Name:    "login failures",
+		// Keys are hashed, the table holds no email or IP addresses
+		Up: `
+create table login_failures (
+  key text primary key,
+  failures integer not null,
+  last_failure timestamp not null
+);
+
+create index login_failures_last_failure on login_failures (last_failure);
+`,
+		Down: `
+drop table login_failures;
+`,
+	},
+	{
+		Version: 16,
+		Name:    "password resets",
+		Up: `
+create table password_resets (
+  id serial primary key,
+  user_id integer references users not null,
+  token_hash text not null unique,
+  expires timestamp not null
+);
+
+create index password_resets_user on password_resets (user_id);
+create index password_resets_expires on password_resets (expires);
+`,
+		Down: `
+drop table password_resets;
+`,
+	},
+	{
+		Version: 17,
+		Name:    "email verification",
+		// Users from before had no way to verify, they are taken as verified
+		Up: `
+alter table users add column verified_at timestamp;
+update users set verified_at = created_at;
+
+create table email_verifications (
+  id serial primary key,
+  user_id integer references users not null,
+  token_hash text not null unique,
+  created_at timestamp not null,
+  expires timestamp not null
+);
+
+create index email_verifications_user on email_verifications (user_id);
+create index email_verifications_expires on email_verifications (expires);
+`,
+		Down: `
+drop table email_verifications;
+alter table users drop column verified_at;
+`,
+	},
+	{
+		Version: 18,
+		Name:    "password reset created",
+		// Resets are short lived, the ones without a time are dropped
+		Up: `
+delete from password_resets;
+alter table password_resets add column created_at timestamp not null;
+create index password_resets_user_created on password_resets (user_id, created_at);
+`,
+		Down: `
+alter table password_resets drop column created_at;
+`,
+	},
+}
+
+// seed are some sample records to work with.  They are never applied by
+// "migrate up", run "kiron migrate seed" on development databases.
+const seed = `
+insert into users (name, lastname, email, password, created_at, verified_at, role_id)
+select
+  'foo', 'bar', 'foo@example.org',
+  '$2a$10$FTHN0Dechb/IiQuyeEwxaOCSdBss1KcC5fBKDKsj85adOYTLOPQf6', NOW(), NOW(),
+  (select id from roles where role = 'applicant')
+where not exists (select 1 from users where email = 'foo@example.org');
+
+insert into applications
+(
+  birthday, phone, nationality, country,
+  city, zip, address_extra, first_page_of_survey_data, gender, education_level_id,
+  user_id, status, created_at, edited_at
+)
+select
+  '2000-01-01', '123456789', 'german', 'germany', 'munich', '80331',
+  'po box 123', 'first page of the survey data', 'male',
+  (select id from education_levels where education_level = 'elementary'),
+  users.id,
+  'received', now(), now()
+from users
+where users.email = 'foo@example.org'
+and not exists (select 1 from applications where applications.user_id = users.id);
+
+insert into documents (application_id, document_type_id, filename, content_type, size, checksum, created_at, contents)
+select
+  app.id,
+  (select id from document_types where document_type = '1refugee status'),
+  'refugee status.txt', 'text/plain; charset=utf-8',
+  octet_length('[contents of a pdf file]'::bytea), encode(sha256('[contents of a pdf file]'::bytea), 'hex'),
+  now(),
+  '[contents of a pdf file]'
+from applications app
+join users on users.id = app.user_id
+where users.email = 'foo@example.org'
+and not exists (select 1 from documents where documents.application_id = app.id);
+`
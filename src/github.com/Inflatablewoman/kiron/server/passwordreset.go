@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// passwordResetLifetime is how long the link in a password reset mail
+	// works
+	passwordResetLifetime = time.Hour
+
+	// passwordResetResendInterval is how long a user has to wait for another
+	// password reset mail, so kiron cannot be used to flood a mailbox
+	passwordResetResendInterval = 5 * time.Minute
+)
+
+type forgotPasswordRequest struct {
+	EmailAddress string `json:"email"`
+}
+
+// forgotPassword mails a link to reset the password to the user.  The
+// response is the same for unknown email addresses, so it does not tell
+// which addresses have an account.  The reset is stored and mailed in the
+// background, so the response does not take longer for known addresses
+// either.
+func forgotPassword(u *url.URL, h http.Header, request *forgotPasswordRequest, context *BasicContext) (int, http.Header, interface{}, error) {
+	var err error
+	defer CatchPanic(&err, "forgotPassword")
+
+	log.Printf("forgotPassword called: %s %s", context.RemoteAddr, context.UserAgent)
+
+	if request.EmailAddress == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide an email address")
+	}
+
+	user, err := repository.GetUserByEmail(request.EmailAddress)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error:  Unable to get user from repo: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	if user == nil {
+		log.Println("No password reset for unknown user")
+	} else {
+		go mailPasswordReset(user)
+	}
+
+	// All good!
+	return http.StatusOK, nil, nil, nil
+}
+
+// mailPasswordReset stores a password reset for the user and mails the link,
+// unless the last one was sent too recently.  Failures are only logged.
+func mailPasswordReset(user *User) {
+	now := clock.Now()
+	last, err := repository.GetLastPasswordReset(user.ID)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error:  Unable to get password reset: %v", err)
+		return
+	}
+	if last != nil && now.Before(last.Created.Add(passwordResetResendInterval)) {
+		log.Printf("Not resending password reset to user %d so soon", user.ID)
+		return
+	}
+
+	reset := PasswordReset{UserID: user.ID, Value: GetRandomString(32, ""), Created: now, Expires: now.Add(passwordResetLifetime)}
+	err = repository.AddPasswordReset(&reset)
+	if err != nil {
+		log.Printf("Error:  Unable to store password reset: %v", err)
+		return
+	}
+
+	link := publicURL + "/password/reset?token=" + url.QueryEscape(reset.Value)
+	sendMail(&Mail{To: user.EmailAddress,
+		Subject: "Reset your kiron password",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your kiron account.  "+
+			"To choose a new password open\n\n%s\n\nThe link works once within %s.  "+
+			"If you did not ask for it, you can ignore this mail.\n", user.FirstName, link, passwordResetLifetime)})
+
+	log.Printf("Sent password reset %d to user %d", reset.ID, user.ID)
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// resetPassword sets a new password with the token of a password reset mail.
+// All sessions of the user end, so whoever knew the old password is out.
+func resetPassword(u *url.URL, h http.Header, request *resetPasswordRequest, context *BasicContext) (int, http.Header, interface{}, error) {
+	var err error
+	defer CatchPanic(&err, "resetPassword")
+
+	log.Printf("resetPassword called: %s %s", context.RemoteAddr, context.UserAgent)
+
+	if request.Token == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a reset token")
+	}
+
+	if request.Password == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a password")
+	}
+
+	hashedPassword, err := createHashedPassword(request.Password)
+	if err != nil {
+		log.Printf("Error:  Unable to hash password: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	reset, families, err := repository.ResetPassword(request.Token, hashedPassword)
+	if err == ErrNotFound {
+		return http.StatusUnauthorized, nil, nil, errors.New("Invalid or expired reset token")
+	}
+	if err != nil {
+		log.Printf("Error:  Unable to reset password: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	// Stored tokens are gone with the reset, signed ones are revoked
+	for _, family := range families {
+		err = revokeFamily(family)
+		if err != nil {
+			log.Printf("Error:  Unable to revoke token family %s: %v", family, err)
+			return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+		}
+	}
+
+	user, err := repository.GetUser(reset.UserID)
+	if err != nil {
+		log.Printf("Error:  Unable to get user from repo: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	// Whoever can read the mails may log in right away
+	err = repository.DelLoginFailures(accountLoginKey(user.EmailAddress))
+	if err != nil {
+		log.Printf("Error:  Unable to reset failed logins: %v", err)
+	}
+
+	sendMail(&Mail{To: user.EmailAddress,
+		Subject: "Your kiron password has been changed",
+		Body: fmt.Sprintf("Hello %s,\n\nthe password of your kiron account has just been changed and all sessions "+
+			"have been logged out.  If this was not you, please contact us right away.\n", user.FirstName)})
+
+	log.Printf("Reset password of user %d", user.ID)
+
+	// All good!
+	return http.StatusOK, nil, nil, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postTestForgot asks for a password reset mail and returns the status
+func postTestForgot(t *testing.T, serverURL, emailAddress string) int {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/password/forgot", "", fmt.Sprintf(`{"email": %q}`, emailAddress)).StatusCode
+}
+
+// postTestReset sets a new password with a reset token and returns the status
+func postTestReset(t *testing.T, serverURL, token, password string) int {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/password/reset", "", fmt.Sprintf(`{"token": %q, "password": %q}`, token, password)).StatusCode
+}
+
+func TestPasswordReset(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	user := createTestUser(t, repo, RoleApplication)
+	status, login := postTestSession(t, fmt.Sprintf("%s/api/v1/login", server.URL), loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+
+	// Unknown addresses get the same response, but no mail
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, "nobody@example.com"))
+	requireNoTestMail(t)
+
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	mail := nextTestMail(t)
+	require.Equal(t, user.EmailAddress, mail.To)
+	token := tokenFromMail(t, "/password/reset", mail)
+	require.NotEmpty(t, token)
+
+	require.Equal(t, http.StatusBadRequest, postTestReset(t, server.URL, token, ""))
+	require.Equal(t, http.StatusUnauthorized, postTestReset(t, server.URL, "made up", "itsASin"))
+
+	require.Equal(t, http.StatusOK, postTestReset(t, server.URL, token, "itsASin"))
+	require.Equal(t, user.EmailAddress, nextTestMail(t).To)
+
+	// The old sessions and password are no good any more
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+	status, _ = postTestSession(t, fmt.Sprintf("%s/api/v1/token/refresh", server.URL), refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, user.EmailAddress, "westEndGirls").StatusCode)
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, user.EmailAddress, "itsASin").StatusCode)
+
+	// A link works once
+	require.Equal(t, http.StatusUnauthorized, postTestReset(t, server.URL, token, "westEndGirls"))
+
+	// The repository holds no reset tokens
+	memory := repo.(*memoryRepository)
+	memory.mu.RLock()
+	_, ok := memory.passwordResets[token]
+	memory.mu.RUnlock()
+	require.False(t, ok)
+}
+
+func TestPasswordResetExpires(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+	user := createTestUser(t, repo, RoleApplication)
+
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	token := tokenFromMail(t, "/password/reset", nextTestMail(t))
+
+	fake.Advance(passwordResetLifetime)
+	require.Equal(t, http.StatusUnauthorized, postTestReset(t, server.URL, token, "itsASin"))
+	requireNoTestMail(t)
+}
+
+func TestSignedPasswordReset(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	useSigningKeys(t, "2017")
+	user := createTestUser(t, repo, RoleApplication)
+
+	status, login := postTestSession(t, fmt.Sprintf("%s/api/v1/login", server.URL), loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, isSignedToken(login.Token))
+
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	token := tokenFromMail(t, "/password/reset", nextTestMail(t))
+
+	require.Equal(t, http.StatusOK, postTestReset(t, server.URL, token, "itsASin"))
+
+	// Signed access tokens cannot be deleted, they are revoked
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+}
+
+func TestPasswordResetResendInterval(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+	user := createTestUser(t, repo, RoleApplication)
+
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	first := tokenFromMail(t, "/password/reset", nextTestMail(t))
+
+	// Another mail has to wait, the response does not tell
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	requireNoTestMail(t)
+
+	fake.Advance(passwordResetResendInterval)
+	require.Equal(t, http.StatusOK, postTestForgot(t, server.URL, user.EmailAddress))
+	second := tokenFromMail(t, "/password/reset", nextTestMail(t))
+	require.NotEqual(t, first, second)
+
+	// Either link works, and takes the other one with it
+	require.Equal(t, http.StatusOK, postTestReset(t, server.URL, first, "itsASin"))
+	require.Equal(t, http.StatusUnauthorized, postTestReset(t, server.URL, second, "itsASin"))
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/rcrowley/go-tigertonic"
+)
+
+// action is something a user does to a resource
+type action string
+
+// Actions checked by the policy
+const (
+	actionRead   action = "read"
+	actionCreate action = "create"
+	actionUpdate action = "update"
+	actionDelete action = "delete"
+)
+
+// resource is a kind of record protected by the policy
+type resource string
+
+// Resources checked by the policy
+const (
+	resourceUser        resource = "user"
+	resourceApplication resource = "application"
+	resourceDocument    resource = "document"
+	resourceComment     resource = "comment"
+	resourceHistory     resource = "status history"
+	resourceExport      resource = "data export"
+	resourceMetrics     resource = "metrics"
+	resourceLockout     resource = "login lockout"
+)
+
+// roleHelpers are all roles that review applications
+const roleHelpers = RoleAdmin | RoleSubAdmin | RoleTrustedHelper | RoleLimitedHelper
+
+// roleAll is every role a user can have
+const roleAll = roleHelpers | RoleApplication
+
+// permission lists the roles allowed to do something.  Roles in Any may act on
+// every record, roles in Own only on records that belong to them.
+type permission struct {
+	Any role
+	Own role
+}
+
+// policy is the single place that decides who may do what
+var policy = map[resource]map[action]permission{
+	resourceUser: {
+		actionRead:   {Any: RoleAdmin | RoleSubAdmin, Own: roleAll},
+		actionCreate: {Any: RoleAdmin},
+		actionUpdate: {Any: RoleAdmin, Own: roleAll},
+		actionDelete: {Any: RoleAdmin},
+	},
+	resourceApplication: {
+		actionRead:   {Any: roleHelpers, Own: RoleApplication},
+		actionCreate: {Any: RoleAdmin | RoleSubAdmin, Own: RoleApplication},
+		actionUpdate: {Any: RoleAdmin | RoleSubAdmin | RoleTrustedHelper, Own: RoleApplication},
+		actionDelete: {Any: RoleAdmin},
+	},
+	resourceDocument: {
+		actionRead:   {Any: RoleAdmin | RoleSubAdmin | RoleTrustedHelper, Own: RoleApplication},
+		actionCreate: {Any: RoleAdmin | RoleSubAdmin, Own: RoleApplication},
+		actionUpdate: {Any: RoleAdmin | RoleSubAdmin},
+		actionDelete: {Any: RoleAdmin | RoleSubAdmin, Own: RoleApplication},
+	},
+	resourceComment: {
+		actionRead:   {Any: roleHelpers},
+		actionCreate: {Any: roleHelpers},
+		actionUpdate: {Any: RoleAdmin | RoleSubAdmin},
+		actionDelete: {Any: RoleAdmin | RoleSubAdmin},
+	},
+	resourceHistory: {
+		actionRead: {Any: RoleAdmin | RoleSubAdmin},
+	},
+	resourceExport: {
+		actionRead: {Any: RoleAdmin, Own: roleAll},
+	},
+	resourceMetrics: {
+		actionRead: {Any: RoleAdmin},
+	},
+	resourceLockout: {
+		actionDelete: {Any: RoleAdmin},
+	},
+}
+
+// has returns true if r is one of the roles in set
+func (r role) has(set role) bool {
+	return r != RoleNone && r&set == r
+}
+
+// allowed returns true if user may perform act on res.  ownerID is the user the
+// record belongs to, 0 if the request is not about a single user's records.
+func allowed(user *User, res resource, act action, ownerID int) bool {
+	if user == nil {
+		return false
+	}
+
+	p, ok := policy[res][act]
+	if !ok {
+		return false
+	}
+
+	if user.Role.has(p.Any) {
+		return true
+	}
+
+	return ownerID != 0 && ownerID == user.ID && user.Role.has(p.Own)
+}
+
+// authorized wraps handler so it only runs for a logged in user the policy
+// allows to perform act on res
+func authorized(res resource, act action, handler http.Handler) http.Handler {
+	return tigertonic.WithContext(tigertonic.If(getContext, tigertonic.If(authorize(res, act), handler)), AuthContext{})
+}
+
+// authorize returns the check run by authorized.  It has to run after getContext.
+func authorize(res resource, act action) func(*http.Request) (http.Header, error) {
+	return func(r *http.Request) (http.Header, error) {
+		context := tigertonic.Context(r).(*AuthContext)
+
+		ownerID, err := routeOwner(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed(context.User, res, act, ownerID) {
+			log.Printf("Access denied: user %d (role %d) %s %s of user %d", context.User.ID, context.User.Role, act, res, ownerID)
+			return nil, tigertonic.Forbidden{Err: errors.New("Access denied")}
+		}
+
+		return nil, nil
+	}
+}
+
+// routeOwner returns the user the records addressed by the URL belong to.
+// The route parameters have to agree with each other, an application
+// has to belong to the user and a document to the application.
+func routeOwner(r *http.Request) (int, error) {
+	query := r.URL.Query()
+
+	if query.Get("userID") == "" {
+		return 0, nil
+	}
+
+	userID, err := strconv.Atoi(query.Get("userID"))
+	if err != nil {
+		return 0, tigertonic.BadRequest{Err: errors.New("Invalid user id")}
+	}
+
+	if query.Get("applicationID") == "" {
+		return userID, nil
+	}
+
+	applicationID, err := strconv.Atoi(query.Get("applicationID"))
+	if err != nil {
+		return 0, tigertonic.BadRequest{Err: errors.New("Invalid application id")}
+	}
+
+	application, err := repository.GetApplication(applicationID)
+	if err != nil || application.UserID != userID {
+		return 0, tigertonic.NotFound{Err: errors.New("Application not found")}
+	}
+
+	if query.Get("documentID") == "" {
+		return userID, nil
+	}
+
+	documentID, err := strconv.Atoi(query.Get("documentID"))
+	if err != nil {
+		return 0, tigertonic.BadRequest{Err: errors.New("Invalid document id")}
+	}
+
+	document, err := repository.GetDocument(documentID)
+	if err != nil || document.ApplicationID != applicationID {
+		return 0, tigertonic.NotFound{Err: errors.New("Document not found")}
+	}
+
+	return userID, nil
+}
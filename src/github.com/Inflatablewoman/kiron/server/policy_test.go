@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// loginTestUser stores a token for the user and returns its value
+func loginTestUser(t *testing.T, repo DataRepository, user *User) string {
+	token := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	err := repo.SetToken(&token)
+	require.NoError(t, err)
+
+	return token.Value
+}
+
+// doTestRequest sends a request with the token and a JSON body
+func doTestRequest(t *testing.T, method, url, tokenValue, body string) *http.Response {
+	request, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+
+	request.Header.Set("Content-Type", "application/json")
+	if tokenValue != "" {
+		request.Header.Set("Authorization", "Bearer "+tokenValue)
+	}
+
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	return response
+}
+
+// targetPath fills in the ids of the application in a path
+func targetPath(path string, application *Application, documentID int) string {
+	return strings.NewReplacer(
+		"{user}", strconv.Itoa(application.UserID),
+		"{application}", strconv.Itoa(application.ID),
+		"{document}", strconv.Itoa(documentID)).Replace(path)
+}
+
+func TestPolicyMatrix(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	roles := []struct {
+		name string
+		role role
+	}{
+		{"admin", RoleAdmin},
+		{"sub-admin", RoleSubAdmin},
+		{"trusted helper", RoleTrustedHelper},
+		{"limited helper", RoleLimitedHelper},
+		{"applicant", RoleApplication},
+	}
+
+	tokens := make(map[role]string)
+	for _, r := range roles {
+		tokens[r.role] = loginTestUser(t, repo, createTestUser(t, repo, r.role))
+	}
+
+	// The applicant with a token owns this application, the other one does not
+	applicant, err := repo.GetToken(tokens[RoleApplication])
+	require.NoError(t, err)
+	ownApplication := createTestApplication(t, repo, applicant.UserID)
+	other := createTestUser(t, repo, RoleApplication)
+	otherApplication := createTestApplication(t, repo, other.ID)
+
+	documents := make(map[int]int)
+	for _, appl := range []*Application{ownApplication, otherApplication} {
+		document := Document{ApplicationID: appl.ID, DocumentTypeID: 1}
+		require.NoError(t, repo.StoreDocument(&document))
+		documents[appl.ID] = document.ID
+	}
+
+	// {user}, {application} and {document} in path are replaced with the ids of the target
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		allowed role
+		own     role
+	}{
+		{"list users", "GET", "/api/v1/users", "", RoleAdmin | RoleSubAdmin, RoleNone},
+		{"read user", "GET", "/api/v1/users/{user}", "", RoleAdmin | RoleSubAdmin, RoleApplication},
+		{"list applications", "GET", "/api/v1/applications", "", roleHelpers, RoleNone},
+		{"search applications", "GET", "/api/v1/search?q=neil", "", roleHelpers, RoleNone},
+		{"read application", "GET", "/api/v1/users/{user}/application", "", roleHelpers, RoleApplication},
+		{"create application", "POST", "/api/v1/users/{user}/application", "{}", RoleAdmin | RoleSubAdmin, RoleApplication},
+		{"list documents", "GET", "/api/v1/users/{user}/application/{application}/documents", "", RoleAdmin | RoleSubAdmin | RoleTrustedHelper, RoleApplication},
+		{"read document", "GET", "/api/v1/users/{user}/application/{application}/documents/{document}", "", RoleAdmin | RoleSubAdmin | RoleTrustedHelper, RoleApplication},
+		{"create document", "PUT", "/api/v1/users/{user}/application/{application}/documents", "passport", RoleAdmin | RoleSubAdmin, RoleApplication},
+		{"read comments", "GET", "/api/v1/users/{user}/application/{application}/comments", "", roleHelpers, RoleNone},
+		{"create comment", "POST", "/api/v1/users/{user}/application/{application}/comments", `{"contents": "ok"}`, roleHelpers, RoleNone},
+		{"read metrics", "GET", "/api/v1/metrics", "", RoleAdmin, RoleNone},
+		{"export user data", "GET", "/api/v1/users/{user}/export", "", RoleAdmin, RoleApplication},
+		{"read status history", "GET", "/api/v1/users/{user}/application/history", "", RoleAdmin | RoleSubAdmin, RoleNone},
+		{"unlock user", "DELETE", "/api/v1/users/{user}/lockout", "", RoleAdmin, RoleNone},
+		// Last, it leaves the other application without documents
+		{"erase user", "DELETE", "/api/v1/users/{user}", "", RoleAdmin, RoleNone},
+	}
+
+	for _, c := range cases {
+		for _, r := range roles {
+			targets := []*Application{otherApplication}
+			if r.role == RoleApplication {
+				targets = append(targets, ownApplication)
+			}
+
+			for _, target := range targets {
+				own := target == ownApplication
+				expected := r.role.has(c.allowed) || (own && r.role.has(c.own))
+
+				path := targetPath(c.path, target, documents[target.ID])
+				response := doTestRequest(t, c.method, server.URL+path, tokens[r.role], c.body)
+
+				if expected {
+					require.NotEqual(t, http.StatusForbidden, response.StatusCode, "%s as %s (own %v)", c.name, r.name, own)
+				} else {
+					require.Equal(t, http.StatusForbidden, response.StatusCode, "%s as %s (own %v)", c.name, r.name, own)
+				}
+			}
+		}
+
+		// Nobody gets in without a token
+		path := targetPath(c.path, otherApplication, documents[otherApplication.ID])
+		response := doTestRequest(t, c.method, server.URL+path, "", c.body)
+		require.Equal(t, http.StatusUnauthorized, response.StatusCode, "%s without token", c.name)
+	}
+}
+
+func TestPolicyRouteOwnership(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	ownApplication := createTestApplication(t, repo, applicant.ID)
+
+	other := createTestUser(t, repo, RoleApplication)
+	otherApplication := createTestApplication(t, repo, other.ID)
+
+	otherDocument := Document{ApplicationID: otherApplication.ID, DocumentTypeID: 1}
+	require.NoError(t, repo.StoreDocument(&otherDocument))
+
+	// Own user id with somebody else's application
+	path := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, otherApplication.ID)
+	response := doTestRequest(t, "PUT", path, tokenValue, "passport")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// Own application with somebody else's document
+	path = fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents/%d", server.URL, applicant.ID, ownApplication.ID, otherDocument.ID)
+	response = doTestRequest(t, "GET", path, tokenValue, "")
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	admin := &User{ID: 1, Role: RoleAdmin}
+	applicant := &User{ID: 2, Role: RoleApplication}
+
+	require.True(t, allowed(admin, resourceUser, actionDelete, 2))
+	require.True(t, allowed(applicant, resourceApplication, actionRead, 2))
+	require.False(t, allowed(applicant, resourceApplication, actionRead, 3))
+	require.False(t, allowed(applicant, resourceApplication, actionRead, 0))
+	require.False(t, allowed(&User{ID: 4}, resourceApplication, actionRead, 4))
+	require.False(t, allowed(nil, resourceApplication, actionRead, 4))
+	require.False(t, allowed(admin, resource("unknown"), actionRead, 2))
+}
@@ -2,13 +2,14 @@ package server
 
 import (
 	"database/sql"
-	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	// Required
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type postgresRepository struct {
@@ -17,78 +18,326 @@ type postgresRepository struct {
 
 func getPostgresDB() (DataRepository, error) {
 
+	db, err := openPostgres()
+	if err != nil {
+		return nil, err
+	}
+
+	pr := postgresRepository{db: db}
+
+	return pr, nil
+}
+
+// openPostgres connects to the database in DBCONN
+func openPostgres() (*sql.DB, error) {
+
 	connectionString := os.Getenv("DBCONN")
 
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
-		log.Fatalf("Unable to connect to postgres %v", err)
+		log.Printf("Unable to connect to postgres %v", err)
+		return nil, err
 	}
 
 	err = db.Ping()
 	if err != nil {
-		log.Fatalf("Unable to connect to postgres %v", err)
+		log.Printf("Unable to connect to postgres %v", err)
+		db.Close()
+		return nil, err
 	}
 
-	pr := postgresRepository{db: db}
+	return db, nil
+}
 
-	return pr, nil
+// applicationColumns are selected for every application in the order scanApplication reads them
+const applicationColumns = `id,
+	birthday,
+	coalesce(phone, ''),
+	nationality,
+	country,
+	city,
+	zip,
+	coalesce(address, ''),
+	coalesce(address_extra, ''),
+	coalesce(first_page_of_survey_data, ''),
+	coalesce(gender::text, ''),
+	coalesce(study_program, ''),
+	user_id,
+	education_level_id,
+	status,
+	coalesce(status_changed_by, 0),
+	status_changed_at,
+	coalesce(status_reason, ''),
+	blocked_until,
+	created_at,
+	edited_at`
+
+// scanApplication reads the applicationColumns of the current row, followed
+// by the extra columns, and decrypts the sensitive fields
+func scanApplication(rows *sql.Rows, extra ...interface{}) (*Application, error) {
+	var (
+		app             Application
+		sensitive       sensitiveFields
+		statusChangedAt pq.NullTime
+		blockExpires    pq.NullTime
+	)
+
+	columns := []interface{}{&app.ID,
+		&sensitive.Birthday,
+		&sensitive.Phone,
+		&sensitive.Nationality,
+		&app.Country,
+		&app.City,
+		&app.Zip,
+		&sensitive.Address,
+		&sensitive.AddressExtra,
+		&sensitive.Survey,
+		&app.Gender,
+		&app.StudyProgram,
+		&app.UserID,
+		&app.EducationLevel,
+		&app.Status,
+		&app.StatusChangedBy,
+		&statusChangedAt,
+		&app.StatusReason,
+		&blockExpires,
+		&app.Created,
+		&app.Edited}
+
+	err := rows.Scan(append(columns, extra...)...)
+	if err != nil {
+		log.Printf("Error with scan: %v", err)
+		return nil, err
+	}
+
+	app.StatusChangedAt = statusChangedAt.Time
+	app.BlockExpires = blockExpires.Time
+
+	sensitive, err = sensitive.open(masterKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sensitive.apply(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+// sealApplication returns the sensitive fields of the application as they
+// are stored and the blind indexes of the phone number and the nationality
+func sealApplication(application *Application) (sensitiveFields, interface{}, interface{}, error) {
+	sealed, err := sensitiveFieldsOf(application).seal(masterKeys)
+	if err != nil {
+		return sealed, nil, nil, err
+	}
+
+	phoneIndex := blindIndex(indexKey, "phone", normalizePhone(application.PhoneNumber))
+	nationalityIndex := blindIndex(indexKey, "nationality", normalizeNationality(application.Nationality))
+
+	return sealed, phoneIndex, nationalityIndex, nil
+}
+
+// applicationFilter returns the where clause and its arguments for the filters of the query
+func applicationFilter(query ApplicationQuery) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	// Encrypted fields are found by their blind index, older plain ones by value
+	addBlind := func(column, value string) {
+		args = append(args, blindIndex(indexKey, column, value), value)
+		conditions = append(conditions, fmt.Sprintf("(%s_bidx=$%d OR %s=$%d)", column, len(args)-1, plainColumns[column], len(args)))
+	}
+
+	if query.Status != "" {
+		add("status=$%d", query.Status)
+	}
+	if query.Nationality != "" {
+		addBlind("nationality", normalizeNationality(query.Nationality))
+	}
+	if query.Phone != "" {
+		addBlind("phone", normalizePhone(query.Phone))
+	}
+	if query.Country != "" {
+		add("lower(country)=lower($%d)", query.Country)
+	}
+	if query.Gender != "" {
+		add("gender=$%d", query.Gender)
+	}
+	if query.EducationLevel != 0 {
+		add("education_level_id=$%d", query.EducationLevel)
+	}
+	if !query.CreatedFrom.IsZero() {
+		add("created_at>=$%d", query.CreatedFrom)
+	}
+	if !query.CreatedTo.IsZero() {
+		add("created_at<$%d", query.CreatedTo)
+	}
+	if !query.EditedFrom.IsZero() {
+		add("edited_at>=$%d", query.EditedFrom)
+	}
+	if !query.EditedTo.IsZero() {
+		add("edited_at<$%d", query.EditedTo)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
 }
 
-func (r postgresRepository) GetApplications() ([]*Application, error) {
-	log.Printf("Going to get all applications. This is not gonna happen.")
-	return nil, nil
+// plainColumns normalize the values of the blind indexed columns that are not encrypted yet
+var plainColumns = map[string]string{
+	"nationality": "lower(trim(nationality))",
+	"phone":       "regexp_replace(phone, '[^0-9+]', '', 'g')",
 }
 
-func (r postgresRepository) GetApplicationsByStatus(status string) ([]*Application, error) {
-	log.Printf("Going to get all applications for status %s", status)
-	stmt, err := r.db.Prepare("SELECT id, birthday, phone, nationality, country, city, zip, address, address_extra, first_page_of_survey_data, gender, study_program, user_id, education_level_id, status, blocked_until, created_at, edited_at FROM applications WHERE status=$1")
+func (r postgresRepository) GetApplications(query ApplicationQuery) ([]*Application, int, error) {
+	log.Printf("Going to get applications %+v", query)
+
+	where, args := applicationFilter(query)
+
+	var total int
+	err := r.db.QueryRow("SELECT count(*) FROM applications"+where, args...).Scan(&total)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	// The sort field has been checked against allowedApplicationSorts
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
 	}
+	order := "id " + direction
+	if query.Sort != "" && query.Sort != sortByID {
+		order = query.Sort + " " + direction + ", " + order
+	}
+
+	statement := "SELECT " + applicationColumns + " FROM applications" + where + " ORDER BY " + order
+	if query.Limit > 0 {
+		args = append(args, query.Limit)
+		statement += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	args = append(args, query.Offset)
+	statement += fmt.Sprintf(" OFFSET $%d", len(args))
+
+	rows, err := r.db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	apps := []*Application{}
+	for rows.Next() {
+		app, err := scanApplication(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		apps = append(apps, app)
+	}
+
+	return apps, total, rows.Err()
+}
+
+// Search documents of an application.  The weights A, B and C are ranked like
+// searchWeightName, searchWeightDetails and searchWeightComment.
+const (
+	searchPublicDocument = `setweight(to_tsvector('simple', concat_ws(' ', u.name, u.lastname, u.email)), 'A') ||
+		setweight(to_tsvector('simple', coalesce(a.study_program, '')), 'B') ||
+		setweight(to_tsvector('simple', coalesce(c.contents, '')), 'C')`
+	searchPrivateDocument = ` || setweight(to_tsvector('simple', coalesce(a.city, '')), 'B')`
+
+	searchPublicText  = `concat_ws(' ', u.name, u.lastname, u.email, a.study_program, c.contents`
+	searchPrivateText = `, a.city`
+)
 
-	rows, err := stmt.Query(status)
+func (r postgresRepository) SearchApplications(query SearchQuery) ([]*SearchResult, error) {
+	log.Printf("Going to search applications for %q", query.Text)
+
+	terms := searchTerms(query.Text)
+	if len(terms) == 0 {
+		return []*SearchResult{}, nil
+	}
+
+	document, text := searchPublicDocument, searchPublicText
+	if query.Private {
+		document += searchPrivateDocument
+		text += searchPrivateText
+	}
+	text += ")"
+
+	limit := "ALL"
+	if query.Limit > 0 {
+		limit = strconv.Itoa(query.Limit)
+	}
+
+	// The encrypted nationality is found by its blind index, that is ranked
+	// like a word of weight B
+	rows, err := r.db.Query(`SELECT `+applicationColumns+`, rank, snippet, nationality
+FROM applications
+JOIN (
+	SELECT s.application_id,
+		ts_rank(s.document, q) + CASE WHEN s.nationality THEN `+strconv.FormatFloat(searchWeightDetails, 'f', -1, 64)+` ELSE 0 END AS rank,
+		ts_headline('simple', `+htmlEscapeSQL("s.text")+`, q, $2) AS snippet,
+		s.nationality
+	FROM (
+		SELECT a.id AS application_id, `+document+` AS document, `+text+` AS text,
+			coalesce(a.nationality_bidx = $3, false) AS nationality
+		FROM applications a
+		JOIN users u ON u.id = a.user_id
+		LEFT JOIN (
+			SELECT application_id, string_agg(contents, ' ' ORDER BY id) AS contents
+			FROM comments GROUP BY application_id
+		) c ON c.application_id = a.id
+	) s, to_tsquery('simple', $1) q
+	WHERE s.document @@ q OR s.nationality
+) results ON results.application_id = applications.id
+ORDER BY rank DESC, id
+LIMIT `+limit,
+		tsQuery(terms),
+		fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15", snippetStart, snippetStop),
+		blindIndex(indexKey, "nationality", searchNationality(query)))
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	var apps []*Application
+	results := []*SearchResult{}
 	for rows.Next() {
-		app := &Application{}
-
-		err = rows.Scan(&app.ID,
-			&app.Birthday,
-			&app.PhoneNumber,
-			&app.Nationality,
-			&app.Country,
-			&app.City,
-			&app.Zip,
-			&app.Address,
-			&app.AddressExtra,
-			&app.FirstPageOfSurveyData,
-			&app.Gender,
-			&app.StudyProgram,
-			&app.UserID,
-			&app.EducationLevel,
-			&app.Status,
-			&app.BlockExpires,
-			&app.Created,
-			&app.Edited)
+		var (
+			result      SearchResult
+			nationality bool
+		)
+		result.Application, err = scanApplication(rows, &result.Rank, &result.Snippet, &nationality)
 		if err != nil {
-			log.Printf("Error with scan: %v", err)
 			return nil, err
 		}
+		if nationality {
+			result.Snippet = markNationality(result.Application.Nationality, result.Snippet)
+		}
 
-		apps = append(apps, app)
+		results = append(results, &result)
 	}
 
-	return apps, nil
+	return results, rows.Err()
 }
 
 func (r postgresRepository) GetApplication(applicationID int) (*Application, error) {
 	log.Printf("Going to application with id %d", applicationID)
-	stmt, err := r.db.Prepare("SELECT id, birthday, phone, nationality, country, city, zip, address, address_extra, first_page_of_survey_data, gender, study_program, user_id, education_level_id, status, blocked_until, created_at, edited_at FROM applications WHERE id=$1")
+	stmt, err := r.db.Prepare("SELECT " + applicationColumns + " FROM applications WHERE id=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -101,58 +350,15 @@ func (r postgresRepository) GetApplication(applicationID int) (*Application, err
 	defer rows.Close()
 
 	if rows.Next() {
-		app := &Application{}
-
-		err = rows.Scan(&app.ID,
-			&app.Birthday,
-			&app.PhoneNumber,
-			&app.Nationality,
-			&app.Country,
-			&app.City,
-			&app.Zip,
-			&app.Address,
-			&app.AddressExtra,
-			&app.FirstPageOfSurveyData,
-			&app.Gender,
-			&app.StudyProgram,
-			&app.UserID,
-			&app.EducationLevel,
-			&app.Status,
-			&app.BlockExpires,
-			&app.Created,
-			&app.Edited)
-		if err != nil {
-			log.Printf("Error with scan: %v", err)
-			return nil, err
-		}
-
-		return app, nil
+		return scanApplication(rows)
 	}
 
-	return nil, errors.New("Not found")
+	return nil, ErrNotFound
 }
 
 func (r postgresRepository) GetApplicationOf(userID int) (*Application, error) {
 	log.Printf("Going to get application for user with id %d", userID)
-	stmt, err := r.db.Prepare(`SELECT id, 
-								birthday, 
-								phone, 
-								nationality, 
-								country, 
-								city, 
-								zip,
-								address, 
-								address_extra, 
-								first_page_of_survey_data, 
-								gender, 
-								study_program, 
-								user_id, 
-								education_level_id, 
-								status, 
-								blocked_until, 
-								created_at, 
-								edited_at 
-								FROM applications WHERE user_id=$1`)
+	stmt, err := r.db.Prepare("SELECT " + applicationColumns + " FROM applications WHERE user_id=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -165,39 +371,19 @@ func (r postgresRepository) GetApplicationOf(userID int) (*Application, error) {
 	defer rows.Close()
 
 	if rows.Next() {
-		app := &Application{}
-
-		err = rows.Scan(&app.ID,
-			&app.Birthday,
-			&app.PhoneNumber,
-			&app.Nationality,
-			&app.Country,
-			&app.City,
-			&app.Zip,
-			&app.Address,
-			&app.AddressExtra,
-			&app.FirstPageOfSurveyData,
-			&app.Gender,
-			&app.StudyProgram,
-			&app.UserID,
-			&app.EducationLevel,
-			&app.Status,
-			&app.BlockExpires,
-			&app.Created,
-			&app.Edited)
-		if err != nil {
-			log.Printf("Error with scan: %v", err)
-			return nil, err
-		}
-
-		return app, nil
+		return scanApplication(rows)
 	}
 
-	return nil, errors.New("Not found")
+	return nil, ErrNotFound
 
 }
 
 func (r postgresRepository) SetApplication(application *Application) error {
+	sealed, phoneIndex, nationalityIndex, err := sealApplication(application)
+	if err != nil {
+		return err
+	}
+
 	stmt, err := r.db.Prepare(`INSERT INTO applications 
 								(birthday, 
 								phone, 
@@ -215,21 +401,24 @@ func (r postgresRepository) SetApplication(application *Application) error {
 								status, 
 								blocked_until, 
 								created_at, 
-								edited_at) 
-								VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`)
+								edited_at,
+								phone_bidx,
+								nationality_bidx) 
+								VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+								RETURNING id`)
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(
-		application.Birthday,
-		application.PhoneNumber,
-		application.Nationality,
+	err = stmt.QueryRow(
+		sealed.Birthday,
+		sealed.Phone,
+		sealed.Nationality,
 		application.Country,
 		application.City,
 		application.Zip,
-		application.Address,
-		application.AddressExtra,
-		application.FirstPageOfSurveyData,
+		sealed.Address,
+		sealed.AddressExtra,
+		sealed.Survey,
 		application.Gender,
 		application.StudyProgram,
 		application.UserID,
@@ -237,42 +426,47 @@ func (r postgresRepository) SetApplication(application *Application) error {
 		application.Status,
 		application.BlockExpires,
 		application.Created,
-		application.Edited)
+		application.Edited,
+		phoneIndex,
+		nationalityIndex).Scan(&application.ID)
 	if err != nil {
 		return err
 	}
-	rowCnt, err := res.RowsAffected()
-	if err != nil {
-		log.Printf("Got error - RowsAffected: %v", err)
-	}
-	log.Printf("affected = %d\n", rowCnt)
+	log.Printf("Created application with id %d", application.ID)
 
 	return nil
 }
 
+// UpdateApplication stores everything but the status, use TransitionApplication for that
 func (r postgresRepository) UpdateApplication(application *Application) error {
-	stmt, err := r.db.Prepare("UPDATE applications SET birthday=$1, phone=$2, nationality=$3, country=$4, city=$5, zip=$6, address=$7, address_extra=$8, first_page_of_survey_data=$9, gender=$10, user_id=$11, education_level_id=$12, status=$13, blocked_until=$14, created_at=$15, edited_at=$16 WHERE id=$17")
+	sealed, phoneIndex, nationalityIndex, err := sealApplication(application)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := r.db.Prepare("UPDATE applications SET birthday=$1, phone=$2, nationality=$3, country=$4, city=$5, zip=$6, address=$7, address_extra=$8, first_page_of_survey_data=$9, gender=$10, study_program=$11, user_id=$12, education_level_id=$13, blocked_until=$14, created_at=$15, edited_at=$16, phone_bidx=$17, nationality_bidx=$18 WHERE id=$19")
 	if err != nil {
 		return err
 	}
 	res, err := stmt.Exec(
-		application.Birthday,
-		application.PhoneNumber,
-		application.Nationality,
+		sealed.Birthday,
+		sealed.Phone,
+		sealed.Nationality,
 		application.Country,
 		application.City,
 		application.Zip,
-		application.Address,
-		application.AddressExtra,
-		application.FirstPageOfSurveyData,
+		sealed.Address,
+		sealed.AddressExtra,
+		sealed.Survey,
 		application.Gender,
 		application.StudyProgram,
 		application.UserID,
 		application.EducationLevel,
-		application.Status,
 		application.BlockExpires,
 		application.Created,
 		application.Edited,
+		phoneIndex,
+		nationalityIndex,
 		application.ID)
 	if err != nil {
 		return err
@@ -286,6 +480,68 @@ func (r postgresRepository) UpdateApplication(application *Application) error {
 	return nil
 }
 
+// TransitionApplication changes the status only if it is still change.From and
+// adds the change to the status history in the same transaction
+func (r postgresRepository) TransitionApplication(change *StatusChange) error {
+	log.Printf("Going to change status of application %d from %s to %s", change.ApplicationID, change.From, change.To)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE applications SET status=$1, status_changed_by=$2, status_changed_at=$3, status_reason=$4, edited_at=$3 WHERE id=$5 AND status=$6",
+		change.To, change.UserID, change.Changed, change.Reason, change.ApplicationID, change.From)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rowCnt == 0 {
+		tx.Rollback()
+		return ErrStatusConflict
+	}
+
+	err = tx.QueryRow("INSERT INTO application_status_history(application_id, old_status, new_status, user_id, reason, changed_at) VALUES($1, $2, $3, $4, $5, $6) RETURNING id",
+		change.ApplicationID, change.From, change.To, change.UserID, change.Reason, change.Changed).Scan(&change.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r postgresRepository) GetStatusHistory(applicationID int) ([]*StatusChange, error) {
+	log.Printf("Going to get status history of application %d", applicationID)
+	stmt, err := r.db.Prepare("SELECT id, old_status, new_status, user_id, coalesce(reason, ''), changed_at FROM application_status_history WHERE application_id=$1 ORDER BY changed_at, id")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(applicationID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var history []*StatusChange
+	for rows.Next() {
+		change := StatusChange{ApplicationID: applicationID}
+		err := rows.Scan(&change.ID, &change.From, &change.To, &change.UserID, &change.Reason, &change.Changed)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &change)
+	}
+
+	return history, rows.Err()
+}
+
 // we actually don't delete an application. Still, we need this function for Data Protection Law
 func (r postgresRepository) DeleteApplication(applicationID int) error {
 	stmt, err := r.db.Prepare("DELETE FROM applications WHERE id=$1")
@@ -357,6 +613,7 @@ func (r postgresRepository) GetComment(commentID int) (*Comment, error) {
 	}
 
 	var (
+		found         bool
 		createdAt     time.Time
 		applicationID int
 		userID        int
@@ -365,6 +622,7 @@ func (r postgresRepository) GetComment(commentID int) (*Comment, error) {
 
 	defer rows.Close()
 	for rows.Next() {
+		found = true
 		err := rows.Scan(&createdAt, &applicationID, &userID, &contents)
 		if err != nil {
 			return nil, err
@@ -376,25 +634,25 @@ func (r postgresRepository) GetComment(commentID int) (*Comment, error) {
 		return nil, err
 	}
 
+	if !found {
+		return nil, ErrNotFound
+	}
+
 	comment := Comment{ID: commentID, Created: createdAt, ApplicationID: applicationID, UserID: userID, Contents: contents}
 
 	return &comment, nil
 }
 
 func (r postgresRepository) SetComment(comment *Comment) error {
-	stmt, err := r.db.Prepare("INSERT INTO comments(created_at, application_id, user_id, contents) VALUES($1, $2, $3, $4)")
+	stmt, err := r.db.Prepare("INSERT INTO comments(created_at, application_id, user_id, contents) VALUES($1, $2, $3, $4) RETURNING id")
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(comment.Created, comment.ApplicationID, comment.UserID, comment.Contents)
+	err = stmt.QueryRow(comment.Created, comment.ApplicationID, comment.UserID, comment.Contents).Scan(&comment.ID)
 	if err != nil {
 		return err
 	}
-	rowCnt, err := res.RowsAffected()
-	if err != nil {
-		log.Printf("Got error - RowsAffected: %v", err)
-	}
-	log.Printf("affected = %d\n", rowCnt)
+	log.Printf("Created comment with id %d", comment.ID)
 
 	return nil
 }
@@ -436,12 +694,35 @@ func (r postgresRepository) DeleteComment(commentID int) error {
 }
 
 func (r postgresRepository) GetUsers() ([]User, error) {
-	return nil, nil
+	rows, err := r.db.Query("SELECT id, email, name, lastname, password, created_at, role_id, verified_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var (
+			user      User
+			roleValue int
+			verified  pq.NullTime
+		)
+		err := rows.Scan(&user.ID, &user.EmailAddress, &user.FirstName, &user.LastName, &user.Password, &user.Created, &roleValue, &verified)
+		if err != nil {
+			return nil, err
+		}
+		user.Role = roleFromID(roleValue)
+		user.Verified = verified.Time
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
 }
 
 func (r postgresRepository) GetUser(userID int) (*User, error) {
 	log.Printf("Going to get user by id: %v", userID)
-	stmt, err := r.db.Prepare("SELECT id, email, name, lastname, password, created_at, role_id FROM users WHERE id=$1")
+	stmt, err := r.db.Prepare("SELECT id, email, name, lastname, password, created_at, role_id, verified_at FROM users WHERE id=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -452,6 +733,7 @@ func (r postgresRepository) GetUser(userID int) (*User, error) {
 	}
 
 	var (
+		found     bool
 		id        int
 		name      string
 		email     string
@@ -459,11 +741,13 @@ func (r postgresRepository) GetUser(userID int) (*User, error) {
 		password  string
 		created   time.Time
 		roleValue int
+		verified  pq.NullTime
 	)
 
 	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&id, &email, &name, &lastName, &password, &created, &roleValue)
+		found = true
+		err := rows.Scan(&id, &email, &name, &lastName, &password, &created, &roleValue, &verified)
 		if err != nil {
 			return nil, err
 		}
@@ -474,14 +758,18 @@ func (r postgresRepository) GetUser(userID int) (*User, error) {
 		return nil, err
 	}
 
-	user := User{ID: id, EmailAddress: email, FirstName: name, LastName: lastName, Password: password, Created: created, Role: role(roleValue)}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	user := User{ID: id, EmailAddress: email, FirstName: name, LastName: lastName, Password: password, Created: created, Role: roleFromID(roleValue), Verified: verified.Time}
 
 	return &user, nil
 }
 
 func (r postgresRepository) GetUserByEmail(emailAddress string) (*User, error) {
 	log.Printf("Going to get user by email address %v", emailAddress)
-	stmt, err := r.db.Prepare("SELECT id, name, lastname, password, created_at, role_id FROM users WHERE email=$1")
+	stmt, err := r.db.Prepare("SELECT id, name, lastname, password, created_at, role_id, verified_at FROM users WHERE email=$1")
 	if err != nil {
 		return nil, err
 	}
@@ -492,17 +780,20 @@ func (r postgresRepository) GetUserByEmail(emailAddress string) (*User, error) {
 	}
 
 	var (
+		found     bool
 		id        int
 		name      string
 		lastName  string
 		password  string
 		created   time.Time
 		roleValue int
+		verified  pq.NullTime
 	)
 
 	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&id, &name, &lastName, &password, &created, &roleValue)
+		found = true
+		err := rows.Scan(&id, &name, &lastName, &password, &created, &roleValue, &verified)
 		if err != nil {
 			return nil, err
 		}
@@ -513,37 +804,37 @@ func (r postgresRepository) GetUserByEmail(emailAddress string) (*User, error) {
 		return nil, err
 	}
 
-	user := User{ID: id, EmailAddress: emailAddress, FirstName: name, LastName: lastName, Password: password, Created: created, Role: role(roleValue)}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	user := User{ID: id, EmailAddress: emailAddress, FirstName: name, LastName: lastName, Password: password, Created: created, Role: roleFromID(roleValue), Verified: verified.Time}
 
 	return &user, nil
 }
 
 func (r postgresRepository) SetUser(user *User) error {
 
-	stmt, err := r.db.Prepare("INSERT INTO users(email, name, lastname, password, created_at, role_id) VALUES($1, $2, $3, $4, $5, $6)")
+	stmt, err := r.db.Prepare("INSERT INTO users(email, name, lastname, password, created_at, role_id, verified_at) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id")
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(user.EmailAddress, user.FirstName, user.LastName, user.Password, user.Created, user.Role.Value())
+	err = stmt.QueryRow(user.EmailAddress, user.FirstName, user.LastName, user.Password, user.Created, user.Role.ID(), nullTime(user.Verified)).Scan(&user.ID)
 	if err != nil {
 		return err
 	}
-	rowCnt, err := res.RowsAffected()
-	if err != nil {
-		log.Printf("Got error - RowsAffected: %v", err)
-	}
-	log.Printf("affected = %d\n", rowCnt)
+	log.Printf("Created user with id %d", user.ID)
 
 	return nil
 }
 
 func (r postgresRepository) UpdateUser(user *User) error {
 
-	stmt, err := r.db.Prepare("UPDATE users SET email=$1, name=$2, lastname=$3, password=$4, created_at=$5, role_id=$6 WHERE id=$7")
+	stmt, err := r.db.Prepare("UPDATE users SET email=$1, name=$2, lastname=$3, password=$4, created_at=$5, role_id=$6, verified_at=$7 WHERE id=$8")
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(user.EmailAddress, user.FirstName, user.LastName, user.Password, user.Created, user.Role.Value(), user.ID)
+	res, err := stmt.Exec(user.EmailAddress, user.FirstName, user.LastName, user.Password, user.Created, user.Role.ID(), nullTime(user.Verified), user.ID)
 	if err != nil {
 		return err
 	}
@@ -556,6 +847,11 @@ func (r postgresRepository) UpdateUser(user *User) error {
 	return nil
 }
 
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 func (r postgresRepository) DeleteUser(userID int) error {
 	stmt, err := r.db.Prepare("DELETE FROM users WHERE id = $1")
 	if err != nil {
@@ -575,105 +871,316 @@ func (r postgresRepository) DeleteUser(userID int) error {
 	return nil
 }
 
-// Documents ...
-func (r postgresRepository) GetDocuments(applicationID int) ([][]byte, error) {
-	return nil, nil
-}
-
-func (r postgresRepository) StoreDocument(document *Document) error {
-	stmt, err := r.db.Prepare("INSERT INTO documents(application_id, document_type_id, contents) VALUES($1, $2, $3)")
-	if err != nil {
-		return err
-	}
-	res, err := stmt.Exec(document.ApplicationID, document.DocumentTypeID, document.Contents)
-	if err != nil {
-		return err
-	}
-	rowCnt, err := res.RowsAffected()
+// documentColumns are selected for every document in the order scanDocument reads them
+const documentColumns = "documents.id, application_id, document_type_id, coalesce(document_types.document_type, ''), filename, content_type, size, checksum, coalesce(uploaded_by, 0), created_at, coalesce(storage_key, ''), scan_status, coalesce(scan_result, ''), coalesce(key_id, ''), data_key"
+
+// documentTables joins the documents with the names of their types
+const documentTables = "documents LEFT JOIN document_types ON document_types.id=documents.document_type_id"
+
+// scanDocument reads the documentColumns of the current row
+func scanDocument(rows *sql.Rows) (*Document, error) {
+	var document Document
+
+	err := rows.Scan(&document.ID,
+		&document.ApplicationID,
+		&document.DocumentTypeID,
+		&document.DocumentType,
+		&document.Filename,
+		&document.ContentType,
+		&document.Size,
+		&document.Checksum,
+		&document.UploadedBy,
+		&document.Created,
+		&document.StorageKey,
+		&document.ScanStatus,
+		&document.ScanResult,
+		&document.KeyID,
+		&document.DataKey)
 	if err != nil {
-		log.Printf("Got error - RowsAffected: %v", err)
+		return nil, err
 	}
-	log.Printf("affected = %d\n", rowCnt)
 
-	return nil
+	return &document, nil
 }
 
-func (r postgresRepository) GetDocument(documentID int) (*Document, error) {
-	log.Printf("Going to get document by ID:  %v", documentID)
-	stmt, err := r.db.Prepare("SELECT application_id, document_type_id, contents FROM documents WHERE id=$1")
+// Documents ...
+func (r postgresRepository) GetDocuments(applicationID int) ([]*Document, error) {
+	log.Printf("Going to get documents of application %d", applicationID)
+	stmt, err := r.db.Prepare("SELECT " + documentColumns + " FROM " + documentTables + " WHERE application_id=$1 ORDER BY documents.id")
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := stmt.Query(documentID)
+	rows, err := stmt.Query(applicationID)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		applicationID int
-		docTypeID     int
-		userID        int
-		contents      []byte
-	)
-
 	defer rows.Close()
+
+	documents := []*Document{}
 	for rows.Next() {
-		err := rows.Scan(&applicationID, &docTypeID, &userID, &contents)
+		document, err := scanDocument(rows)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+		documents = append(documents, document)
 	}
 
-	document := Document{ID: documentID, ApplicationID: applicationID, DocumentTypeID: docTypeID, Contents: contents}
+	return documents, rows.Err()
+}
 
-	return &document, nil
+func (r postgresRepository) StoreDocument(document *Document) error {
+	return r.StoreDocuments([]*Document{document})
 }
 
-func (r postgresRepository) DeleteDocument(documentID int) error {
-	log.Printf("Going to delete document with id = %d", documentID)
-	stmt, err := r.db.Prepare("DELETE FROM documents WHERE id = $1")
+// StoreDocuments stores all documents in one transaction
+func (r postgresRepository) StoreDocuments(documents []*Document) error {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	res, err := stmt.Exec(documentID)
+	stmt, err := tx.Prepare("INSERT INTO documents(application_id, document_type_id, filename, content_type, size, checksum, uploaded_by, created_at, storage_key, scan_status, key_id, data_key) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id")
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	rowCnt, err := res.RowsAffected()
+
+	ids := make([]int, len(documents))
+	for i, document := range documents {
+		// Documents stored by migrations or scripts have no uploader
+		var uploadedBy interface{}
+		if document.UploadedBy != 0 {
+			uploadedBy = document.UploadedBy
+		}
+
+		scanStatus := document.ScanStatus
+		if scanStatus == "" {
+			scanStatus = scanPending
+		}
+
+		var keyID interface{}
+		if document.KeyID != "" {
+			keyID = document.KeyID
+		}
+
+		err = stmt.QueryRow(
+			document.ApplicationID,
+			document.DocumentTypeID,
+			document.Filename,
+			document.ContentType,
+			document.Size,
+			document.Checksum,
+			uploadedBy,
+			document.Created,
+			document.StorageKey,
+			scanStatus,
+			keyID,
+			document.DataKey).Scan(&ids[i])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
 	if err != nil {
-		log.Printf("Got error - RowsAffected: %v", err)
+		return err
+	}
+
+	// Only hand out ids once they exist
+	for i, document := range documents {
+		document.ID = ids[i]
+		if document.ScanStatus == "" {
+			document.ScanStatus = scanPending
+		}
+		log.Printf("Created document with id %d", document.ID)
 	}
-	log.Printf("affected = %d\n", rowCnt)
 
 	return nil
 }
 
-func (r postgresRepository) GetToken(tokenValue string) (*Token, error) {
-	log.Printf("Going to get token by value: %v", tokenValue)
-	stmt, err := r.db.Prepare("SELECT user_id, expires FROM auth_tokens WHERE token=$1")
+func (r postgresRepository) GetDocumentTypes() ([]*DocumentType, error) {
+	rows, err := r.db.Query("SELECT id, document_type FROM document_types ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := stmt.Query(tokenValue)
-	if err != nil {
-		return nil, err
+	defer rows.Close()
+
+	var documentTypes []*DocumentType
+	for rows.Next() {
+		var documentType DocumentType
+		err := rows.Scan(&documentType.ID, &documentType.Name)
+		if err != nil {
+			return nil, err
+		}
+		documentTypes = append(documentTypes, &documentType)
+	}
+
+	return documentTypes, rows.Err()
+}
+
+func (r postgresRepository) GetDocument(documentID int) (*Document, error) {
+	log.Printf("Going to get document by ID:  %v", documentID)
+	stmt, err := r.db.Prepare("SELECT " + documentColumns + " FROM " + documentTables + " WHERE documents.id=$1")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanDocument(rows)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrNotFound
+}
+
+// GetPendingDocuments returns the documents in the blob store that have not been scanned
+func (r postgresRepository) GetPendingDocuments() ([]*Document, error) {
+	rows, err := r.db.Query("SELECT "+documentColumns+" FROM "+documentTables+" WHERE scan_status=$1 AND storage_key IS NOT NULL ORDER BY documents.id", scanPending)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	documents := []*Document{}
+	for rows.Next() {
+		document, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents, rows.Err()
+}
+
+func (r postgresRepository) SetDocumentScan(documentID int, status, result string) error {
+	log.Printf("Document %d scanned: %s %s", documentID, status, result)
+
+	var scanResult interface{}
+	if result != "" {
+		scanResult = result
+	}
+
+	res, err := r.db.Exec("UPDATE documents SET scan_status=$1, scan_result=$2 WHERE id=$3", status, scanResult, documentID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// GetDocumentsToRekey returns the documents in the blob store whose data key
+// is not wrapped by the master key keyID, including unencrypted ones
+func (r postgresRepository) GetDocumentsToRekey(keyID string) ([]*Document, error) {
+	rows, err := r.db.Query("SELECT "+documentColumns+" FROM "+documentTables+" WHERE coalesce(key_id, '')<>$1 AND storage_key IS NOT NULL ORDER BY documents.id", keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	documents := []*Document{}
+	for rows.Next() {
+		document, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents, rows.Err()
+}
+
+// RekeyDocument changes the storage key and the data key of the document,
+// unless its key has changed since it was read with oldKeyID
+func (r postgresRepository) RekeyDocument(document *Document, oldKeyID string) error {
+	var keyID interface{}
+	if document.KeyID != "" {
+		keyID = document.KeyID
+	}
+
+	res, err := r.db.Exec("UPDATE documents SET storage_key=$1, key_id=$2, data_key=$3 WHERE id=$4 AND coalesce(key_id, '')=$5", document.StorageKey, keyID, document.DataKey, document.ID, oldKeyID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (r postgresRepository) DeleteDocument(documentID int) error {
+	log.Printf("Going to delete document with id = %d", documentID)
+	stmt, err := r.db.Prepare("DELETE FROM documents WHERE id = $1")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(documentID)
+	if err != nil {
+		return err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Got error - RowsAffected: %v", err)
+	}
+	log.Printf("affected = %d\n", rowCnt)
+
+	return nil
+}
+
+func (r postgresRepository) GetToken(tokenValue string) (*Token, error) {
+	stmt, err := r.db.Prepare("SELECT user_id, expires, coalesce(family, '') FROM auth_tokens WHERE token_hash=$1 AND expires>$2")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(hashToken(tokenValue), clock.Now())
+	if err != nil {
+		return nil, err
 	}
 
 	var (
 		userID  int
 		expires time.Time
+		family  string
 	)
 
 	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&userID, &expires)
+		err := rows.Scan(&userID, &expires, &family)
 		if err != nil {
 			return nil, err
 		}
@@ -684,20 +1191,26 @@ func (r postgresRepository) GetToken(tokenValue string) (*Token, error) {
 	}
 
 	if userID == 0 {
-		return nil, errors.New("Not found")
+		return nil, ErrNotFound
 	}
 
-	token := Token{UserID: userID, Value: tokenValue, Expires: expires}
+	token := Token{UserID: userID, Value: tokenValue, Expires: expires, Family: family}
 
 	return &token, nil
 }
 
 func (r postgresRepository) SetToken(token *Token) error {
-	stmt, err := r.db.Prepare("INSERT INTO auth_tokens(user_id, token, expires) VALUES($1, $2, $3)")
+	stmt, err := r.db.Prepare("INSERT INTO auth_tokens(user_id, token_hash, expires, family) VALUES($1, $2, $3, $4)")
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(token.UserID, token.Value, token.Expires)
+
+	var family interface{}
+	if token.Family != "" {
+		family = token.Family
+	}
+
+	res, err := stmt.Exec(token.UserID, hashToken(token.Value), token.Expires, family)
 	if err != nil {
 		return err
 	}
@@ -711,13 +1224,11 @@ func (r postgresRepository) SetToken(token *Token) error {
 }
 
 func (r postgresRepository) DelToken(tokenValue string) error {
-	log.Printf("Deleting token: %s", tokenValue)
-
-	stmt, err := r.db.Prepare("DELETE FROM auth_tokens WHERE token = $1")
+	stmt, err := r.db.Prepare("DELETE FROM auth_tokens WHERE token_hash = $1")
 	if err != nil {
 		return err
 	}
-	res, err := stmt.Exec(tokenValue)
+	res, err := stmt.Exec(hashToken(tokenValue))
 	if err != nil {
 		return err
 	}
@@ -731,5 +1242,497 @@ func (r postgresRepository) DelToken(tokenValue string) error {
 }
 
 func (r postgresRepository) DelExpiredTokens() error {
+	now := clock.Now()
+	for _, table := range []string{"auth_tokens", "refresh_tokens", "revoked_tokens", "password_resets", "email_verifications"} {
+		res, err := r.db.Exec("DELETE FROM "+table+" WHERE expires<=$1", now)
+		if err != nil {
+			return err
+		}
+		rowCnt, err := res.RowsAffected()
+		if err != nil {
+			log.Printf("Got error - RowsAffected: %v", err)
+		}
+		log.Printf("Deleted %d expired %s", rowCnt, table)
+	}
+
 	return nil
 }
+
+func (r postgresRepository) SetRefreshToken(token *RefreshToken) error {
+	_, err := r.db.Exec("INSERT INTO refresh_tokens(user_id, token_hash, family, expires) VALUES($1, $2, $3, $4)",
+		token.UserID, hashToken(token.Value), token.Family, token.Expires)
+	return err
+}
+
+// UseRefreshToken marks the refresh token as used.  A token that has been
+// used before is returned with ErrRefreshTokenReused.
+func (r postgresRepository) UseRefreshToken(tokenValue string) (*RefreshToken, error) {
+	now := clock.Now()
+	token := RefreshToken{Value: tokenValue}
+
+	err := r.db.QueryRow("UPDATE refresh_tokens SET used_at=$2 WHERE token_hash=$1 AND expires>$2 AND used_at IS NULL RETURNING user_id, family, expires",
+		hashToken(tokenValue), now).Scan(&token.UserID, &token.Family, &token.Expires)
+	if err == nil {
+		token.Used = now
+		return &token, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Unknown, expired or used before
+	var used pq.NullTime
+	err = r.db.QueryRow("SELECT user_id, family, expires, used_at FROM refresh_tokens WHERE token_hash=$1 AND expires>$2",
+		hashToken(tokenValue), now).Scan(&token.UserID, &token.Family, &token.Expires, &used)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token.Used = used.Time
+	return &token, ErrRefreshTokenReused
+}
+
+// RevokeTokenFamily deletes the refresh tokens of the family and the access
+// tokens issued with them
+func (r postgresRepository) RevokeTokenFamily(family string) error {
+	log.Printf("Going to revoke token family %s", family)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"auth_tokens", "refresh_tokens"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE family=$1", family)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RevokeToken adds to the revocation list.  Revoking again can only make
+// the revocation last longer.
+func (r postgresRepository) RevokeToken(token *RevokedToken) error {
+	_, err := r.db.Exec(`INSERT INTO revoked_tokens(id, expires) VALUES($1, $2)
+		ON CONFLICT (id) DO UPDATE SET expires=greatest(revoked_tokens.expires, excluded.expires)`,
+		token.ID, token.Expires)
+	return err
+}
+
+func (r postgresRepository) GetRevokedTokens() ([]*RevokedToken, error) {
+	rows, err := r.db.Query("SELECT id, expires FROM revoked_tokens WHERE expires>$1 ORDER BY id", clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var tokens []*RevokedToken
+	for rows.Next() {
+		var token RevokedToken
+		err := rows.Scan(&token.ID, &token.Expires)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (r postgresRepository) AddPasswordReset(reset *PasswordReset) error {
+	log.Printf("Going to add password reset for user %d", reset.UserID)
+	return r.db.QueryRow("INSERT INTO password_resets(user_id, token_hash, created_at, expires) VALUES($1, $2, $3, $4) RETURNING id",
+		reset.UserID, hashToken(reset.Value), reset.Created, reset.Expires).Scan(&reset.ID)
+}
+
+// GetLastPasswordReset returns the reset sent last to the user, without its
+// value
+func (r postgresRepository) GetLastPasswordReset(userID int) (*PasswordReset, error) {
+	reset := PasswordReset{UserID: userID}
+	err := r.db.QueryRow("SELECT id, created_at, expires FROM password_resets WHERE user_id=$1 ORDER BY created_at DESC, id DESC LIMIT 1",
+		userID).Scan(&reset.ID, &reset.Created, &reset.Expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// ResetPassword uses the password reset to set the password of its user.
+// All other resets and tokens of the user are deleted, the families of the
+// refresh tokens are returned to revoke signed access tokens.
+func (r postgresRepository) ResetPassword(tokenValue, hashedPassword string) (*PasswordReset, []string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	reset := PasswordReset{Value: tokenValue}
+	err = tx.QueryRow("DELETE FROM password_resets WHERE token_hash=$1 AND expires>$2 RETURNING id, user_id, created_at, expires",
+		hashToken(tokenValue), clock.Now()).Scan(&reset.ID, &reset.UserID, &reset.Created, &reset.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Going to reset the password of user %d", reset.UserID)
+
+	_, err = tx.Exec("UPDATE users SET password=$2 WHERE id=$1", reset.UserID, hashedPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	families, err := tokenFamilies(tx, reset.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, table := range []string{"auth_tokens", "refresh_tokens", "password_resets"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id=$1", reset.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &reset, families, tx.Commit()
+}
+
+func (r postgresRepository) AddEmailVerification(verification *EmailVerification) error {
+	log.Printf("Going to add email verification for user %d", verification.UserID)
+	return r.db.QueryRow("INSERT INTO email_verifications(user_id, token_hash, created_at, expires) VALUES($1, $2, $3, $4) RETURNING id",
+		verification.UserID, hashToken(verification.Value), verification.Created, verification.Expires).Scan(&verification.ID)
+}
+
+// GetLastEmailVerification returns the verification sent last to the user,
+// without its value
+func (r postgresRepository) GetLastEmailVerification(userID int) (*EmailVerification, error) {
+	verification := EmailVerification{UserID: userID}
+	err := r.db.QueryRow("SELECT id, created_at, expires FROM email_verifications WHERE user_id=$1 ORDER BY created_at DESC, id DESC LIMIT 1",
+		userID).Scan(&verification.ID, &verification.Created, &verification.Expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+// VerifyEmail uses the email verification to mark the email address of its
+// user as verified.  All verifications of the user are deleted.
+func (r postgresRepository) VerifyEmail(tokenValue string) (*EmailVerification, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := clock.Now()
+	verification := EmailVerification{Value: tokenValue}
+	err = tx.QueryRow("DELETE FROM email_verifications WHERE token_hash=$1 AND expires>$2 RETURNING id, user_id, created_at, expires",
+		hashToken(tokenValue), now).Scan(&verification.ID, &verification.UserID, &verification.Created, &verification.Expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Going to verify the email address of user %d", verification.UserID)
+
+	_, err = tx.Exec("UPDATE users SET verified_at=$2 WHERE id=$1 AND verified_at IS NULL", verification.UserID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id=$1", verification.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verification, tx.Commit()
+}
+
+// tokenFamilies returns the families of the refresh tokens of the user
+func tokenFamilies(tx *sql.Tx, userID int) ([]string, error) {
+	rows, err := tx.Query("SELECT DISTINCT family FROM refresh_tokens WHERE user_id=$1 ORDER BY family", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var families []string
+	for rows.Next() {
+		var family string
+		if err := rows.Scan(&family); err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+
+	return families, rows.Err()
+}
+
+func (r postgresRepository) GetLoginFailures(key string) (*LoginFailures, error) {
+	failures := LoginFailures{Key: key}
+	err := r.db.QueryRow("SELECT failures, last_failure FROM login_failures WHERE key=$1", key).Scan(&failures.Failures, &failures.LastFailure)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &failures, nil
+}
+
+// AddLoginFailure counts a failed login.  Failures up to forgetBefore are
+// forgotten, counting starts over.
+func (r postgresRepository) AddLoginFailure(key string, at, forgetBefore time.Time) (*LoginFailures, error) {
+	failures := LoginFailures{Key: key, LastFailure: at}
+	err := r.db.QueryRow(`INSERT INTO login_failures(key, failures, last_failure) VALUES($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+		  failures=CASE WHEN login_failures.last_failure<$3 THEN 1 ELSE login_failures.failures+1 END,
+		  last_failure=$2
+		RETURNING failures`,
+		key, at, forgetBefore).Scan(&failures.Failures)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failures, nil
+}
+
+// UndoLoginFailure takes back the failure counted at.  If no other failure
+// was counted since, the last failure is previous again.
+func (r postgresRepository) UndoLoginFailure(key string, at, previous time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE login_failures SET failures=failures-1,
+		  last_failure=CASE WHEN last_failure=$2 THEN $3 ELSE last_failure END
+		WHERE key=$1`, key, at, previous)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM login_failures WHERE key=$1 AND failures<=0", key)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r postgresRepository) DelLoginFailures(key string) error {
+	_, err := r.db.Exec("DELETE FROM login_failures WHERE key=$1", key)
+	return err
+}
+
+func (r postgresRepository) DelExpiredLoginFailures(before time.Time) error {
+	res, err := r.db.Exec("DELETE FROM login_failures WHERE last_failure<$1", before)
+	if err != nil {
+		return err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Got error - RowsAffected: %v", err)
+	}
+	log.Printf("Deleted %d expired login failures", rowCnt)
+
+	return nil
+}
+
+func (r postgresRepository) AddAuditEvent(event *AuditEvent) error {
+	log.Printf("Going to add audit event %s of user %d on user %d", event.Action, event.UserID, event.SubjectID)
+	return r.db.QueryRow("INSERT INTO audit_events(user_id, subject_id, action, remote_addr, created_at) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		event.UserID, event.SubjectID, event.Action, event.RemoteAddr, event.Created).Scan(&event.ID)
+}
+
+func (r postgresRepository) GetAuditEvents(subjectID int) ([]*AuditEvent, error) {
+	log.Printf("Going to get audit events of user %d", subjectID)
+	rows, err := r.db.Query("SELECT id, user_id, action, remote_addr, created_at FROM audit_events WHERE subject_id=$1 ORDER BY created_at, id", subjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event := AuditEvent{SubjectID: subjectID}
+		err := rows.Scan(&event.ID, &event.UserID, &event.Action, &event.RemoteAddr, &event.Created)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func (r postgresRepository) AddErasureRequest(request *ErasureRequest) error {
+	log.Printf("Going to add erasure request of user %d for user %d", request.RequestedBy, request.SubjectID)
+	return r.db.QueryRow("INSERT INTO erasure_requests(subject_id, requested_by, requested_at) VALUES($1, $2, $3) RETURNING id",
+		request.SubjectID, request.RequestedBy, request.Requested).Scan(&request.ID)
+}
+
+// applicationsOf selects the applications of the user in $1
+const applicationsOf = "application_id IN (SELECT id FROM applications WHERE user_id=$1)"
+
+// EraseUser erases the personal data of the user and completes the request in
+// one transaction.  It returns the deleted documents, their contents are still
+// in the blobs, and the families of the deleted refresh tokens to revoke
+// signed access tokens.
+func (r postgresRepository) EraseUser(request *ErasureRequest) ([]*Document, []string, error) {
+	log.Printf("Going to erase user %d", request.SubjectID)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET email=$2, name='', lastname='', password=$3 WHERE id=$1",
+		request.SubjectID, erasedEmail(request.SubjectID), erasedPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+	rowCnt, err := res.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+	if rowCnt == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	rows, err := tx.Query("SELECT "+documentColumns+" FROM "+documentTables+" WHERE "+applicationsOf+" ORDER BY documents.id", request.SubjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	documents := []*Document{}
+	for rows.Next() {
+		document, err := scanDocument(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		documents = append(documents, document)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	families, err := tokenFamilies(tx, request.SubjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statements := []string{
+		"DELETE FROM documents WHERE " + applicationsOf,
+		"DELETE FROM auth_tokens WHERE user_id=$1",
+		"DELETE FROM refresh_tokens WHERE user_id=$1",
+		"DELETE FROM password_resets WHERE user_id=$1",
+		"DELETE FROM email_verifications WHERE user_id=$1",
+		"UPDATE comments SET contents='" + erasedContents + "' WHERE " + applicationsOf,
+		"UPDATE application_status_history SET reason=NULL WHERE " + applicationsOf,
+		`UPDATE applications SET birthday='', phone=NULL, nationality='', country='', city='', zip='', address=NULL, address_extra=NULL,
+			first_page_of_survey_data=NULL, gender=NULL, study_program=NULL, status_reason=NULL, phone_bidx=NULL, nationality_bidx=NULL
+			WHERE user_id=$1`,
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, request.SubjectID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	completed := time.Now().UTC()
+	res, err = tx.Exec("UPDATE erasure_requests SET completed_at=$1 WHERE id=$2 AND subject_id=$3", completed, request.ID, request.SubjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	rowCnt, err = res.RowsAffected()
+	if err != nil {
+		return nil, nil, err
+	}
+	if rowCnt == 0 {
+		return nil, nil, ErrNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request.Completed = completed
+	return documents, families, nil
+}
+
+// GetRejectedDocuments returns the documents of applications rejected before
+// rejectedBefore.  Applications rejected before status changes were recorded
+// count as rejected when they were last edited.
+func (r postgresRepository) GetRejectedDocuments(rejectedBefore time.Time) ([]*Document, error) {
+	rows, err := r.db.Query("SELECT "+documentColumns+" FROM "+documentTables+` WHERE application_id IN
+		(SELECT id FROM applications WHERE status='rejected' AND coalesce(status_changed_at, edited_at)<$1) ORDER BY documents.id`, rejectedBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	documents := []*Document{}
+	for rows.Next() {
+		document, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents, rows.Err()
+}
+
+// GetInactiveApplicants returns the ids of the applicants whose application
+// has not been edited since inactiveSince, or who signed up before without
+// applying.  Applicants that have been erased are left out.
+func (r postgresRepository) GetInactiveApplicants(inactiveSince time.Time) ([]int, error) {
+	rows, err := r.db.Query(`SELECT users.id FROM users LEFT JOIN applications ON applications.user_id=users.id
+		WHERE users.role_id=$1 AND coalesce(applications.edited_at, users.created_at)<$2
+		AND NOT EXISTS (SELECT 1 FROM erasure_requests WHERE subject_id=users.id AND completed_at IS NOT NULL)
+		ORDER BY users.id`, RoleApplication.ID(), inactiveSince)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applicants := []int{}
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		applicants = append(applicants, id)
+	}
+
+	return applicants, rows.Err()
+}
@@ -2,13 +2,31 @@ package server
 
 import (
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// requirePostgres skips tests that need a database reachable via DBCONN
+func requirePostgres(t *testing.T) {
+	if os.Getenv("DBCONN") == "" {
+		t.Skip("DBCONN not set, skipping postgres test")
+	}
+}
+
+func TestPostgresRepository(t *testing.T) {
+	requirePostgres(t)
+
+	repo, err := getPostgresDB()
+	require.NoError(t, err)
+
+	testRepository(t, repo)
+}
+
 func TestPostgres(t *testing.T) {
+	requirePostgres(t)
 
 	// Connect
 	repo, err := getPostgresDB()
@@ -72,6 +90,7 @@ func TestPostgres(t *testing.T) {
 }
 
 func TestPostgresApplications(t *testing.T) {
+	requirePostgres(t)
 
 	// Connect
 	repo, err := getPostgresDB()
@@ -155,6 +174,7 @@ func TestPostgresApplications(t *testing.T) {
 }
 
 func TestPostgresTokens(t *testing.T) {
+	requirePostgres(t)
 	// Connect
 	repo, err := getPostgresDB()
 	require.NoError(t, err)
@@ -201,3 +221,36 @@ func TestPostgresTokens(t *testing.T) {
 	// It should have been deleted as it is an expired token
 	require.Nil(t, repoToken)*/
 }
+
+func TestPostgresTokensAreHashed(t *testing.T) {
+	requirePostgres(t)
+
+	repo, err := getPostgresDB()
+	require.NoError(t, err)
+	db := repo.(postgresRepository).db
+
+	user := User{EmailAddress: fmt.Sprintf("test_%s@%s.com", GetRandomString(5, ""), GetRandomString(5, "")), FirstName: "neil", LastName: "tennant", Password: "$2a$10$notapassword", Created: time.Now().UTC(), Role: RoleApplication}
+	require.NoError(t, repo.SetUser(&user))
+
+	expiry := time.Now().UTC().Add(time.Hour)
+	access := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: expiry}
+	require.NoError(t, repo.SetToken(&access))
+	refresh := RefreshToken{UserID: user.ID, Value: GetRandomString(32, ""), Family: GetRandomString(16, ""), Expires: expiry}
+	require.NoError(t, repo.SetRefreshToken(&refresh))
+
+	var stored string
+	require.NoError(t, db.QueryRow("SELECT token_hash FROM auth_tokens WHERE user_id=$1", user.ID).Scan(&stored))
+	require.Equal(t, hashToken(access.Value), stored)
+	require.NoError(t, db.QueryRow("SELECT token_hash FROM refresh_tokens WHERE user_id=$1", user.ID).Scan(&stored))
+	require.Equal(t, hashToken(refresh.Value), stored)
+
+	// The hash is no good as a token
+	_, err = repo.GetToken(hashToken(access.Value))
+	require.Equal(t, ErrNotFound, err)
+	repoToken, err := repo.GetToken(access.Value)
+	require.NoError(t, err)
+	require.Equal(t, access.Value, repoToken.Value)
+
+	require.NoError(t, repo.DelToken(access.Value))
+	require.NoError(t, repo.RevokeTokenFamily(refresh.Family))
+}
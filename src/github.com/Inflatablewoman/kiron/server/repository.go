@@ -1,27 +1,50 @@
 package server
 
 import (
+	"errors"
 	"log"
+	"os"
 	"time"
 )
 
 var repository DataRepository
 
-// InitDatabase will create a connection to a postgres server
+// ErrNotFound is returned by a repository when the requested record does not exist
+var ErrNotFound = errors.New("Not found")
+
+// InitDatabase will create the repository selected by KIRON_REPOSITORY.  Use
+// "memory" for tests and local development, anything else connects to postgres.
 func InitDatabase() error {
 	var err error
-	repository, err = getPostgresDB()
-	return err
+	switch os.Getenv("KIRON_REPOSITORY") {
+	case "memory":
+		repository, err = getMemoryDB()
+	default:
+		repository, err = getPostgresDB()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The postgres repository encrypts sensitive application fields
+	err = initMasterKeys()
+	if err != nil {
+		return err
+	}
+
+	return initIndexKey()
 }
 
 // DataRepository is a repository
 type DataRepository interface {
-	GetApplications() ([]*Application, error) // this cannot return all applications, at least not with files.
-	GetApplicationsByStatus(status string) ([]*Application, error)
+	GetApplications(query ApplicationQuery) ([]*Application, int, error)
+	SearchApplications(query SearchQuery) ([]*SearchResult, error)
 	GetApplication(applicationID int) (*Application, error)
 	GetApplicationOf(userID int) (*Application, error)
 	SetApplication(application *Application) error
 	UpdateApplication(application *Application) error
+	TransitionApplication(change *StatusChange) error
+	GetStatusHistory(applicationID int) ([]*StatusChange, error)
 	DeleteApplication(applicationID int) error
 
 	GetComments(applicationID int) ([]*Comment, error)
@@ -37,15 +60,49 @@ type DataRepository interface {
 	UpdateUser(*User) error
 	DeleteUser(userID int) error
 
-	GetDocuments(applicationID int) ([][]byte, error)
+	GetDocuments(applicationID int) ([]*Document, error)
 	StoreDocument(document *Document) error
+	StoreDocuments(documents []*Document) error
+	GetDocumentTypes() ([]*DocumentType, error)
 	GetDocument(documentID int) (*Document, error)
+	GetPendingDocuments() ([]*Document, error)
+	SetDocumentScan(documentID int, status, result string) error
+	GetDocumentsToRekey(keyID string) ([]*Document, error)
+	RekeyDocument(document *Document, oldKeyID string) error
 	DeleteDocument(documentID int) error
 
 	GetToken(tokenValue string) (*Token, error)
 	SetToken(token *Token) error
 	DelToken(tokenValue string) error
 	DelExpiredTokens() error
+	SetRefreshToken(token *RefreshToken) error
+	UseRefreshToken(tokenValue string) (*RefreshToken, error)
+	RevokeTokenFamily(family string) error
+	RevokeToken(token *RevokedToken) error
+	GetRevokedTokens() ([]*RevokedToken, error)
+
+	AddPasswordReset(reset *PasswordReset) error
+	GetLastPasswordReset(userID int) (*PasswordReset, error)
+	ResetPassword(tokenValue, hashedPassword string) (*PasswordReset, []string, error)
+
+	AddEmailVerification(verification *EmailVerification) error
+	GetLastEmailVerification(userID int) (*EmailVerification, error)
+	VerifyEmail(tokenValue string) (*EmailVerification, error)
+
+	GetLoginFailures(key string) (*LoginFailures, error)
+	AddLoginFailure(key string, at, forgetBefore time.Time) (*LoginFailures, error)
+	UndoLoginFailure(key string, at, previous time.Time) error
+	DelLoginFailures(key string) error
+	DelExpiredLoginFailures(before time.Time) error
+
+	AddAuditEvent(event *AuditEvent) error
+	GetAuditEvents(subjectID int) ([]*AuditEvent, error)
+
+	AddErasureRequest(request *ErasureRequest) error
+	EraseUser(request *ErasureRequest) ([]*Document, []string, error)
+
+	GetRejectedDocuments(rejectedBefore time.Time) ([]*Document, error)
+	GetInactiveApplicants(inactiveSince time.Time) ([]int, error)
 }
 
 // Roles ...
@@ -68,6 +125,30 @@ func (r role) Value() int {
 	return int(r)
 }
 
+// roleIDs are the ids of the roles in the roles table
+var roleIDs = map[role]int{
+	RoleAdmin:         1,
+	RoleSubAdmin:      2,
+	RoleTrustedHelper: 3,
+	RoleLimitedHelper: 4,
+	RoleApplication:   5,
+}
+
+// ID returns the id of the role in the roles table
+func (r role) ID() int {
+	return roleIDs[r]
+}
+
+// roleFromID returns the role with the id from the roles table
+func roleFromID(id int) role {
+	for r, roleID := range roleIDs {
+		if roleID == id {
+			return r
+		}
+	}
+	return RoleNone
+}
+
 // User is the users struct
 type User struct {
 	ID           int
@@ -77,32 +158,15 @@ type User struct {
 	Password     string
 	Created      time.Time
 	Role         role
+	Verified     time.Time // zero until the email address is verified
 }
 
 // ToRestUser converts repo version of User to RestUser
 func (u *User) ToRestUser() *RestUser {
-	ru := RestUser{ID: u.ID, EmailAddress: u.EmailAddress, FirstName: u.FirstName, LastName: u.LastName, Created: u.Created, Role: u.Role}
+	ru := RestUser{ID: u.ID, EmailAddress: u.EmailAddress, FirstName: u.FirstName, LastName: u.LastName, Created: u.Created, Role: u.Role, Verified: !u.Verified.IsZero()}
 	return &ru
 }
 
-// Status ...
-type status string
-
-const statusNone = 0
-
-const (
-	statusRecieved role = 1 << iota
-	statusConfirmed
-	statusInVerification
-	statusVerified
-	statusWaitingForResponse
-	statusRejected
-	statusAccepted
-)
-
-// ALlowed stati
-var allowedStati = []string{"received", "confirmed", "inVerfication", "verified", "waitingForResponse", "rejected", "accepted"}
-
 // Allowed education types
 var allowedEducationTypes = []string{"none", "elementary", "secondary", "associate", "bachelor"}
 
@@ -123,6 +187,9 @@ type Application struct {
 	UserID                int
 	EducationLevel        int
 	Status                string
+	StatusChangedBy       int
+	StatusChangedAt       time.Time
+	StatusReason          string
 	BlockExpires          time.Time
 	Created               time.Time
 	Edited                time.Time
@@ -143,10 +210,79 @@ func (a *Application) ToRestApplication() *RestApplication {
 		Nationality: a.Nationality, Address: a.Address, AddressExtra: a.AddressExtra,
 		Zip: a.Zip, City: a.City, Country: a.Country, FirstPageOfSurveyData: a.FirstPageOfSurveyData,
 		Gender: a.Gender, EducationLevel: a.EducationLevel, Status: a.Status,
+		StatusChangedBy: a.StatusChangedBy, StatusChangedAt: a.StatusChangedAt, StatusReason: a.StatusReason,
 		Created: a.Created, Edited: a.Edited}
 	return &ru
 }
 
+// Fields applications can be sorted by.  Encrypted fields cannot be sorted.
+const (
+	sortByID      = "id"
+	sortByCreated = "created_at"
+	sortByEdited  = "edited_at"
+	sortByStatus  = "status"
+	sortByCountry = "country"
+)
+
+// Allowed sort fields
+var allowedApplicationSorts = []string{sortByID, sortByCreated, sortByEdited, sortByStatus, sortByCountry}
+
+// ApplicationQuery selects a page of applications.  Empty fields do not filter,
+// the From times are inclusive and the To times exclusive.  Ties in the sort
+// order are broken by id so pages never overlap.  Nationality and phone
+// number are encrypted and only match exactly, ignoring case and formatting.
+type ApplicationQuery struct {
+	Status         string
+	Nationality    string
+	Phone          string
+	Country        string
+	Gender         string
+	EducationLevel int
+	CreatedFrom    time.Time
+	CreatedTo      time.Time
+	EditedFrom     time.Time
+	EditedTo       time.Time
+
+	Sort       string
+	Descending bool
+
+	Limit  int
+	Offset int
+}
+
+// SearchQuery is a full text search for applications.  Every word of Text has
+// to be the start of a word in the name, email address, study program or
+// comments of an application.  The city and the nationality, which limited
+// helpers may not see, are only searched if Private is set.  The nationality
+// is encrypted, so it only matches if Text is the whole nationality, ignoring
+// case.  Other encrypted fields are never searched.
+type SearchQuery struct {
+	Text    string
+	Private bool
+	Limit   int
+}
+
+// SearchResult is an application found by a search.  The snippet is HTML,
+// the escaped text with the matched words between snippetStart and
+// snippetStop.
+type SearchResult struct {
+	Application *Application
+	Rank        float64
+	Snippet     string
+}
+
+// StatusChange moves an application from one status to another.  Every change
+// is kept in the status history.
+type StatusChange struct {
+	ID            int
+	ApplicationID int
+	From          string
+	To            string
+	UserID        int
+	Reason        string
+	Changed       time.Time
+}
+
 // Comment ...
 type Comment struct {
 	ID            int
@@ -156,19 +292,74 @@ type Comment struct {
 	Contents      string
 }
 
-// Document ...
+// DocumentType is a kind of document an applicant can upload
+type DocumentType struct {
+	ID   int
+	Name string
+}
+
+// Document is the metadata of an uploaded file.  The contents are kept in the
+// blobs under StorageKey.
 type Document struct {
 	ID             int
 	ApplicationID  int
 	DocumentTypeID int
-	Contents       []byte
+	DocumentType   string // name of the document type, only set when reading
+	Filename       string
+	ContentType    string
+	Size           int64
+	Checksum       string // hex encoded SHA-256 of the contents
+	UploadedBy     int
+	Created        time.Time
+	StorageKey     string
+	ScanStatus     string // scanPending, scanClean or scanQuarantined
+	ScanResult     string // why a document is quarantined
+	KeyID          string // master key that wrapped DataKey, empty if not encrypted
+	DataKey        []byte // wrapped key the contents are encrypted with
+}
+
+// ToRestDocument converts repo version of Document to RestDocument
+func (d *Document) ToRestDocument() *RestDocument {
+	rd := RestDocument{
+		ID: d.ID, ApplicationID: d.ApplicationID, DocumentTypeID: d.DocumentTypeID, DocumentType: d.DocumentType,
+		Filename: d.Filename, ContentType: d.ContentType, Size: d.Size, Checksum: d.Checksum,
+		UploadedBy: d.UploadedBy, Created: d.Created, ScanStatus: d.ScanStatus, ScanResult: d.ScanResult}
+	return &rd
 }
 
-// LoginResponse ...
+// Actions recorded in the audit trail
+const (
+	auditExport = "export"
+)
+
+// AuditEvent records that a user did something with the personal data of
+// another user, or their own.  Events are kept after the users are deleted.
+type AuditEvent struct {
+	ID         int
+	UserID     int // who did it
+	SubjectID  int // whose data it was
+	Action     string
+	RemoteAddr string
+	Created    time.Time
+}
+
+// ErasureRequest asks for the personal data of a user to be erased.  It is
+// kept as a record of the erasure.
+type ErasureRequest struct {
+	ID          int
+	SubjectID   int // whose data is erased
+	RequestedBy int // 0 for the retention policy
+	Requested   time.Time
+	Completed   time.Time // zero until the data is erased
+}
+
+// LoginResponse ...  The expiries are in seconds.
 type LoginResponse struct {
-	Token       string
-	TokenExpiry int
-	Result      LoginResult
+	Token              string
+	TokenExpiry        int
+	RefreshToken       string
+	RefreshTokenExpiry int
+	Result             LoginResult
 }
 
 // LoginResult  ...
@@ -185,4 +376,51 @@ type Token struct {
 	UserID  int
 	Value   string
 	Expires time.Time
+	Family  string // of the refresh tokens it was issued with
+}
+
+// RefreshToken is exchanged once for a new access token and a new refresh
+// token.  The tokens issued since a login are a family, if a refresh token is
+// used twice the family is revoked.
+type RefreshToken struct {
+	UserID  int
+	Value   string
+	Family  string
+	Expires time.Time
+	Used    time.Time // zero until it is exchanged
+}
+
+// PasswordReset lets a user set a new password without the old one.  The
+// value is mailed to the user and stored hashed, it can be used once.
+type PasswordReset struct {
+	ID      int
+	UserID  int
+	Value   string
+	Created time.Time
+	Expires time.Time
+}
+
+// EmailVerification proves that a new user can read the mails sent to its
+// email address.  Like a PasswordReset it is stored hashed and used once.
+type EmailVerification struct {
+	ID      int
+	UserID  int
+	Value   string
+	Created time.Time
+	Expires time.Time
+}
+
+// LoginFailures counts the failed logins of an account or an address since
+// the failures were last forgotten
+type LoginFailures struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+}
+
+// RevokedToken is the id of a signed access token or of a token family that
+// is refused until it expires
+type RevokedToken struct {
+	ID      string
+	Expires time.Time
 }
@@ -0,0 +1,1058 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testRepository runs the behaviour every DataRepository implementation has to
+// share.  It only creates records with random keys so it can run against a
+// database that is also used for other things.
+func testRepository(t *testing.T, repo DataRepository) {
+	t.Run("Users", func(t *testing.T) { testRepositoryUsers(t, repo) })
+	t.Run("Applications", func(t *testing.T) { testRepositoryApplications(t, repo) })
+	t.Run("ApplicationQueries", func(t *testing.T) { testRepositoryApplicationQueries(t, repo) })
+	t.Run("Search", func(t *testing.T) { testRepositorySearch(t, repo) })
+	t.Run("Comments", func(t *testing.T) { testRepositoryComments(t, repo) })
+	t.Run("Documents", func(t *testing.T) { testRepositoryDocuments(t, repo) })
+	t.Run("Tokens", func(t *testing.T) { testRepositoryTokens(t, repo) })
+	t.Run("AuditEvents", func(t *testing.T) { testRepositoryAuditEvents(t, repo) })
+	t.Run("Erasure", func(t *testing.T) { testRepositoryErasure(t, repo) })
+	t.Run("Retention", func(t *testing.T) { testRepositoryRetention(t, repo) })
+	t.Run("LoginFailures", func(t *testing.T) { testRepositoryLoginFailures(t, repo) })
+	t.Run("PasswordResets", func(t *testing.T) { testRepositoryPasswordResets(t, repo) })
+	t.Run("EmailVerifications", func(t *testing.T) { testRepositoryEmailVerifications(t, repo) })
+}
+
+// createTestUser stores a user with a random email address
+func createTestUser(t *testing.T, repo DataRepository, r role) *User {
+	bcryptPassword, err := createHashedPassword("westEndGirls")
+	require.NoError(t, err)
+
+	emailAddress := fmt.Sprintf("test_%s@%s.com", GetRandomString(8, ""), GetRandomString(5, ""))
+	user := User{EmailAddress: emailAddress, FirstName: "neil", LastName: "tennant", Password: bcryptPassword, Created: time.Now().UTC(), Role: r, Verified: time.Now().UTC()}
+
+	err = repo.SetUser(&user)
+	require.NoError(t, err)
+	require.True(t, user.ID > 0)
+
+	return &user
+}
+
+// createTestApplication stores an application for the user
+func createTestApplication(t *testing.T, repo DataRepository, userID int) *Application {
+	created := time.Now().UTC()
+	appl := Application{
+		Birthday:              created,
+		PhoneNumber:           "555",
+		Nationality:           "marsian",
+		Country:               "for old men",
+		City:                  "atlantis",
+		Zip:                   "666",
+		Address:               "none",
+		AddressExtra:          "of yo business",
+		FirstPageOfSurveyData: "I use a GameBoy",
+		Gender:                "female",
+		StudyProgram:          "astronomy",
+		UserID:                userID,
+		EducationLevel:        2,
+		Status:                "received",
+		BlockExpires:          created,
+		Created:               created,
+		Edited:                created}
+
+	err := repo.SetApplication(&appl)
+	require.NoError(t, err)
+	require.True(t, appl.ID > 0)
+
+	return &appl
+}
+
+func testRepositoryUsers(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleAdmin)
+
+	repoUser, err := repo.GetUserByEmail(user.EmailAddress)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, repoUser.ID)
+	require.Equal(t, user.FirstName, repoUser.FirstName)
+	require.Equal(t, user.LastName, repoUser.LastName)
+	require.Equal(t, user.Password, repoUser.Password)
+	require.WithinDuration(t, user.Created, repoUser.Created, time.Duration(5*time.Second))
+	require.Equal(t, RoleAdmin, repoUser.Role)
+
+	// The user is listed, the repository may hold others
+	users, err := repo.GetUsers()
+	require.NoError(t, err)
+	var listed *User
+	for i := range users {
+		if users[i].ID == user.ID {
+			listed = &users[i]
+		}
+	}
+	require.NotNil(t, listed)
+	require.Equal(t, user.EmailAddress, listed.EmailAddress)
+	require.Equal(t, user.LastName, listed.LastName)
+	require.Equal(t, RoleAdmin, listed.Role)
+	require.False(t, listed.Verified.IsZero())
+	for i := 1; i < len(users); i++ {
+		require.True(t, users[i-1].ID < users[i].ID)
+	}
+
+	// Duplicate email addresses are refused
+	duplicate := *user
+	err = repo.SetUser(&duplicate)
+	require.Error(t, err)
+
+	// Passwords must be bcrypt hashes
+	plain := User{EmailAddress: "plain_" + user.EmailAddress, FirstName: "plain", LastName: "text", Password: "monkey", Created: time.Now().UTC(), Role: RoleAdmin}
+	err = repo.SetUser(&plain)
+	require.Error(t, err)
+
+	repoUser.LastName = "waterboy"
+	err = repo.UpdateUser(repoUser)
+	require.NoError(t, err)
+
+	repoUser, err = repo.GetUser(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, user.EmailAddress, repoUser.EmailAddress)
+	require.Equal(t, "waterboy", repoUser.LastName)
+
+	err = repo.DeleteUser(user.ID)
+	require.NoError(t, err)
+
+	_, err = repo.GetUser(user.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	_, err = repo.GetUserByEmail(user.EmailAddress)
+	require.Equal(t, ErrNotFound, err)
+
+	// Every role survives the round trip
+	for _, r := range []role{RoleAdmin, RoleSubAdmin, RoleTrustedHelper, RoleLimitedHelper, RoleApplication} {
+		user = createTestUser(t, repo, r)
+
+		repoUser, err = repo.GetUser(user.ID)
+		require.NoError(t, err)
+		require.Equal(t, r, repoUser.Role)
+
+		err = repo.DeleteUser(user.ID)
+		require.NoError(t, err)
+	}
+}
+
+func testRepositoryApplications(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleAdmin)
+	appl := createTestApplication(t, repo, user.ID)
+
+	repoAppl, err := repo.GetApplicationOf(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, appl.ID, repoAppl.ID)
+	require.Equal(t, user.ID, repoAppl.UserID)
+	// Birthday is stored as date not timestamp
+	require.WithinDuration(t, appl.Birthday, repoAppl.Birthday, time.Duration(24*time.Hour))
+	require.Equal(t, "555", repoAppl.PhoneNumber)
+	require.Equal(t, "marsian", repoAppl.Nationality)
+	require.Equal(t, "astronomy", repoAppl.StudyProgram)
+	require.Equal(t, "received", repoAppl.Status)
+	require.WithinDuration(t, appl.Created, repoAppl.Created, time.Duration(5*time.Second))
+
+	// Only one application per user
+	second := *appl
+	err = repo.SetApplication(&second)
+	require.Error(t, err)
+
+	repoAppl.Nationality = "venusian"
+	repoAppl.StudyProgram = "geology"
+	err = repo.UpdateApplication(repoAppl)
+	require.NoError(t, err)
+
+	repoAppl, err = repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, "venusian", repoAppl.Nationality)
+	require.Equal(t, "geology", repoAppl.StudyProgram)
+
+	// Updates leave the status alone
+	repoAppl.Status = "accepted"
+	err = repo.UpdateApplication(repoAppl)
+	require.NoError(t, err)
+
+	repoAppl, err = repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, "received", repoAppl.Status)
+
+	// Status changes only apply to the expected status
+	changed := time.Now().UTC()
+	change := StatusChange{ApplicationID: appl.ID, From: "confirmed", To: "in verification", UserID: user.ID, Changed: changed}
+	err = repo.TransitionApplication(&change)
+	require.Equal(t, ErrStatusConflict, err)
+
+	change = StatusChange{ApplicationID: appl.ID, From: "received", To: "confirmed", UserID: user.ID, Reason: "all there", Changed: changed}
+	err = repo.TransitionApplication(&change)
+	require.NoError(t, err)
+
+	repoAppl, err = repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, "confirmed", repoAppl.Status)
+	require.Equal(t, user.ID, repoAppl.StatusChangedBy)
+	require.Equal(t, "all there", repoAppl.StatusReason)
+	require.WithinDuration(t, changed, repoAppl.StatusChangedAt, time.Duration(5*time.Second))
+
+	err = repo.TransitionApplication(&change)
+	require.Equal(t, ErrStatusConflict, err)
+
+	// Only the successful change is in the history
+	history, err := repo.GetStatusHistory(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.True(t, history[0].ID > 0)
+	require.Equal(t, appl.ID, history[0].ApplicationID)
+	require.Equal(t, "received", history[0].From)
+	require.Equal(t, "confirmed", history[0].To)
+	require.Equal(t, user.ID, history[0].UserID)
+	require.Equal(t, "all there", history[0].Reason)
+	require.WithinDuration(t, changed, history[0].Changed, time.Duration(5*time.Second))
+
+	confirmed, _, err := repo.GetApplications(ApplicationQuery{Status: "confirmed", Nationality: "venusian"})
+	require.NoError(t, err)
+	found := false
+	for _, a := range confirmed {
+		found = found || a.ID == appl.ID
+	}
+	require.True(t, found)
+
+	err = repo.DeleteApplication(appl.ID)
+	require.NoError(t, err)
+
+	_, err = repo.GetApplication(appl.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	_, err = repo.GetApplicationOf(user.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	err = repo.DeleteUser(user.ID)
+	require.NoError(t, err)
+}
+
+func testRepositoryApplicationQueries(t *testing.T, repo DataRepository) {
+	// A nationality nobody else uses keeps other records out of the results
+	nationality := GetRandomString(12, "")
+	start := time.Now().UTC().Truncate(time.Second)
+
+	var (
+		users []*User
+		apps  []*Application
+	)
+	for i := 0; i < 5; i++ {
+		user := createTestUser(t, repo, RoleApplication)
+		appl := createTestApplication(t, repo, user.ID)
+
+		appl.Nationality = nationality
+		appl.PhoneNumber = fmt.Sprintf("+49 (30) %d-%d", start.UnixNano(), i)
+		appl.Country = "country" + strconv.Itoa(i%2)
+		appl.Created = start.Add(time.Duration(i) * time.Hour)
+		appl.Edited = appl.Created
+		require.NoError(t, repo.UpdateApplication(appl))
+
+		users = append(users, user)
+		apps = append(apps, appl)
+	}
+
+	ids := func(apps []*Application) []int {
+		var ids []int
+		for _, a := range apps {
+			ids = append(ids, a.ID)
+		}
+		return ids
+	}
+
+	page, total, err := repo.GetApplications(ApplicationQuery{Nationality: nationality, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Equal(t, []int{apps[0].ID, apps[1].ID}, ids(page))
+
+	page, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Limit: 2, Offset: 4})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Equal(t, []int{apps[4].ID}, ids(page))
+
+	page, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Offset: 10})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+	require.Empty(t, page)
+
+	// Sorting with the id as tie breaker
+	page, _, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Sort: sortByCountry, Descending: true})
+	require.NoError(t, err)
+	require.Equal(t, []int{apps[3].ID, apps[1].ID, apps[4].ID, apps[2].ID, apps[0].ID}, ids(page))
+
+	page, _, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Sort: sortByCreated, Descending: true, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, []int{apps[4].ID}, ids(page))
+
+	// Filters
+	page, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Country: "COUNTRY1"})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, []int{apps[1].ID, apps[3].ID}, ids(page))
+
+	page, _, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, CreatedFrom: apps[1].Created, CreatedTo: apps[3].Created})
+	require.NoError(t, err)
+	require.Equal(t, []int{apps[1].ID, apps[2].ID}, ids(page))
+
+	page, _, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, EditedFrom: apps[4].Edited})
+	require.NoError(t, err)
+	require.Equal(t, []int{apps[4].ID}, ids(page))
+
+	// Phone numbers and nationalities match exactly, whatever their formatting
+	page, total, err = repo.GetApplications(ApplicationQuery{Phone: fmt.Sprintf("+4930%d2", start.UnixNano())})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, []int{apps[2].ID}, ids(page))
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Phone: fmt.Sprintf("+4930%d", start.UnixNano())})
+	require.NoError(t, err)
+	require.Equal(t, 0, total)
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Nationality: " " + strings.ToUpper(nationality)})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality[:6]})
+	require.NoError(t, err)
+	require.Equal(t, 0, total)
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Gender: "male"})
+	require.NoError(t, err)
+	require.Equal(t, 0, total)
+
+	_, total, err = repo.GetApplications(ApplicationQuery{Nationality: nationality, Gender: "female", EducationLevel: 2, Status: "received"})
+	require.NoError(t, err)
+	require.Equal(t, 5, total)
+
+	for i := range apps {
+		require.NoError(t, repo.DeleteApplication(apps[i].ID))
+		require.NoError(t, repo.DeleteUser(users[i].ID))
+	}
+}
+
+func testRepositorySearch(t *testing.T, repo DataRepository) {
+	// Words nobody else uses keep other records out of the results
+	name := "n" + strings.ToLower(GetRandomString(10, "alpha"))
+	city := "c" + strings.ToLower(GetRandomString(10, "alpha"))
+
+	named := createTestUser(t, repo, RoleApplication)
+	named.FirstName = strings.ToUpper(name)
+	require.NoError(t, repo.UpdateUser(named))
+	namedAppl := createTestApplication(t, repo, named.ID)
+	namedAppl.City = city
+	require.NoError(t, repo.UpdateApplication(namedAppl))
+
+	commented := createTestUser(t, repo, RoleApplication)
+	commentedAppl := createTestApplication(t, repo, commented.ID)
+	comment := Comment{Created: time.Now().UTC(), ApplicationID: commentedAppl.ID, UserID: named.ID, Contents: "same as " + name}
+	require.NoError(t, repo.SetComment(&comment))
+
+	// Prefixes match and names rank above comments
+	results, err := repo.SearchApplications(SearchQuery{Text: name[:6], Private: true})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, namedAppl.ID, results[0].Application.ID)
+	require.Equal(t, commentedAppl.ID, results[1].Application.ID)
+	require.True(t, results[0].Rank > results[1].Rank)
+	require.Contains(t, results[0].Snippet, snippetStart+strings.ToUpper(name)+snippetStop)
+	require.Contains(t, results[1].Snippet, snippetStart+name+snippetStop)
+
+	results, err = repo.SearchApplications(SearchQuery{Text: name, Private: true, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	// Every word has to match
+	results, err = repo.SearchApplications(SearchQuery{Text: name + " " + city, Private: true})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, namedAppl.ID, results[0].Application.ID)
+
+	// Private fields are neither searched nor shown without Private
+	results, err = repo.SearchApplications(SearchQuery{Text: city})
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	results, err = repo.SearchApplications(SearchQuery{Text: name})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NotContains(t, results[0].Snippet, city)
+
+	// The encrypted nationality only matches as a whole and only with Private
+	nationality := "n" + strings.ToLower(GetRandomString(10, "alpha"))
+	namedAppl.Nationality = strings.ToUpper(nationality)
+	require.NoError(t, repo.UpdateApplication(namedAppl))
+
+	results, err = repo.SearchApplications(SearchQuery{Text: " " + nationality + " ", Private: true})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, namedAppl.ID, results[0].Application.ID)
+	require.True(t, results[0].Rank > 0)
+	require.Contains(t, results[0].Snippet, snippetStart+strings.ToUpper(nationality)+snippetStop)
+
+	results, err = repo.SearchApplications(SearchQuery{Text: nationality})
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	results, err = repo.SearchApplications(SearchQuery{Text: nationality[:6], Private: true})
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	// Markup in a name is escaped around the marked words
+	scripted := createTestUser(t, repo, RoleApplication)
+	scripted.FirstName = "<script>alert('" + name + "')</script>"
+	require.NoError(t, repo.UpdateUser(scripted))
+	scriptedAppl := createTestApplication(t, repo, scripted.ID)
+	results, err = repo.SearchApplications(SearchQuery{Text: "script " + name})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NotContains(t, results[0].Snippet, "<script>")
+	require.Contains(t, results[0].Snippet, "&lt;"+snippetStart+"script"+snippetStop+"&gt;")
+	require.NoError(t, repo.DeleteApplication(scriptedAppl.ID))
+	require.NoError(t, repo.DeleteUser(scripted.ID))
+
+	results, err = repo.SearchApplications(SearchQuery{Text: " ':*& "})
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	require.NoError(t, repo.DeleteComment(comment.ID))
+	for _, appl := range []*Application{namedAppl, commentedAppl} {
+		require.NoError(t, repo.DeleteApplication(appl.ID))
+		require.NoError(t, repo.DeleteUser(appl.UserID))
+	}
+}
+
+func testRepositoryComments(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleAdmin)
+	appl := createTestApplication(t, repo, user.ID)
+
+	created := time.Now().UTC()
+	comment := Comment{Created: created, ApplicationID: appl.ID, UserID: user.ID, Contents: "looks good"}
+	err := repo.SetComment(&comment)
+	require.NoError(t, err)
+	require.True(t, comment.ID > 0)
+
+	second := Comment{Created: created, ApplicationID: appl.ID, UserID: user.ID, Contents: "needs a passport"}
+	err = repo.SetComment(&second)
+	require.NoError(t, err)
+
+	comments, err := repo.GetComments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, comments, 2)
+
+	repoComment, err := repo.GetComment(comment.ID)
+	require.NoError(t, err)
+	require.Equal(t, appl.ID, repoComment.ApplicationID)
+	require.Equal(t, user.ID, repoComment.UserID)
+	require.Equal(t, "looks good", repoComment.Contents)
+	require.WithinDuration(t, created, repoComment.Created, time.Duration(5*time.Second))
+
+	repoComment.Contents = "looks great"
+	err = repo.UpdateComment(repoComment)
+	require.NoError(t, err)
+
+	repoComment, err = repo.GetComment(comment.ID)
+	require.NoError(t, err)
+	require.Equal(t, "looks great", repoComment.Contents)
+
+	for _, c := range comments {
+		err = repo.DeleteComment(c.ID)
+		require.NoError(t, err)
+	}
+
+	_, err = repo.GetComment(comment.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	err = repo.DeleteApplication(appl.ID)
+	require.NoError(t, err)
+	err = repo.DeleteUser(user.ID)
+	require.NoError(t, err)
+}
+
+func testRepositoryDocuments(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleAdmin)
+	appl := createTestApplication(t, repo, user.ID)
+
+	contents := []byte(GetRandomString(50, "test"))
+	created := time.Now().UTC()
+	document := newDocument(appl.ID, 1, user.ID, "passport.txt", contents, created)
+	document.StorageKey = "test/" + GetRandomString(16, "")
+	err := repo.StoreDocument(document)
+	require.NoError(t, err)
+	require.True(t, document.ID > 0)
+
+	repoDocument, err := repo.GetDocument(document.ID)
+	require.NoError(t, err)
+	require.Equal(t, appl.ID, repoDocument.ApplicationID)
+	require.Equal(t, 1, repoDocument.DocumentTypeID)
+	require.NotEmpty(t, repoDocument.DocumentType)
+	require.Equal(t, document.StorageKey, repoDocument.StorageKey)
+	require.Equal(t, "passport.txt", repoDocument.Filename)
+	require.Equal(t, "text/plain; charset=utf-8", repoDocument.ContentType)
+	require.Equal(t, int64(50), repoDocument.Size)
+	require.Equal(t, document.Checksum, repoDocument.Checksum)
+	require.Equal(t, user.ID, repoDocument.UploadedBy)
+	require.WithinDuration(t, created, repoDocument.Created, time.Duration(5*time.Second))
+
+	require.Equal(t, scanPending, repoDocument.ScanStatus)
+
+	pending, err := repo.GetPendingDocuments()
+	require.NoError(t, err)
+	require.Contains(t, documentIDs(pending), document.ID)
+
+	err = repo.SetDocumentScan(document.ID, scanQuarantined, "File type not allowed")
+	require.NoError(t, err)
+
+	repoDocument, err = repo.GetDocument(document.ID)
+	require.NoError(t, err)
+	require.Equal(t, scanQuarantined, repoDocument.ScanStatus)
+	require.Equal(t, "File type not allowed", repoDocument.ScanResult)
+
+	pending, err = repo.GetPendingDocuments()
+	require.NoError(t, err)
+	require.NotContains(t, documentIDs(pending), document.ID)
+
+	err = repo.SetDocumentScan(document.ID+1000000, scanClean, "")
+	require.Equal(t, ErrNotFound, err)
+
+	// Keys change only if nobody else changed them
+	toRekey, err := repo.GetDocumentsToRekey("2017")
+	require.NoError(t, err)
+	require.Contains(t, documentIDs(toRekey), document.ID)
+
+	rekeyed := *repoDocument
+	rekeyed.StorageKey = "test/" + GetRandomString(16, "")
+	rekeyed.KeyID = "2017"
+	rekeyed.DataKey = []byte("wrapped")
+	err = repo.RekeyDocument(&rekeyed, "2016")
+	require.Equal(t, ErrNotFound, err)
+	err = repo.RekeyDocument(&rekeyed, "")
+	require.NoError(t, err)
+
+	repoDocument, err = repo.GetDocument(document.ID)
+	require.NoError(t, err)
+	require.Equal(t, rekeyed.StorageKey, repoDocument.StorageKey)
+	require.Equal(t, "2017", repoDocument.KeyID)
+	require.Equal(t, []byte("wrapped"), repoDocument.DataKey)
+	document.StorageKey = rekeyed.StorageKey
+
+	toRekey, err = repo.GetDocumentsToRekey("2017")
+	require.NoError(t, err)
+	require.NotContains(t, documentIDs(toRekey), document.ID)
+
+	// Storage keys are unique
+	duplicate := *document
+	err = repo.StoreDocument(&duplicate)
+	require.Error(t, err)
+
+	documents, err := repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+	require.Equal(t, *repoDocument, *documents[0])
+
+	// A batch is stored completely or not at all
+	first := newDocument(appl.ID, 2, user.ID, "a.txt", contents, created)
+	first.StorageKey = "test/" + GetRandomString(16, "")
+	second := newDocument(appl.ID, 1000, user.ID, "b.txt", contents, created)
+	second.StorageKey = "test/" + GetRandomString(16, "")
+	err = repo.StoreDocuments([]*Document{first, second})
+	require.Error(t, err)
+
+	documents, err = repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 1)
+
+	second.DocumentTypeID = 3
+	err = repo.StoreDocuments([]*Document{first, second})
+	require.NoError(t, err)
+	require.True(t, first.ID > 0)
+	require.True(t, second.ID > first.ID)
+
+	documents, err = repo.GetDocuments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, documents, 3)
+	require.Equal(t, 3, documents[2].DocumentTypeID)
+
+	documentTypes, err := repo.GetDocumentTypes()
+	require.NoError(t, err)
+	require.NotEmpty(t, documentTypes)
+	require.Equal(t, 1, documentTypes[0].ID)
+	require.NotEmpty(t, documentTypes[0].Name)
+
+	for _, d := range []*Document{document, first, second} {
+		err = repo.DeleteDocument(d.ID)
+		require.NoError(t, err)
+	}
+
+	_, err = repo.GetDocument(document.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	err = repo.DeleteApplication(appl.ID)
+	require.NoError(t, err)
+	err = repo.DeleteUser(user.ID)
+	require.NoError(t, err)
+}
+
+// documentIDs returns the ids of the documents
+func documentIDs(documents []*Document) []int {
+	var ids []int
+	for _, document := range documents {
+		ids = append(ids, document.ID)
+	}
+	return ids
+}
+
+func testRepositoryTokens(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleAdmin)
+
+	expiry := time.Now().UTC().Add(time.Hour)
+	token := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: expiry}
+
+	err := repo.SetToken(&token)
+	require.NoError(t, err)
+
+	repoToken, err := repo.GetToken(token.Value)
+	require.NoError(t, err)
+	require.Equal(t, token.Value, repoToken.Value)
+	require.Equal(t, user.ID, repoToken.UserID)
+	require.WithinDuration(t, expiry, repoToken.Expires, time.Duration(5*time.Second))
+
+	err = repo.DelToken(token.Value)
+	require.NoError(t, err)
+
+	repoToken, err = repo.GetToken(token.Value)
+	require.Equal(t, ErrNotFound, err)
+	require.Nil(t, repoToken)
+
+	// Tokens are refused once they expire and purged afterwards
+	expiring := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: expiry}
+	require.NoError(t, repo.SetToken(&expiring))
+
+	defer func(c Clock) {
+		clock = c
+	}(clock)
+	clock = newFakeClock(expiry)
+
+	_, err = repo.GetToken(expiring.Value)
+	require.Equal(t, ErrNotFound, err)
+
+	clock = systemClock{}
+	_, err = repo.GetToken(expiring.Value)
+	require.NoError(t, err)
+
+	clock = newFakeClock(expiry.Add(time.Minute))
+	require.NoError(t, repo.DelExpiredTokens())
+
+	clock = systemClock{}
+	_, err = repo.GetToken(expiring.Value)
+	require.Equal(t, ErrNotFound, err)
+
+	// Refresh tokens can be used once
+	family := GetRandomString(16, "")
+	access := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: expiry, Family: family}
+	require.NoError(t, repo.SetToken(&access))
+	refresh := RefreshToken{UserID: user.ID, Value: GetRandomString(32, ""), Family: family, Expires: expiry}
+	require.NoError(t, repo.SetRefreshToken(&refresh))
+
+	repoToken, err = repo.GetToken(access.Value)
+	require.NoError(t, err)
+	require.Equal(t, family, repoToken.Family)
+
+	used, err := repo.UseRefreshToken(refresh.Value)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, used.UserID)
+	require.Equal(t, family, used.Family)
+	require.False(t, used.Used.IsZero())
+
+	used, err = repo.UseRefreshToken(refresh.Value)
+	require.Equal(t, ErrRefreshTokenReused, err)
+	require.Equal(t, family, used.Family)
+
+	_, err = repo.UseRefreshToken(GetRandomString(32, ""))
+	require.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, repo.RevokeTokenFamily(family))
+	_, err = repo.UseRefreshToken(refresh.Value)
+	require.Equal(t, ErrNotFound, err)
+	_, err = repo.GetToken(access.Value)
+	require.Equal(t, ErrNotFound, err)
+
+	// And expire like access tokens
+	refresh = RefreshToken{UserID: user.ID, Value: GetRandomString(32, ""), Family: family, Expires: expiry}
+	require.NoError(t, repo.SetRefreshToken(&refresh))
+	clock = newFakeClock(expiry)
+	_, err = repo.UseRefreshToken(refresh.Value)
+	require.Equal(t, ErrNotFound, err)
+	require.NoError(t, repo.DelExpiredTokens())
+	clock = systemClock{}
+
+	// Revoked signed tokens are listed until they expire
+	revokedID := GetRandomString(16, "")
+	require.NoError(t, repo.RevokeToken(&RevokedToken{ID: revokedID, Expires: expiry}))
+	require.NoError(t, repo.RevokeToken(&RevokedToken{ID: revokedID, Expires: expiry.Add(-time.Minute)}))
+	revoked, err := repo.GetRevokedTokens()
+	require.NoError(t, err)
+	found := false
+	for _, token := range revoked {
+		if token.ID == revokedID {
+			found = true
+			require.WithinDuration(t, expiry, token.Expires, time.Second)
+		}
+	}
+	require.True(t, found)
+
+	clock = newFakeClock(expiry)
+	require.NoError(t, repo.DelExpiredTokens())
+	revoked, err = repo.GetRevokedTokens()
+	require.NoError(t, err)
+	for _, token := range revoked {
+		require.NotEqual(t, revokedID, token.ID)
+	}
+	clock = systemClock{}
+
+	err = repo.DeleteUser(user.ID)
+	require.NoError(t, err)
+}
+
+func testRepositoryAuditEvents(t *testing.T, repo DataRepository) {
+	admin := createTestUser(t, repo, RoleAdmin)
+	subject := createTestUser(t, repo, RoleApplication)
+
+	created := time.Now().UTC()
+	for _, userID := range []int{subject.ID, admin.ID} {
+		event := AuditEvent{UserID: userID, SubjectID: subject.ID, Action: auditExport, RemoteAddr: "127.0.0.1", Created: created}
+		require.NoError(t, repo.AddAuditEvent(&event))
+		require.True(t, event.ID > 0)
+		created = created.Add(time.Second)
+	}
+
+	events, err := repo.GetAuditEvents(subject.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, subject.ID, events[0].UserID)
+	require.Equal(t, admin.ID, events[1].UserID)
+	require.Equal(t, subject.ID, events[1].SubjectID)
+	require.Equal(t, auditExport, events[1].Action)
+	require.Equal(t, "127.0.0.1", events[1].RemoteAddr)
+
+	// The trail stays when the users are gone
+	require.NoError(t, repo.DeleteUser(admin.ID))
+	require.NoError(t, repo.DeleteUser(subject.ID))
+
+	events, err = repo.GetAuditEvents(subject.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	events, err = repo.GetAuditEvents(admin.ID)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func testRepositoryErasure(t *testing.T, repo DataRepository) {
+	admin := createTestUser(t, repo, RoleAdmin)
+	user := createTestUser(t, repo, RoleApplication)
+	appl := createTestApplication(t, repo, user.ID)
+
+	token := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	require.NoError(t, repo.SetToken(&token))
+	refresh := RefreshToken{UserID: user.ID, Value: GetRandomString(16, ""), Family: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	require.NoError(t, repo.SetRefreshToken(&refresh))
+
+	document := Document{ApplicationID: appl.ID, DocumentTypeID: 1, Filename: "passport.pdf", StorageKey: "erase/passport", Created: time.Now().UTC()}
+	require.NoError(t, repo.StoreDocument(&document))
+
+	comment := Comment{Created: time.Now().UTC(), ApplicationID: appl.ID, UserID: admin.ID, Contents: "lives with her sister"}
+	require.NoError(t, repo.SetComment(&comment))
+
+	change, err := newStatusChange(appl, statusConfirmed, admin, "phoned her", time.Now().UTC())
+	require.NoError(t, err)
+	require.NoError(t, repo.TransitionApplication(change))
+
+	request := ErasureRequest{SubjectID: user.ID, RequestedBy: admin.ID, Requested: time.Now().UTC()}
+	require.NoError(t, repo.AddErasureRequest(&request))
+	require.True(t, request.ID > 0)
+
+	documents, families, err := repo.EraseUser(&request)
+	require.NoError(t, err)
+	require.Equal(t, []string{refresh.Family}, families)
+	require.Equal(t, []int{document.ID}, documentIDs(documents))
+	require.Equal(t, "erase/passport", documents[0].StorageKey)
+	require.False(t, request.Completed.IsZero())
+
+	repoUser, err := repo.GetUser(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, erasedEmail(user.ID), repoUser.EmailAddress)
+	require.Empty(t, repoUser.FirstName)
+	require.Empty(t, repoUser.LastName)
+	require.Equal(t, RoleApplication, repoUser.Role)
+	match, _ := MatchPassword("password", repoUser.Password)
+	require.False(t, match)
+
+	_, err = repo.GetUserByEmail(user.EmailAddress)
+	require.Error(t, err)
+
+	// Statistics survive
+	repoAppl, err := repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(statusConfirmed), repoAppl.Status)
+	require.Equal(t, appl.EducationLevel, repoAppl.EducationLevel)
+	require.WithinDuration(t, appl.Created, repoAppl.Created, time.Second)
+	require.True(t, repoAppl.Birthday.IsZero())
+	require.Empty(t, repoAppl.PhoneNumber)
+	require.Empty(t, repoAppl.Nationality)
+	require.Empty(t, repoAppl.City)
+	require.Empty(t, repoAppl.Address)
+	require.Empty(t, repoAppl.FirstPageOfSurveyData)
+	require.Empty(t, repoAppl.Gender)
+
+	_, err = repo.GetToken(token.Value)
+	require.Equal(t, ErrNotFound, err)
+
+	_, err = repo.GetDocument(document.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	comments, err := repo.GetComments(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, comments, 1)
+	require.Equal(t, erasedContents, comments[0].Contents)
+
+	history, err := repo.GetStatusHistory(appl.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Empty(t, history[0].Reason)
+
+	// A request is only completed for its own user
+	other := ErasureRequest{SubjectID: admin.ID, RequestedBy: admin.ID, Requested: time.Now().UTC()}
+	require.NoError(t, repo.AddErasureRequest(&other))
+	other.SubjectID = user.ID
+	_, _, err = repo.EraseUser(&other)
+	require.Equal(t, ErrNotFound, err)
+
+	_, _, err = repo.EraseUser(&ErasureRequest{SubjectID: 1000000, ID: request.ID})
+	require.Equal(t, ErrNotFound, err)
+}
+
+func testRepositoryRetention(t *testing.T, repo DataRepository) {
+	admin := createTestUser(t, repo, RoleAdmin)
+	now := time.Now().UTC()
+
+	// Rejected a month ago, rejected today and never rejected
+	var apps []*Application
+	var documents []int
+	for i, rejected := range []time.Time{now.AddDate(0, -1, 0), now, {}} {
+		appl := createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+		if !rejected.IsZero() {
+			change, err := newStatusChange(appl, statusRejected, admin, "no documents", rejected)
+			require.NoError(t, err)
+			require.NoError(t, repo.TransitionApplication(change))
+		}
+
+		document := Document{ApplicationID: appl.ID, DocumentTypeID: 1, Filename: fmt.Sprintf("passport-%d.pdf", i), Created: now}
+		require.NoError(t, repo.StoreDocument(&document))
+
+		apps = append(apps, appl)
+		documents = append(documents, document.ID)
+	}
+
+	rejected, err := repo.GetRejectedDocuments(now.AddDate(0, 0, -7))
+	require.NoError(t, err)
+	require.Contains(t, documentIDs(rejected), documents[0])
+	require.NotContains(t, documentIDs(rejected), documents[1])
+	require.NotContains(t, documentIDs(rejected), documents[2])
+
+	rejected, err = repo.GetRejectedDocuments(now.Add(time.Second))
+	require.NoError(t, err)
+	require.Contains(t, documentIDs(rejected), documents[1])
+
+	// The applications were edited just now, the applicant without one signed up long ago
+	idle := User{EmailAddress: fmt.Sprintf("idle_%s@example.org", GetRandomString(8, "")), Password: "$2a$10$idle", Created: now.AddDate(-1, 0, 0), Role: RoleApplication}
+	require.NoError(t, repo.SetUser(&idle))
+
+	inactive, err := repo.GetInactiveApplicants(now.AddDate(0, -6, 0))
+	require.NoError(t, err)
+	require.Contains(t, inactive, idle.ID)
+	require.NotContains(t, inactive, apps[0].UserID)
+	require.NotContains(t, inactive, admin.ID)
+
+	inactive, err = repo.GetInactiveApplicants(now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Contains(t, inactive, apps[0].UserID)
+	require.NotContains(t, inactive, admin.ID)
+
+	// Erased applicants are not found again
+	request := ErasureRequest{SubjectID: idle.ID, RequestedBy: 0, Requested: now}
+	require.NoError(t, repo.AddErasureRequest(&request))
+	_, _, err = repo.EraseUser(&request)
+	require.NoError(t, err)
+
+	inactive, err = repo.GetInactiveApplicants(now.AddDate(0, -6, 0))
+	require.NoError(t, err)
+	require.NotContains(t, inactive, idle.ID)
+}
+
+func testRepositoryLoginFailures(t *testing.T, repo DataRepository) {
+	key := "test:" + GetRandomString(16, "")
+	start := time.Now().UTC().Truncate(time.Second)
+
+	_, err := repo.GetLoginFailures(key)
+	require.Equal(t, ErrNotFound, err)
+
+	for i := 1; i <= 3; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		failures, err := repo.AddLoginFailure(key, at, start)
+		require.NoError(t, err)
+		require.Equal(t, i, failures.Failures)
+
+		failures, err = repo.GetLoginFailures(key)
+		require.NoError(t, err)
+		require.Equal(t, key, failures.Key)
+		require.Equal(t, i, failures.Failures)
+		require.WithinDuration(t, at, failures.LastFailure, time.Millisecond)
+	}
+
+	// Failures before forgetBefore are forgotten
+	failures, err := repo.AddLoginFailure(key, start.Add(time.Hour), start.Add(30*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, failures.Failures)
+
+	require.NoError(t, repo.DelExpiredLoginFailures(start.Add(time.Hour)))
+	_, err = repo.GetLoginFailures(key)
+	require.NoError(t, err)
+	require.NoError(t, repo.DelExpiredLoginFailures(start.Add(time.Hour+time.Second)))
+	_, err = repo.GetLoginFailures(key)
+	require.Equal(t, ErrNotFound, err)
+
+	// An undone failure gives the last failure back
+	_, err = repo.AddLoginFailure(key, start, start)
+	require.NoError(t, err)
+	_, err = repo.AddLoginFailure(key, start.Add(time.Minute), start)
+	require.NoError(t, err)
+	require.NoError(t, repo.UndoLoginFailure(key, start.Add(time.Minute), start))
+	failures, err = repo.GetLoginFailures(key)
+	require.NoError(t, err)
+	require.Equal(t, 1, failures.Failures)
+	require.WithinDuration(t, start, failures.LastFailure, time.Millisecond)
+	require.NoError(t, repo.UndoLoginFailure(key, start.Add(2*time.Minute), start))
+	_, err = repo.GetLoginFailures(key)
+	require.Equal(t, ErrNotFound, err)
+	require.NoError(t, repo.UndoLoginFailure(key, start, start))
+
+	_, err = repo.AddLoginFailure(key, start, start)
+	require.NoError(t, err)
+	require.NoError(t, repo.DelLoginFailures(key))
+	_, err = repo.GetLoginFailures(key)
+	require.Equal(t, ErrNotFound, err)
+}
+
+func testRepositoryPasswordResets(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleApplication)
+	bcryptPassword, err := createHashedPassword("itsASin")
+	require.NoError(t, err)
+
+	token := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	require.NoError(t, repo.SetToken(&token))
+	refresh := RefreshToken{UserID: user.ID, Value: GetRandomString(16, ""), Family: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	require.NoError(t, repo.SetRefreshToken(&refresh))
+
+	_, err = repo.GetLastPasswordReset(user.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := PasswordReset{UserID: user.ID, Value: GetRandomString(32, ""), Created: now.Add(-time.Hour), Expires: now.Add(-time.Minute)}
+	require.NoError(t, repo.AddPasswordReset(&expired))
+	reset := PasswordReset{UserID: user.ID, Value: GetRandomString(32, ""), Created: now, Expires: now.Add(time.Hour)}
+	require.NoError(t, repo.AddPasswordReset(&reset))
+	require.True(t, reset.ID > 0)
+
+	last, err := repo.GetLastPasswordReset(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, reset.ID, last.ID)
+	require.Empty(t, last.Value)
+	require.WithinDuration(t, now, last.Created, time.Millisecond)
+
+	_, _, err = repo.ResetPassword(expired.Value, bcryptPassword)
+	require.Equal(t, ErrNotFound, err)
+	_, _, err = repo.ResetPassword(GetRandomString(32, ""), bcryptPassword)
+	require.Equal(t, ErrNotFound, err)
+
+	// The password has to be a bcrypt hash, the reset is kept if it is not
+	_, _, err = repo.ResetPassword(reset.Value, "itsASin")
+	require.Error(t, err)
+
+	used, families, err := repo.ResetPassword(reset.Value, bcryptPassword)
+	require.NoError(t, err)
+	require.Equal(t, reset.ID, used.ID)
+	require.Equal(t, user.ID, used.UserID)
+	require.Equal(t, []string{refresh.Family}, families)
+
+	changed, err := repo.GetUser(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, bcryptPassword, changed.Password)
+
+	// The tokens of the user are gone and the reset works only once
+	_, err = repo.GetToken(token.Value)
+	require.Equal(t, ErrNotFound, err)
+	_, err = repo.UseRefreshToken(refresh.Value)
+	require.Equal(t, ErrNotFound, err)
+	_, _, err = repo.ResetPassword(reset.Value, bcryptPassword)
+	require.Equal(t, ErrNotFound, err)
+	_, err = repo.GetLastPasswordReset(user.ID)
+	require.Equal(t, ErrNotFound, err)
+}
+
+func testRepositoryEmailVerifications(t *testing.T, repo DataRepository) {
+	user := createTestUser(t, repo, RoleApplication)
+	user.Verified = time.Time{}
+	require.NoError(t, repo.UpdateUser(user))
+
+	stored, err := repo.GetUser(user.ID)
+	require.NoError(t, err)
+	require.True(t, stored.Verified.IsZero())
+
+	_, err = repo.GetLastEmailVerification(user.ID)
+	require.Equal(t, ErrNotFound, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := EmailVerification{UserID: user.ID, Value: GetRandomString(32, ""), Created: now.Add(-time.Hour), Expires: now.Add(-time.Minute)}
+	require.NoError(t, repo.AddEmailVerification(&expired))
+	verification := EmailVerification{UserID: user.ID, Value: GetRandomString(32, ""), Created: now, Expires: now.Add(time.Hour)}
+	require.NoError(t, repo.AddEmailVerification(&verification))
+	require.True(t, verification.ID > 0)
+
+	last, err := repo.GetLastEmailVerification(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, verification.ID, last.ID)
+	require.Empty(t, last.Value)
+	require.WithinDuration(t, now, last.Created, time.Millisecond)
+
+	_, err = repo.VerifyEmail(expired.Value)
+	require.Equal(t, ErrNotFound, err)
+	_, err = repo.VerifyEmail(GetRandomString(32, ""))
+	require.Equal(t, ErrNotFound, err)
+
+	used, err := repo.VerifyEmail(verification.Value)
+	require.NoError(t, err)
+	require.Equal(t, verification.ID, used.ID)
+	require.Equal(t, user.ID, used.UserID)
+
+	verified, err := repo.GetUser(user.ID)
+	require.NoError(t, err)
+	require.False(t, verified.Verified.IsZero())
+	byEmail, err := repo.GetUserByEmail(user.EmailAddress)
+	require.NoError(t, err)
+	require.Equal(t, verified.Verified, byEmail.Verified)
+
+	// A verification works once and the others of the user are gone
+	_, err = repo.VerifyEmail(verification.Value)
+	require.Equal(t, ErrNotFound, err)
+	_, err = repo.GetLastEmailVerification(user.ID)
+	require.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// retentionPolicy says how long personal data is kept.  Rules that are 0
+// keep the data forever.
+type retentionPolicy struct {
+	// RejectedDocumentDays is how long documents are kept after their
+	// application was rejected
+	RejectedDocumentDays int
+
+	// InactiveApplicantMonths is how long applicants are kept after their
+	// application last changed, or they signed up if they have none.  They
+	// are erased like on request.
+	InactiveApplicantMonths int
+
+	// Interval is the time between two runs
+	Interval time.Duration
+
+	// DryRun only reports what would be purged
+	DryRun bool
+}
+
+// enabled returns true if any rule is set
+func (p retentionPolicy) enabled() bool {
+	return p.RejectedDocumentDays > 0 || p.InactiveApplicantMonths > 0
+}
+
+// retentionReport lists what a run purged, or would have purged in a dry run
+type retentionReport struct {
+	Documents  []*Document
+	Applicants []int
+	Errors     int
+}
+
+// Metrics on what the retention policy purged, in the default registry of
+// go-metrics.  The due gauges count what the last run found, in dry runs too.
+var (
+	retentionRuns             = metrics.GetOrRegisterCounter("retention.runs", metrics.DefaultRegistry)
+	retentionErrors           = metrics.GetOrRegisterCounter("retention.errors", metrics.DefaultRegistry)
+	retentionDocumentsPurged  = metrics.GetOrRegisterCounter("retention.documents.purged", metrics.DefaultRegistry)
+	retentionApplicantsErased = metrics.GetOrRegisterCounter("retention.applicants.erased", metrics.DefaultRegistry)
+	retentionDocumentsDue     = metrics.GetOrRegisterGauge("retention.documents.due", metrics.DefaultRegistry)
+	retentionApplicantsDue    = metrics.GetOrRegisterGauge("retention.applicants.due", metrics.DefaultRegistry)
+	retentionLastRun          = metrics.GetOrRegisterGauge("retention.last_run", metrics.DefaultRegistry)
+)
+
+// defaultRetentionInterval is the time between two runs unless
+// KIRON_RETENTION_INTERVAL says otherwise
+const defaultRetentionInterval = 24 * time.Hour
+
+// parseRetentionPolicy reads the policy from the environment:
+//
+//	KIRON_RETAIN_REJECTED_DOCUMENTS_DAYS    days to keep documents of rejected applications
+//	KIRON_RETAIN_INACTIVE_APPLICANTS_MONTHS months to keep inactive applicants
+//	KIRON_RETENTION_INTERVAL                time between runs, default 24h
+//	KIRON_RETENTION_DRY_RUN                 "true" to only report
+func parseRetentionPolicy() (retentionPolicy, error) {
+	policy := retentionPolicy{Interval: defaultRetentionInterval}
+
+	rules := []struct {
+		name  string
+		value *int
+	}{
+		{"KIRON_RETAIN_REJECTED_DOCUMENTS_DAYS", &policy.RejectedDocumentDays},
+		{"KIRON_RETAIN_INACTIVE_APPLICANTS_MONTHS", &policy.InactiveApplicantMonths},
+	}
+
+	for _, r := range rules {
+		if os.Getenv(r.name) == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(os.Getenv(r.name))
+		if err != nil || value <= 0 {
+			return policy, fmt.Errorf("%s has to be a positive number", r.name)
+		}
+		*r.value = value
+	}
+
+	if interval := os.Getenv("KIRON_RETENTION_INTERVAL"); interval != "" {
+		value, err := time.ParseDuration(interval)
+		if err != nil || value < time.Minute {
+			return policy, errors.New("KIRON_RETENTION_INTERVAL has to be a duration of at least a minute")
+		}
+		policy.Interval = value
+	}
+
+	if dryRun := os.Getenv("KIRON_RETENTION_DRY_RUN"); dryRun != "" {
+		value, err := strconv.ParseBool(dryRun)
+		if err != nil {
+			return policy, errors.New("KIRON_RETENTION_DRY_RUN has to be true or false")
+		}
+		policy.DryRun = value
+	}
+
+	return policy, nil
+}
+
+// StartRetention applies the retention policy of the environment in the
+// background, right away and then every interval.  Nothing runs if no rule
+// is set.
+func StartRetention() (*Task, error) {
+	policy, err := parseRetentionPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if !policy.enabled() {
+		log.Println("No retention rules set, personal data is kept until it is erased")
+		return nil, nil
+	}
+
+	return startTask("retention policy", policy.Interval, func(now time.Time) {
+		_, err := policy.apply(repository, blobs, now)
+		if err != nil {
+			log.Printf("Retention run failed: %v", err)
+			retentionErrors.Inc(1)
+		}
+	}), nil
+}
+
+// apply purges what the rules no longer allow to keep at now.  A failure to
+// purge one record is logged and counted, the others are still purged.
+func (p retentionPolicy) apply(repo DataRepository, store BlobStore, now time.Time) (*retentionReport, error) {
+	report := retentionReport{Documents: []*Document{}, Applicants: []int{}}
+
+	if p.RejectedDocumentDays > 0 {
+		documents, err := repo.GetRejectedDocuments(now.AddDate(0, 0, -p.RejectedDocumentDays))
+		if err != nil {
+			return nil, err
+		}
+		report.Documents = documents
+	}
+
+	if p.InactiveApplicantMonths > 0 {
+		applicants, err := repo.GetInactiveApplicants(now.AddDate(0, -p.InactiveApplicantMonths, 0))
+		if err != nil {
+			return nil, err
+		}
+		report.Applicants = applicants
+	}
+
+	retentionRuns.Inc(1)
+	retentionLastRun.Update(now.Unix())
+	retentionDocumentsDue.Update(int64(len(report.Documents)))
+	retentionApplicantsDue.Update(int64(len(report.Applicants)))
+
+	description := "purged"
+	if p.DryRun {
+		description = "would purge"
+	}
+
+	for _, document := range report.Documents {
+		log.Printf("Retention %s document %d of application %d", description, document.ID, document.ApplicationID)
+	}
+	for _, userID := range report.Applicants {
+		log.Printf("Retention %s inactive applicant %d", description, userID)
+	}
+
+	if p.DryRun {
+		return &report, nil
+	}
+
+	for _, document := range report.Documents {
+		err := purgeDocument(repo, store, document)
+		if err != nil {
+			log.Printf("Unable to purge document %d: %v", document.ID, err)
+			report.Errors++
+			continue
+		}
+		retentionDocumentsPurged.Inc(1)
+	}
+
+	for _, userID := range report.Applicants {
+		_, err := erase(repo, store, userID, 0, now)
+		if err != nil {
+			log.Printf("Unable to erase inactive applicant %d: %v", userID, err)
+			report.Errors++
+			continue
+		}
+		retentionApplicantsErased.Inc(1)
+	}
+
+	retentionErrors.Inc(int64(report.Errors))
+	log.Printf("Retention %s %d documents and %d applicants, %d failed", description, len(report.Documents), len(report.Applicants), report.Errors)
+
+	return &report, nil
+}
+
+// purgeDocument deletes the document and then its contents.  Contents left
+// behind are unreachable.
+func purgeDocument(repo DataRepository, store BlobStore, document *Document) error {
+	err := repo.DeleteDocument(document.ID)
+	if err != nil {
+		return err
+	}
+
+	if document.StorageKey == "" {
+		return nil
+	}
+
+	if err := store.Delete(document.StorageKey); err != nil {
+		log.Printf("Unable to delete blob %s of purged document %d: %v", document.StorageKey, document.ID, err)
+	}
+
+	return nil
+}
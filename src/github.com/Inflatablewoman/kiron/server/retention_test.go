@@ -0,0 +1,104 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := parseRetentionPolicy()
+	require.NoError(t, err)
+	require.False(t, policy.enabled())
+	require.Equal(t, defaultRetentionInterval, policy.Interval)
+
+	t.Setenv("KIRON_RETAIN_REJECTED_DOCUMENTS_DAYS", "30")
+	t.Setenv("KIRON_RETAIN_INACTIVE_APPLICANTS_MONTHS", "24")
+	t.Setenv("KIRON_RETENTION_INTERVAL", "1h")
+	t.Setenv("KIRON_RETENTION_DRY_RUN", "true")
+
+	policy, err = parseRetentionPolicy()
+	require.NoError(t, err)
+	require.Equal(t, retentionPolicy{RejectedDocumentDays: 30, InactiveApplicantMonths: 24, Interval: time.Hour, DryRun: true}, policy)
+
+	for name, value := range map[string]string{
+		"KIRON_RETAIN_REJECTED_DOCUMENTS_DAYS": "-1",
+		"KIRON_RETENTION_INTERVAL":             "1s",
+		"KIRON_RETENTION_DRY_RUN":              "maybe",
+	} {
+		t.Setenv(name, value)
+		_, err = parseRetentionPolicy()
+		require.Error(t, err, name)
+		t.Setenv(name, "")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	repo, err := getMemoryDB()
+	require.NoError(t, err)
+	store := newMemoryBlobStore()
+
+	now := time.Now().UTC()
+	admin := createTestUser(t, repo, RoleAdmin)
+
+	// Rejected 40 days ago, with its contents in the blobs
+	rejected := createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+	change, err := newStatusChange(rejected, statusRejected, admin, "no documents", now.AddDate(0, 0, -40))
+	require.NoError(t, err)
+	require.NoError(t, repo.TransitionApplication(change))
+
+	passport := Document{ApplicationID: rejected.ID, DocumentTypeID: 1, StorageKey: "rejected/passport", Created: now}
+	require.NoError(t, store.Put(passport.StorageKey, strings.NewReader("%PDF-1.4 passport"), 17))
+	require.NoError(t, repo.StoreDocument(&passport))
+
+	// Still being reviewed
+	active := createTestApplication(t, repo, createTestUser(t, repo, RoleApplication).ID)
+	cv := Document{ApplicationID: active.ID, DocumentTypeID: 1, Created: now}
+	require.NoError(t, repo.StoreDocument(&cv))
+
+	// Signed up three years ago and never applied
+	idle := User{EmailAddress: "idle@example.org", Password: "$2a$10$idle", Created: now.AddDate(-3, 0, 0), Role: RoleApplication}
+	require.NoError(t, repo.SetUser(&idle))
+
+	policy := retentionPolicy{RejectedDocumentDays: 30, InactiveApplicantMonths: 24, DryRun: true}
+	purged := retentionDocumentsPurged.Count()
+	erased := retentionApplicantsErased.Count()
+
+	// A dry run only reports
+	report, err := policy.apply(repo, store, now)
+	require.NoError(t, err)
+	require.Equal(t, []int{passport.ID}, documentIDs(report.Documents))
+	require.Equal(t, []int{idle.ID}, report.Applicants)
+	require.Equal(t, int64(1), retentionDocumentsDue.Value())
+	require.Equal(t, purged, retentionDocumentsPurged.Count())
+
+	_, err = repo.GetDocument(passport.ID)
+	require.NoError(t, err)
+
+	policy.DryRun = false
+	report, err = policy.apply(repo, store, now)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Errors)
+	require.Equal(t, purged+1, retentionDocumentsPurged.Count())
+	require.Equal(t, erased+1, retentionApplicantsErased.Count())
+
+	_, err = repo.GetDocument(passport.ID)
+	require.Equal(t, ErrNotFound, err)
+	_, err = store.Get(passport.StorageKey)
+	require.Error(t, err)
+
+	_, err = repo.GetDocument(cv.ID)
+	require.NoError(t, err)
+
+	user, err := repo.GetUser(idle.ID)
+	require.NoError(t, err)
+	require.Equal(t, erasedEmail(idle.ID), user.EmailAddress)
+
+	// Nothing is left to purge
+	report, err = policy.apply(repo, store, now)
+	require.NoError(t, err)
+	require.Empty(t, report.Documents)
+	require.Empty(t, report.Applicants)
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hashes of requests to S3
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+// s3BlobStore keeps the blobs in a bucket of an S3 compatible service.  It
+// uses path style URLs, endpoint/bucket/key, which AWS and MinIO both accept.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newS3BlobStoreFromEnv configures the store with KIRON_S3_ENDPOINT,
+// KIRON_S3_REGION, KIRON_S3_BUCKET, KIRON_S3_ACCESS_KEY and KIRON_S3_SECRET_KEY
+func newS3BlobStoreFromEnv() (*s3BlobStore, error) {
+	region := os.Getenv("KIRON_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return newS3BlobStore(os.Getenv("KIRON_S3_ENDPOINT"), region, os.Getenv("KIRON_S3_BUCKET"), os.Getenv("KIRON_S3_ACCESS_KEY"), os.Getenv("KIRON_S3_SECRET_KEY"))
+}
+
+func newS3BlobStore(endpoint, region, bucket, accessKey, secretKey string) (*s3BlobStore, error) {
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3 blob store needs an endpoint, a bucket and credentials")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+	}
+
+	s := s3BlobStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}
+	return &s, nil
+}
+
+// request returns a signed request for the object stored under key
+func (s *s3BlobStore) request(method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	if !validBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+
+	r, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	signV4(r, payloadHash, s.accessKey, s.secretKey, s.region, "s3", s.now())
+
+	return r, nil
+}
+
+// do sends the request and turns unexpected answers into errors
+func (s *s3BlobStore) do(r *http.Request, expected ...int) (*http.Response, error) {
+	response, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expected {
+		if response.StatusCode == status {
+			return response, nil
+		}
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %s failed with %s: %s", r.Method, r.URL.Path, response.Status, message)
+}
+
+func (s *s3BlobStore) Put(key string, contents io.Reader, size int64) error {
+	// The contents are streamed, so the payload cannot be part of the signature
+	r, err := s.request("PUT", key, contents, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	r.ContentLength = size
+	if size == 0 {
+		r.Body = http.NoBody
+	}
+
+	response, err := s.do(r, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+func (s *s3BlobStore) Get(key string) (Blob, error) {
+	r, err := s.request("GET", key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.do(r, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.ContentLength < 0 {
+		response.Body.Close()
+		return nil, fmt.Errorf("S3 did not send the size of %s", key)
+	}
+
+	return &s3Blob{store: s, key: key, size: response.ContentLength, body: response.Body}, nil
+}
+
+// s3Blob reads an object.  If it is read after a seek the rest of the object
+// is requested with a Range header, so only the parts read are transferred.
+type s3Blob struct {
+	store      *s3BlobStore
+	key        string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.body != nil && b.bodyOffset != b.offset {
+		b.Close()
+	}
+
+	if b.body == nil {
+		r, err := b.store.request("GET", b.key, nil, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+		// The Range header is signed too
+		signV4(r, emptyPayloadHash, b.store.accessKey, b.store.secretKey, b.store.region, "s3", b.store.now())
+
+		response, err := b.store.do(r, http.StatusPartialContent)
+		if err != nil {
+			return 0, err
+		}
+		b.body = response.Body
+		b.bodyOffset = b.offset
+	}
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	b.bodyOffset += int64(n)
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("Seek before the start of the blob")
+	}
+
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	r, err := s.request("DELETE", key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.do(r, http.StatusNoContent, http.StatusOK)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+// signV4 adds an AWS signature version 4 to the request, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signV4(r *http.Request, payloadHash, accessKey, secretKey, region, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	r.Header.Set("x-amz-date", amzDate)
+	r.Header.Set("x-amz-content-sha256", payloadHash)
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	// Sign the host, the content headers and every x-amz header
+	headers := map[string]string{"host": host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted and encoded as AWS expects
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent encodes everything but the unreserved characters of
+// RFC 3986.  Slashes are kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scan states of a document.  Only clean documents can be downloaded.
+const (
+	scanPending     = "pending"
+	scanClean       = "clean"
+	scanQuarantined = "quarantined"
+)
+
+// Scanner checks the contents of an uploaded document
+type Scanner interface {
+	// Scan returns why the contents are refused or "" if they are fine.  An
+	// error means the contents could not be checked.
+	Scan(contents io.Reader) (string, error)
+}
+
+// documentScanner checks every upload.  InitBlobStore adds ClamAV if it is
+// configured.
+var documentScanner = scanPipeline{magicScanner{}}
+
+// initScanner adds a ClamAV scanner to the pipeline if KIRON_CLAMD_ADDRESS
+// is set
+func initScanner() error {
+	address := os.Getenv("KIRON_CLAMD_ADDRESS")
+	if address == "" {
+		log.Println("KIRON_CLAMD_ADDRESS not set, uploads are not scanned for viruses")
+		documentScanner = scanPipeline{magicScanner{}}
+		return nil
+	}
+
+	clamd, err := newClamdScanner(address)
+	if err != nil {
+		return err
+	}
+
+	documentScanner = scanPipeline{magicScanner{}, clamd}
+	return nil
+}
+
+// scanPipeline runs the scanners one after the other until one of them
+// refuses the contents
+type scanPipeline []Scanner
+
+func (p scanPipeline) scan(contents io.ReadSeeker) (string, error) {
+	for _, scanner := range p {
+		_, err := contents.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+
+		reason, err := scanner.Scan(contents)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	return "", nil
+}
+
+// checkDocument runs the pipeline over the stored contents of the document and
+// records the outcome.  If scanning fails the document stays pending.
+func checkDocument(repo DataRepository, store BlobStore, pipeline scanPipeline, document *Document) error {
+	store, err := documentStore(store, masterKeys, document)
+	if err != nil {
+		return err
+	}
+
+	contents, err := store.Get(document.StorageKey)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	reason, err := pipeline.scan(contents)
+	if err != nil {
+		return fmt.Errorf("Unable to scan document %d: %v", document.ID, err)
+	}
+
+	status := scanClean
+	if reason != "" {
+		status = scanQuarantined
+		log.Printf("Document %d quarantined: %s", document.ID, reason)
+	}
+
+	err = repo.SetDocumentScan(document.ID, status, reason)
+	if err != nil {
+		return err
+	}
+
+	document.ScanStatus = status
+	document.ScanResult = reason
+	return nil
+}
+
+// scanPendingDocuments scans the documents that are still pending, e.g.
+// because the scanner could not be reached during the upload
+func scanPendingDocuments(repo DataRepository, store BlobStore, pipeline scanPipeline) (int, error) {
+	documents, err := repo.GetPendingDocuments()
+	if err != nil {
+		return 0, err
+	}
+
+	scanned := 0
+	for _, document := range documents {
+		err := checkDocument(repo, store, pipeline, document)
+		if err != nil {
+			return scanned, err
+		}
+		scanned++
+	}
+
+	return scanned, nil
+}
+
+// File signatures of the types applicants may upload
+var allowedMagic = [][]byte{
+	[]byte("%PDF-"),
+	{0xff, 0xd8, 0xff},
+	[]byte("\x89PNG\r\n\x1a\n"),
+}
+
+// magicScanner only admits PDF, JPEG and PNG files, whatever their name or
+// the content type the client claims
+type magicScanner struct{}
+
+func (magicScanner) Scan(contents io.Reader) (string, error) {
+	head := make([]byte, 8)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	for _, allowed := range allowedMagic {
+		if bytes.HasPrefix(head, allowed) {
+			return "", nil
+		}
+	}
+
+	return "File type not allowed, only PDF, JPEG and PNG", nil
+}
+
+// Size of the chunks sent to clamd and how long a scan may take
+const (
+	clamdChunkSize = 32 * 1024
+	clamdTimeout   = 2 * time.Minute
+)
+
+// clamdScanner sends the contents to a ClamAV daemon with the INSTREAM
+// command, see clamd(8)
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// newClamdScanner connects to address, either host:port, tcp://host:port or
+// the path of a unix socket
+func newClamdScanner(address string) (*clamdScanner, error) {
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		return &clamdScanner{network: "tcp", address: strings.TrimPrefix(address, "tcp://"), timeout: clamdTimeout}, nil
+	case strings.HasPrefix(address, "unix://"):
+		return &clamdScanner{network: "unix", address: strings.TrimPrefix(address, "unix://"), timeout: clamdTimeout}, nil
+	case strings.HasPrefix(address, "/"):
+		return &clamdScanner{network: "unix", address: address, timeout: clamdTimeout}, nil
+	}
+
+	_, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid clamd address %q", address)
+	}
+
+	return &clamdScanner{network: "tcp", address: address, timeout: clamdTimeout}, nil
+}
+
+func (s *clamdScanner) Scan(contents io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	err = s.stream(conn, contents)
+	if err != nil {
+		// clamd answers and hangs up when the stream is too large, so
+		// its reply is more useful than a broken pipe
+		reply, rerr := bufio.NewReader(conn).ReadString(0)
+		if rerr != nil && reply == "" {
+			return "", err
+		}
+		return parseClamdReply(reply)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+
+	return parseClamdReply(reply)
+}
+
+// stream sends the INSTREAM command with the contents as length prefixed
+// chunks, terminated by an empty chunk
+func (s *clamdScanner) stream(w io.Writer, contents io.Reader) error {
+	_, err := io.WriteString(w, "zINSTREAM\x00")
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := contents.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			_, err := w.Write(chunk[:4+n])
+			if err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+
+	_, err = w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply turns "stream: OK", "stream: <virus> FOUND" and
+// "<message> ERROR" into the result of Scan
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+
+	switch {
+	case reply == "stream: OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return "Virus found: " + strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	case strings.HasPrefix(reply, "INSTREAM size limit exceeded"):
+		// Whatever cannot be scanned is not handed out
+		return "Too large to scan", nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", errors.New("clamd: " + strings.TrimSuffix(reply, " ERROR"))
+	}
+
+	return "", fmt.Errorf("Unexpected reply from clamd: %q", reply)
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is part of the EICAR test file every virus scanner knows
+const eicar = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+// fakeClamd speaks enough of the clamd protocol to answer INSTREAM commands.
+// It finds the EICAR test file and refuses streams above maxStream bytes.
+type fakeClamd struct {
+	listener  net.Listener
+	maxStream int
+}
+
+func newFakeClamd(t *testing.T, maxStream int) *fakeClamd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clamd := &fakeClamd{listener: listener, maxStream: maxStream}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.serve(conn)
+		}
+	}()
+
+	return clamd
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := c.reply(r)
+	io.WriteString(conn, reply+"\x00")
+
+	// Read what is left so the client gets the reply before the connection is reset
+	io.Copy(ioutil.Discard, r)
+}
+
+func (c *fakeClamd) reply(r *bufio.Reader) string {
+	command, err := r.ReadString(0)
+	if err != nil || command != "zINSTREAM\x00" {
+		return "UNKNOWN COMMAND"
+	}
+
+	var stream []byte
+	for {
+		var size uint32
+		err := binary.Read(r, binary.BigEndian, &size)
+		if err != nil {
+			return "Read error ERROR"
+		}
+		if size == 0 {
+			break
+		}
+		if len(stream)+int(size) > c.maxStream {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(r, chunk)
+		if err != nil {
+			return "Read error ERROR"
+		}
+		stream = append(stream, chunk...)
+	}
+
+	if bytes.Contains(stream, []byte(eicar)) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func (c *fakeClamd) Close() {
+	c.listener.Close()
+}
+
+func TestMagicScanner(t *testing.T) {
+	for contents, allowed := range map[string]bool{
+		"%PDF-1.4 passport":                   true,
+		"\xff\xd8\xff\xe0\x00\x10JFIF":        true,
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR": true,
+		"":                                    false,
+		"%PD":                                 false,
+		"passport":                            false,
+		"<html><script>":                      false,
+		"MZ\x90\x00":                          false,
+	} {
+		reason, err := magicScanner{}.Scan(strings.NewReader(contents))
+		require.NoError(t, err)
+		require.Equal(t, allowed, reason == "", "%q", contents)
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	clamd := newFakeClamd(t, 1024*1024)
+	defer clamd.Close()
+
+	scanner, err := newClamdScanner(clamd.listener.Addr().String())
+	require.NoError(t, err)
+
+	reason, err := scanner.Scan(strings.NewReader("%PDF-1.4 passport"))
+	require.NoError(t, err)
+	require.Empty(t, reason)
+
+	// Larger than a chunk
+	reason, err = scanner.Scan(io.MultiReader(bytes.NewReader(make([]byte, 3*clamdChunkSize)), strings.NewReader(eicar)))
+	require.NoError(t, err)
+	require.Equal(t, "Virus found: Eicar-Test-Signature", reason)
+
+	reason, err = scanner.Scan(bytes.NewReader(make([]byte, 2*1024*1024)))
+	require.NoError(t, err)
+	require.Equal(t, "Too large to scan", reason)
+
+	// Nobody listening
+	clamd.Close()
+	_, err = scanner.Scan(strings.NewReader("%PDF-1.4 passport"))
+	require.Error(t, err)
+}
+
+func TestNewClamdScanner(t *testing.T) {
+	for address, expected := range map[string]clamdScanner{
+		"localhost:3310":            {network: "tcp", address: "localhost:3310"},
+		"tcp://clamav:3310":         {network: "tcp", address: "clamav:3310"},
+		"unix:///run/clamd.ctl":     {network: "unix", address: "/run/clamd.ctl"},
+		"/var/run/clamav/clamd.ctl": {network: "unix", address: "/var/run/clamav/clamd.ctl"},
+	} {
+		scanner, err := newClamdScanner(address)
+		require.NoError(t, err, address)
+		require.Equal(t, expected.network, scanner.network, address)
+		require.Equal(t, expected.address, scanner.address, address)
+	}
+
+	_, err := newClamdScanner("clamav")
+	require.Error(t, err)
+}
+
+func TestParseClamdReply(t *testing.T) {
+	reason, err := parseClamdReply("stream: OK\x00")
+	require.NoError(t, err)
+	require.Empty(t, reason)
+
+	_, err = parseClamdReply("Can't allocate memory ERROR\x00")
+	require.EqualError(t, err, "clamd: Can't allocate memory")
+
+	_, err = parseClamdReply("PONG")
+	require.Error(t, err)
+}
+
+func TestDocumentScanning(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	clamd := newFakeClamd(t, 1024*1024)
+	defer clamd.Close()
+	scanner, err := newClamdScanner(clamd.listener.Addr().String())
+	require.NoError(t, err)
+
+	defer func(pipeline scanPipeline) {
+		documentScanner = pipeline
+	}(documentScanner)
+	documentScanner = scanPipeline{magicScanner{}, scanner}
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	tokenValue := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+	documentsURL := fmt.Sprintf("%s/api/v1/users/%d/application/%d/documents", server.URL, applicant.ID, appl.ID)
+
+	download := func(documentID int) int {
+		response := doTestRequest(t, "GET", fmt.Sprintf("%s/%d", documentsURL, documentID), tokenValue, "")
+		return response.StatusCode
+	}
+
+	uploads := []struct {
+		contents string
+		status   string
+		download int
+	}{
+		{"%PDF-1.4 passport", scanClean, http.StatusOK},
+		{"#!/bin/sh passport", scanQuarantined, http.StatusConflict},
+		{"%PDF-1.4 " + eicar, scanQuarantined, http.StatusConflict},
+	}
+
+	for i, upload := range uploads {
+		response := putTestDocument(t, documentsURL, tokenValue, strings.NewReader(upload.contents))
+		require.Equal(t, http.StatusCreated, response.StatusCode)
+		require.Equal(t, upload.status, response.Header.Get("X-Scan-Status"), upload.contents)
+
+		// The memory repository numbers documents from 1
+		document, err := repo.GetDocument(i + 1)
+		require.NoError(t, err)
+		require.Equal(t, upload.status, document.ScanStatus)
+		require.Equal(t, upload.download, download(document.ID))
+	}
+
+	document, err := repo.GetDocument(3)
+	require.NoError(t, err)
+	require.Equal(t, "Virus found: Eicar-Test-Signature", document.ScanResult)
+
+	// Documents stay pending while clamd is down and cannot be downloaded
+	clamd.Close()
+
+	response := putTestDocument(t, documentsURL, tokenValue, strings.NewReader("%PDF-1.4 cv"))
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	require.Equal(t, scanPending, response.Header.Get("X-Scan-Status"))
+	require.Equal(t, http.StatusConflict, download(4))
+
+	// Until they are scanned again
+	clamd = newFakeClamd(t, 1024*1024)
+	defer clamd.Close()
+	scanner, err = newClamdScanner(clamd.listener.Addr().String())
+	require.NoError(t, err)
+
+	scanned, err := scanPendingDocuments(repo, blobs, scanPipeline{magicScanner{}, scanner})
+	require.NoError(t, err)
+	require.Equal(t, 1, scanned)
+	require.Equal(t, http.StatusOK, download(4))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Markers around the matched words of a search snippet
+const (
+	snippetStart = "<mark>"
+	snippetStop  = "</mark>"
+)
+
+// Search weights as used by ts_rank for the labels A, B and C
+const (
+	searchWeightName    = 1.0
+	searchWeightDetails = 0.4
+	searchWeightComment = 0.2
+)
+
+// Number of search results
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchField is some text of an application and how much a match in it counts
+type searchField struct {
+	Text   string
+	Weight float64
+}
+
+// searchTerms splits text into the lower case words a search looks for.  Every
+// term matches the words it is a prefix of.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tsQuery returns a postgres tsquery matching documents that contain a word
+// starting with every term.  The terms only contain letters and digits.
+func tsQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term + ":*"
+	}
+	return strings.Join(parts, " & ")
+}
+
+// rankSearch returns the rank of the fields for the terms.  It is 0 unless
+// every term is found in one of the fields.
+func rankSearch(fields []searchField, terms []string) float64 {
+	var rank float64
+	for _, term := range terms {
+		found := false
+		for _, field := range fields {
+			for _, word := range searchTerms(field.Text) {
+				if strings.HasPrefix(word, term) {
+					rank += field.Weight
+					found = true
+				}
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return rank
+}
+
+// highlight marks the words of text that start with one of the terms.  The
+// text is escaped, so the snippet is HTML even if applicants put markup in
+// their names or comments.
+func highlight(text string, terms []string) string {
+	var (
+		snippet strings.Builder
+		word    []rune
+	)
+
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		lower := strings.ToLower(string(word))
+		for _, term := range terms {
+			if strings.HasPrefix(lower, term) {
+				snippet.WriteString(snippetStart + string(word) + snippetStop)
+				word = word[:0]
+				return
+			}
+		}
+		snippet.WriteString(string(word))
+		word = word[:0]
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		snippet.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+
+	return snippet.String()
+}
+
+// searchNationality returns the nationality the query looks for, or "" if it
+// may not search nationalities
+func searchNationality(query SearchQuery) string {
+	if !query.Private {
+		return ""
+	}
+	return normalizeNationality(query.Text)
+}
+
+// markNationality puts the nationality an application was found by in front
+// of its snippet, the nationality is not part of the searched text
+func markNationality(nationality, snippet string) string {
+	return snippetStart + html.EscapeString(nationality) + snippetStop + " " + snippet
+}
+
+// htmlEscapeSQL returns a postgres expression that escapes the text of expr
+// like html.EscapeString
+func htmlEscapeSQL(expr string) string {
+	for _, r := range []struct{ from, to string }{
+		{"&", "&amp;"},
+		{"'", "&#39;"},
+		{"<", "&lt;"},
+		{">", "&gt;"},
+		{`"`, "&#34;"},
+	} {
+		expr = "replace(" + expr + ", '" + strings.Replace(r.from, "'", "''", -1) + "', '" + r.to + "')"
+	}
+	return expr
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchTerms(t *testing.T) {
+	require.Equal(t, []string{"mo", "aleppo"}, searchTerms("Mo, ALEPPO!"))
+	require.Equal(t, []string{"mo", "example", "org"}, searchTerms("mo@example.org"))
+	require.Empty(t, searchTerms(" ':*&|() "))
+
+	require.Equal(t, "mo:* & aleppo:*", tsQuery([]string{"mo", "aleppo"}))
+}
+
+func TestHighlight(t *testing.T) {
+	require.Equal(t, "<mark>Mohammed</mark> from <mark>Aleppo</mark>, mo@x.org", highlight("Mohammed from Aleppo, mo@x.org", []string{"moh", "al"}))
+	require.Equal(t, "nothing", highlight("nothing", []string{"x"}))
+
+	// Markup of applicants is escaped
+	require.Equal(t, "&lt;<mark>script</mark>&gt;alert(&#39;x&#39;)&lt;/<mark>script</mark>&gt; &amp; &#34;co&#34;",
+		highlight(`<script>alert('x')</script> & "co"`, []string{"script"}))
+
+	require.Equal(t, `replace(replace(replace(replace(replace(s.text, '&', '&amp;'), '''', '&#39;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;')`, htmlEscapeSQL("s.text"))
+}
+
+func TestSearchApplications(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	helperToken := loginTestUser(t, repo, createTestUser(t, repo, RoleLimitedHelper))
+	trustedToken := loginTestUser(t, repo, createTestUser(t, repo, RoleTrustedHelper))
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	appl := createTestApplication(t, repo, applicant.ID)
+
+	search := func(token, text string) []RestSearchResult {
+		searchURL := fmt.Sprintf("%s/api/v1/search?q=%s", server.URL, url.QueryEscape(text))
+
+		request, err := http.NewRequest("GET", searchURL, nil)
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		var results []RestSearchResult
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+		return results
+	}
+
+	// createTestApplication lives in atlantis
+	results := search(trustedToken, "tennant atl")
+	require.Len(t, results, 1)
+	require.Equal(t, appl.ID, results[0].Application.ID)
+	require.Equal(t, "atlantis", results[0].Application.City)
+	require.Contains(t, results[0].Snippet, snippetStart+"atlantis"+snippetStop)
+
+	// Limited helpers cannot search by city and never see it
+	require.Empty(t, search(helperToken, "tennant atl"))
+
+	results = search(helperToken, "tennant")
+	require.Len(t, results, 1)
+	require.Empty(t, results[0].Application.City)
+	require.Empty(t, results[0].Application.Nationality)
+	require.NotContains(t, results[0].Snippet, "atlantis")
+	require.NotContains(t, results[0].Snippet, "marsian")
+
+	for _, query := range []string{"", "q=", "q=***", "q=neil&limit=0"} {
+		response := doTestRequest(t, "GET", server.URL+"/api/v1/search?"+query, helperToken, "")
+		require.Equal(t, http.StatusBadRequest, response.StatusCode, query)
+	}
+}
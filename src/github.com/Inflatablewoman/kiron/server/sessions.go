@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Lifetimes of the tokens.  Every refresh issues a new refresh token, so a
+// session lasts as long as it is refreshed within refreshTokenLifetime.  Set
+// them with KIRON_ACCESS_TOKEN_LIFETIME and KIRON_REFRESH_TOKEN_LIFETIME.
+var (
+	accessTokenLifetime  = time.Hour
+	refreshTokenLifetime = 7 * 24 * time.Hour
+)
+
+// tokenKey keys the hashes that the repositories keep instead of the token
+// values, so the database alone does not let anyone log in.  The links of
+// password reset and verification mails and the failed login counters are
+// keyed with it too.  Changing it logs everybody out and breaks those links.
+var tokenKey []byte
+
+// ErrRefreshTokenReused is returned for a refresh token that has been
+// exchanged before.  Somebody else may have it, its family is revoked.
+var ErrRefreshTokenReused = errors.New("Refresh token has been used before")
+
+// InitSessions reads the token key and lifetimes from the environment
+func InitSessions() error {
+	err := initTokenKey()
+	if err != nil {
+		return err
+	}
+
+	lifetimes := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"KIRON_ACCESS_TOKEN_LIFETIME", &accessTokenLifetime},
+		{"KIRON_REFRESH_TOKEN_LIFETIME", &refreshTokenLifetime},
+	}
+
+	for _, l := range lifetimes {
+		if os.Getenv(l.name) == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(os.Getenv(l.name))
+		if err != nil || value < time.Minute {
+			return fmt.Errorf("%s has to be a duration of at least a minute", l.name)
+		}
+		*l.value = value
+	}
+
+	if refreshTokenLifetime <= accessTokenLifetime {
+		return errors.New("KIRON_REFRESH_TOKEN_LIFETIME has to be longer than KIRON_ACCESS_TOKEN_LIFETIME")
+	}
+
+	return initSigningKeys()
+}
+
+// initTokenKey reads KIRON_TOKEN_KEY, 32 random bytes base64 encoded.  It is
+// required, a made up key would not survive a restart and differ between the
+// processes of kiron.
+func initTokenKey() error {
+	config := os.Getenv("KIRON_TOKEN_KEY")
+	if config == "" {
+		return fmt.Errorf("KIRON_TOKEN_KEY has to be set to %d random bytes, base64 encoded", dataKeySize)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config)
+	if err != nil || len(key) != dataKeySize {
+		return fmt.Errorf("KIRON_TOKEN_KEY has to be %d bytes, base64 encoded", dataKeySize)
+	}
+
+	tokenKey = key
+	return nil
+}
+
+// hashToken returns what the repositories store and look up instead of the
+// token value
+func hashToken(value string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSession stores a new access token and refresh token of family for the
+// user and returns them
+func newSession(user *User, family string) (*LoginResponse, error) {
+	now := clock.Now()
+
+	access := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: now.Add(accessTokenLifetime), Family: family}
+	var err error
+	if signingKeys != nil {
+		access.Value, err = signToken(&tokenClaims{ID: access.Value,
+			UserID:   user.ID,
+			RoleID:   user.Role.ID(),
+			Family:   family,
+			IssuedAt: now.Unix(),
+			Expires:  access.Expires.Unix()})
+	} else {
+		err = repository.SetToken(&access)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := RefreshToken{UserID: user.ID, Value: GetRandomString(32, ""), Family: family, Expires: now.Add(refreshTokenLifetime)}
+	err = repository.SetRefreshToken(&refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := LoginResult{ID: user.ID,
+		EmailAddress: user.EmailAddress,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		Role:         user.Role}
+	lResp := LoginResponse{Token: access.Value,
+		TokenExpiry:        int(accessTokenLifetime / time.Second),
+		RefreshToken:       refresh.Value,
+		RefreshTokenExpiry: int(refreshTokenLifetime / time.Second),
+		Result:             lr}
+
+	return &lResp, nil
+}
+
+// revokeFamily ends the session of family.  Signed access tokens cannot be
+// deleted, the family is revoked until the last of them has expired.
+func revokeFamily(family string) error {
+	err := repository.RevokeTokenFamily(family)
+	if err != nil || signingKeys == nil {
+		return err
+	}
+
+	return revoke(family, clock.Now().Add(accessTokenLifetime))
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshSession exchanges a refresh token for new tokens.  The old access
+// token stays valid until it expires.
+func refreshSession(u *url.URL, h http.Header, request *refreshRequest, context *BasicContext) (int, http.Header, *LoginResponse, error) {
+	var err error
+	defer CatchPanic(&err, "refreshSession")
+
+	log.Printf("refreshSession called: %s %s", context.RemoteAddr, context.UserAgent)
+
+	if request.RefreshToken == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a refresh token")
+	}
+
+	token, err := repository.UseRefreshToken(request.RefreshToken)
+	if err == ErrRefreshTokenReused {
+		log.Printf("Refresh token of user %d used again, revoking family %s", token.UserID, token.Family)
+		if err := revokeFamily(token.Family); err != nil {
+			log.Printf("Unable to revoke token family %s: %v", token.Family, err)
+			return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+		}
+		return http.StatusUnauthorized, nil, nil, errors.New("Invalid refresh token")
+	}
+	if err == ErrNotFound {
+		return http.StatusUnauthorized, nil, nil, errors.New("Invalid refresh token")
+	}
+	if err != nil {
+		log.Printf("Error:  Unable to use refresh token: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	user, err := repository.GetUser(token.UserID)
+	if err != nil {
+		log.Printf("Error:  Unable to get user from repo: %v", err)
+		return http.StatusUnauthorized, nil, nil, errors.New("Invalid refresh token")
+	}
+
+	response, err := newSession(user, token.Family)
+	if err != nil {
+		log.Printf("Error:  Unable to store tokens: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	// All good!
+	return http.StatusOK, nil, response, nil
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postTestSession posts the JSON body to a session endpoint and returns the
+// status and the tokens handed out
+func postTestSession(t *testing.T, url string, body interface{}) (int, *LoginResponse) {
+	requestBytes, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	response, err := client.Post(url, "application/json", bytes.NewBuffer(requestBytes))
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, nil
+	}
+
+	var session LoginResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	return response.StatusCode, &session
+}
+
+func TestInitSessions(t *testing.T) {
+	defer func(key []byte, access, refresh time.Duration) {
+		tokenKey, accessTokenLifetime, refreshTokenLifetime = key, access, refresh
+	}(tokenKey, accessTokenLifetime, refreshTokenLifetime)
+
+	// The key is required
+	t.Setenv("KIRON_TOKEN_KEY", "")
+	require.Error(t, InitSessions())
+
+	key := make([]byte, dataKeySize)
+	key[0] = 42
+	t.Setenv("KIRON_TOKEN_KEY", base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, InitSessions())
+	require.Equal(t, key, tokenKey)
+
+	t.Setenv("KIRON_TOKEN_KEY", base64.StdEncoding.EncodeToString(key[:16]))
+	require.Error(t, InitSessions())
+	t.Setenv("KIRON_TOKEN_KEY", base64.StdEncoding.EncodeToString(key))
+
+	t.Setenv("KIRON_ACCESS_TOKEN_LIFETIME", "15m")
+	t.Setenv("KIRON_REFRESH_TOKEN_LIFETIME", "8h")
+	require.NoError(t, InitSessions())
+	require.Equal(t, 15*time.Minute, accessTokenLifetime)
+	require.Equal(t, 8*time.Hour, refreshTokenLifetime)
+
+	t.Setenv("KIRON_REFRESH_TOKEN_LIFETIME", "10m")
+	require.Error(t, InitSessions())
+
+	t.Setenv("KIRON_ACCESS_TOKEN_LIFETIME", "forever")
+	require.Error(t, InitSessions())
+}
+
+func TestHashToken(t *testing.T) {
+	defer func(key []byte) { tokenKey = key }(tokenKey)
+
+	tokenKey = make([]byte, dataKeySize)
+	hash := hashToken("abcdefghijklmnop")
+	require.Len(t, hash, 64)
+	require.Equal(t, hash, hashToken("abcdefghijklmnop"))
+	require.NotEqual(t, hash, hashToken("abcdefghijklmnoq"))
+
+	// Another key, another hash
+	tokenKey = make([]byte, dataKeySize)
+	tokenKey[0] = 1
+	require.NotEqual(t, hash, hashToken("abcdefghijklmnop"))
+}
+
+func TestTokensAreHashed(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	user := createTestUser(t, repo, RoleApplication)
+	status, login := postTestSession(t, fmt.Sprintf("%s/api/v1/login", server.URL), loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+
+	response := doTestRequest(t, "GET", fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID), login.Token, "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	status, refreshed := postTestSession(t, fmt.Sprintf("%s/api/v1/token/refresh", server.URL), refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusOK, status)
+
+	// Neither the repository nor the log have seen a token
+	memory := repo.(*memoryRepository)
+	memory.mu.RLock()
+	for hash, token := range memory.tokens {
+		require.Empty(t, token.Value)
+		require.NotEqual(t, login.Token, hash)
+	}
+	for hash, token := range memory.refreshTokens {
+		require.Empty(t, token.Value)
+		require.NotEqual(t, login.RefreshToken, hash)
+	}
+	_, ok := memory.tokens[hashToken(refreshed.Token)]
+	require.True(t, ok)
+	memory.mu.RUnlock()
+
+	response = doTestRequest(t, "POST", fmt.Sprintf("%s/api/v1/logout", server.URL), refreshed.Token, "{}")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	for _, value := range []string{login.Token, login.RefreshToken, refreshed.Token, refreshed.RefreshToken} {
+		require.NotContains(t, logged.String(), value)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+
+	user := createTestUser(t, repo, RoleTrustedHelper)
+	loginURL := fmt.Sprintf("%s/api/v1/login", server.URL)
+	refreshURL := fmt.Sprintf("%s/api/v1/token/refresh", server.URL)
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID)
+
+	status, login := postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 3600, login.TokenExpiry)
+	require.Equal(t, int(refreshTokenLifetime/time.Second), login.RefreshTokenExpiry)
+	require.NotEmpty(t, login.RefreshToken)
+
+	// The session slides along as long as it is refreshed
+	session := login
+	for i := 0; i < 3; i++ {
+		fake.Advance(50 * time.Minute)
+
+		var refreshed *LoginResponse
+		status, refreshed = postTestSession(t, refreshURL, refreshRequest{RefreshToken: session.RefreshToken})
+		require.Equal(t, http.StatusOK, status)
+		require.NotEqual(t, session.Token, refreshed.Token)
+		require.NotEqual(t, session.RefreshToken, refreshed.RefreshToken)
+		require.Equal(t, user.ID, refreshed.Result.ID)
+		require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, refreshed.Token, "").StatusCode)
+
+		session = refreshed
+	}
+
+	// The first access token has long expired
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+
+	// Using a refresh token again gives the whole session away
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, session.Token, "").StatusCode)
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: session.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// Other sessions of the user are not affected
+	status, other := postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: other.RefreshToken})
+	require.Equal(t, http.StatusOK, status)
+
+	// Refresh tokens expire
+	status, login = postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	fake.Advance(refreshTokenLifetime)
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: "made up"})
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = postTestSession(t, refreshURL, refreshRequest{})
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestLogoutRevokesRefreshToken(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	user := createTestUser(t, repo, RoleApplication)
+
+	status, login := postTestSession(t, fmt.Sprintf("%s/api/v1/login", server.URL), loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+
+	response := doTestRequest(t, "POST", fmt.Sprintf("%s/api/v1/logout", server.URL), login.Token, "{}")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	status, _ = postTestSession(t, fmt.Sprintf("%s/api/v1/token/refresh", server.URL), refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+}
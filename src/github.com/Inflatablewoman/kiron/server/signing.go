@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With KIRON_SIGNING_KEYS access tokens are not stored but signed.  They are
+// "header.claims.signature" like a JWT, all three base64url encoded, and are
+// checked without asking the repository.  Refresh tokens are stored either
+// way.
+const signingAlgorithm = "EdDSA"
+
+// signingKeys are Ed25519 seeds by key id, the current key signs.  Without
+// signing keys access tokens are stored in the repository.
+var signingKeys *keyRing
+
+// ErrInvalidSignedToken is returned for signed tokens that have been tampered
+// with, are signed by an unknown key or have expired
+var ErrInvalidSignedToken = errors.New("Invalid signed token")
+
+// tokenHeader says how a token is signed
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// tokenClaims is what a signed token says about its user
+type tokenClaims struct {
+	ID       string `json:"jti"`
+	UserID   int    `json:"sub"`
+	RoleID   int    `json:"role"`
+	Family   string `json:"fam,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// initSigningKeys reads the signing keys from KIRON_SIGNING_KEYS,
+// "id:base64,id:base64,..." of 32 byte seeds.  The first key is the current
+// one, the others are only used to check tokens signed before a rotation.
+func initSigningKeys() error {
+	config := os.Getenv("KIRON_SIGNING_KEYS")
+	if config == "" {
+		signingKeys = nil
+		return nil
+	}
+
+	ring, err := parseKeyRing("Signing", config)
+	if err != nil {
+		return err
+	}
+
+	signingKeys = ring
+	return loadRevocations()
+}
+
+// isSignedToken tells signed tokens from stored ones, which have no dots
+func isSignedToken(value string) bool {
+	return strings.Count(value, ".") == 2
+}
+
+// signToken returns the claims signed with the current signing key
+func signToken(claims *tokenClaims) (string, error) {
+	header, err := json.Marshal(tokenHeader{Algorithm: signingAlgorithm, Type: "JWT", KeyID: signingKeys.current})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	key := ed25519.NewKeyFromSeed(signingKeys.keys[signingKeys.current])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed))), nil
+}
+
+// verifyToken checks the signature and expiry of a signed token and returns
+// its claims.  Revocation is up to the caller.
+func verifyToken(value string) (*tokenClaims, error) {
+	if signingKeys == nil || !isSignedToken(value) {
+		return nil, ErrInvalidSignedToken
+	}
+
+	parts := strings.Split(value, ".")
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Algorithm != signingAlgorithm {
+		return nil, ErrInvalidSignedToken
+	}
+
+	seed, ok := signingKeys.keys[header.KeyID]
+	if !ok {
+		return nil, ErrInvalidSignedToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if !ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidSignedToken
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, ErrInvalidSignedToken
+	}
+	if claims.Expires <= clock.Now().Unix() {
+		return nil, ErrInvalidSignedToken
+	}
+
+	return &claims, nil
+}
+
+// decodeTokenPart decodes a base64url encoded JSON part of a token, unknown
+// fields are refused
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// revocationList holds the ids of signed tokens and token families that are
+// revoked until they expire.  It is kept in the repository too, so it
+// survives a restart and reaches other kiron processes with the janitor.
+type revocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+// revocations is consulted for every signed token
+var revocations = &revocationList{revoked: make(map[string]time.Time)}
+
+// isRevoked tells whether any of the ids is revoked
+func (l *revocationList) isRevoked(ids ...string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, ok := l.revoked[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *revocationList) add(id string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.revoked[id] = expires
+}
+
+// replace swaps the list for the revocations in the repository
+func (l *revocationList) replace(tokens []*RevokedToken) {
+	revoked := make(map[string]time.Time, len(tokens))
+	for _, token := range tokens {
+		revoked[token.ID] = token.Expires
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.revoked = revoked
+}
+
+// revoke puts the id of a signed token or a token family on the revocation
+// list until the tokens have expired anyway
+func revoke(id string, expires time.Time) error {
+	err := repository.RevokeToken(&RevokedToken{ID: id, Expires: expires})
+	if err != nil {
+		return err
+	}
+
+	revocations.add(id, expires)
+	return nil
+}
+
+// loadRevocations reads the revocation list from the repository
+func loadRevocations() error {
+	tokens, err := repository.GetRevokedTokens()
+	if err != nil {
+		return err
+	}
+
+	revocations.replace(tokens)
+	log.Printf("Loaded %d revoked tokens", len(tokens))
+	return nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useSigningKeys switches to signed access tokens until the test is done
+func useSigningKeys(t *testing.T, ids ...string) *keyRing {
+	ring, _ := testKeyRing(t, ids...)
+
+	previous, previousRevocations := signingKeys, revocations
+	signingKeys = ring
+	revocations = &revocationList{revoked: make(map[string]time.Time)}
+	t.Cleanup(func() { signingKeys, revocations = previous, previousRevocations })
+
+	return ring
+}
+
+func testClaims() *tokenClaims {
+	now := clock.Now()
+	return &tokenClaims{ID: GetRandomString(16, ""),
+		UserID:   42,
+		RoleID:   RoleTrustedHelper.ID(),
+		Family:   GetRandomString(16, ""),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(time.Hour).Unix()}
+}
+
+func TestSignToken(t *testing.T) {
+	fake := useFakeClock(t, time.Now().UTC())
+	ring := useSigningKeys(t, "2017")
+
+	claims := testClaims()
+	token, err := signToken(claims)
+	require.NoError(t, err)
+	require.True(t, isSignedToken(token))
+
+	verified, err := verifyToken(token)
+	require.NoError(t, err)
+	require.Equal(t, claims, verified)
+
+	parts := strings.Split(token, ".")
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	require.JSONEq(t, `{"alg": "EdDSA", "typ": "JWT", "kid": "2017"}`, string(header))
+
+	// Tampered with
+	tampered := *claims
+	tampered.RoleID = RoleAdmin.ID()
+	forged, err := signToken(&tampered)
+	require.NoError(t, err)
+	for _, invalid := range []string{
+		parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+		parts[0] + "." + parts[1] + ".",
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"2017"}`)) + "." + parts[1] + "." + parts[2],
+		"a.b.c",
+		GetRandomString(16, ""),
+	} {
+		_, err = verifyToken(invalid)
+		require.Equal(t, ErrInvalidSignedToken, err, invalid)
+	}
+
+	// Tokens of the old key are good after a rotation, new ones are signed
+	// with the new key
+	rotated, _ := testKeyRing(t, "2018")
+	rotated.keys["2017"] = ring.keys["2017"]
+	signingKeys = rotated
+
+	_, err = verifyToken(token)
+	require.NoError(t, err)
+	newToken, err := signToken(claims)
+	require.NoError(t, err)
+	require.NotEqual(t, token, newToken)
+	_, err = verifyToken(newToken)
+	require.NoError(t, err)
+
+	// Until the old key is dropped
+	delete(rotated.keys, "2017")
+	_, err = verifyToken(token)
+	require.Equal(t, ErrInvalidSignedToken, err)
+
+	// And they expire
+	fake.Advance(time.Hour)
+	_, err = verifyToken(newToken)
+	require.Equal(t, ErrInvalidSignedToken, err)
+}
+
+func TestSignedSession(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	useSigningKeys(t, "2017")
+
+	user := createTestUser(t, repo, RoleTrustedHelper)
+	loginURL := fmt.Sprintf("%s/api/v1/login", server.URL)
+	refreshURL := fmt.Sprintf("%s/api/v1/token/refresh", server.URL)
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID)
+
+	status, login := postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, isSignedToken(login.Token))
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+
+	claims, err := verifyToken(login.Token)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, claims.UserID)
+	require.Equal(t, RoleTrustedHelper, roleFromID(claims.RoleID))
+
+	// Access tokens are not stored
+	memory := repo.(*memoryRepository)
+	memory.mu.RLock()
+	require.Empty(t, memory.tokens)
+	memory.mu.RUnlock()
+
+	// Logging out revokes the token and its refresh token
+	response := doTestRequest(t, "POST", fmt.Sprintf("%s/api/v1/logout", server.URL), login.Token, "{}")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	revoked, err := repo.GetRevokedTokens()
+	require.NoError(t, err)
+	var ids []string
+	for _, token := range revoked {
+		ids = append(ids, token.ID)
+	}
+	require.Contains(t, ids, claims.ID)
+	require.Contains(t, ids, claims.Family)
+
+	// Reusing a refresh token revokes the signed tokens of the family
+	status, login = postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	status, refreshed := postTestSession(t, refreshURL, refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, isSignedToken(refreshed.Token))
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, refreshed.Token, "").StatusCode)
+
+	status, _ = postTestSession(t, refreshURL, refreshRequest{RefreshToken: login.RefreshToken})
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, refreshed.Token, "").StatusCode)
+
+	// The revocations survive a restart
+	revocations = &revocationList{revoked: make(map[string]time.Time)}
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, refreshed.Token, "").StatusCode)
+	require.NoError(t, loadRevocations())
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, refreshed.Token, "").StatusCode)
+
+	// Stored tokens from before signing keys were configured still work
+	stored := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: time.Now().UTC().Add(time.Hour)}
+	require.NoError(t, repo.SetToken(&stored))
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, stored.Value, "").StatusCode)
+
+	// Signed tokens are refused once signing keys are dropped
+	status, login = postTestSession(t, loginURL, loginRequest{EmailAddress: user.EmailAddress, Password: "westEndGirls"})
+	require.Equal(t, http.StatusOK, status)
+	signingKeys = nil
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, login.Token, "").StatusCode)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// Clock tells the time and waits for it.  Tests replace clock to move time
+// along without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time, in UTC
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock is used for token expiry and the background tasks
+var clock Clock = systemClock{}
+
+// Task runs in the background until it is stopped
+type Task struct {
+	name string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startTask calls run right away and then every interval, with the time of
+// the clock
+func startTask(name string, interval time.Duration, run func(now time.Time)) *Task {
+	task := &Task{name: name, stop: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(task.done)
+		for {
+			run(clock.Now())
+
+			select {
+			case <-task.stop:
+				return
+			case <-clock.After(interval):
+			}
+		}
+	}()
+
+	return task
+}
+
+// Stop stops the task and waits for a run in progress to finish.  Stopping a
+// nil task does nothing, so tasks that were never started can be stopped.
+func (t *Task) Stop() {
+	if t == nil {
+		return
+	}
+
+	close(t.stop)
+	<-t.done
+	log.Printf("Stopped %s", t.name)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when it is advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiter := fakeWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, waiter)
+	return waiter.c
+}
+
+// Advance moves the time along and wakes up everybody whose time has come
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var waiting []fakeWaiter
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.c <- c.now
+	}
+	c.waiters = waiting
+}
+
+// Waiting returns how many are waiting for the time to come
+func (c *fakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
+
+// useFakeClock replaces the clock until the test is done
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	fake := newFakeClock(now)
+
+	previous := clock
+	clock = fake
+	t.Cleanup(func() { clock = previous })
+
+	return fake
+}
+
+// waitFor waits up to a second for a background task to make done true
+func waitFor(t *testing.T, done func() bool) {
+	for deadline := time.Now().Add(time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Gave up waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartTask(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC))
+
+	runs := make(chan time.Time, 10)
+	task := startTask("test task", time.Hour, func(now time.Time) { runs <- now })
+
+	// Right away
+	require.Equal(t, fake.Now(), <-runs)
+
+	// And after every interval
+	for i := 0; i < 3; i++ {
+		waitFor(t, func() bool { return fake.Waiting() == 1 })
+		fake.Advance(30 * time.Minute)
+		require.Empty(t, runs)
+
+		fake.Advance(30 * time.Minute)
+		require.Equal(t, fake.Now(), <-runs)
+	}
+
+	task.Stop()
+	require.Empty(t, runs)
+
+	// Tasks that were never started can be stopped too
+	var none *Task
+	none.Stop()
+}
+
+func TestTokenJanitor(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	start := time.Now().UTC()
+	fake := useFakeClock(t, start)
+
+	user := createTestUser(t, repo, RoleApplication)
+	short := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: start.Add(5 * time.Minute)}
+	require.NoError(t, repo.SetToken(&short))
+	long := Token{UserID: user.ID, Value: GetRandomString(16, ""), Expires: start.Add(3 * time.Hour)}
+	require.NoError(t, repo.SetToken(&long))
+
+	userURL := fmt.Sprintf("%s/api/v1/users/%d", server.URL, user.ID)
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, short.Value, "").StatusCode)
+
+	janitor, err := StartTokenJanitor()
+	require.NoError(t, err)
+	defer func() { janitor.Stop() }()
+
+	// Expired tokens are refused before the janitor gets to them
+	waitFor(t, func() bool { return fake.Waiting() == 1 })
+	fake.Advance(defaultJanitorInterval / 2)
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, short.Value, "").StatusCode)
+	require.Equal(t, http.StatusOK, doTestRequest(t, "GET", userURL, long.Value, "").StatusCode)
+
+	memory := repo.(*memoryRepository)
+	tokens := func() int {
+		memory.mu.RLock()
+		defer memory.mu.RUnlock()
+		return len(memory.tokens)
+	}
+	require.Equal(t, 2, tokens())
+
+	fake.Advance(defaultJanitorInterval / 2)
+	waitFor(t, func() bool { return tokens() == 1 })
+
+	// Stopping waits for the janitor
+	janitor.Stop()
+	janitor = nil
+
+	fake.Advance(4 * time.Hour)
+	require.Equal(t, 1, tokens())
+	require.Equal(t, http.StatusUnauthorized, doTestRequest(t, "GET", userURL, long.Value, "").StatusCode)
+}
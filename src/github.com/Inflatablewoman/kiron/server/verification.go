@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+var (
+	// emailVerificationLifetime is how long the link in a verification mail
+	// works, another one can be asked for after that
+	emailVerificationLifetime = 48 * time.Hour
+
+	// emailVerificationResendInterval is how long a user has to wait for
+	// another verification mail, so kiron cannot be used to flood a mailbox
+	emailVerificationResendInterval = 5 * time.Minute
+)
+
+// isPlainEmailAddress accepts a plain address such as "neil@example.com",
+// without a name or angle brackets
+func isPlainEmailAddress(emailAddress string) bool {
+	address, err := mail.ParseAddress(emailAddress)
+	return err == nil && address.Name == "" && address.Address == emailAddress
+}
+
+// sendEmailVerification mails a link to verify the email address of the user
+func sendEmailVerification(user *User) error {
+	now := clock.Now()
+	verification := EmailVerification{UserID: user.ID, Value: GetRandomString(32, ""), Created: now, Expires: now.Add(emailVerificationLifetime)}
+	err := repository.AddEmailVerification(&verification)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify?token=" + url.QueryEscape(verification.Value)
+	sendMail(&Mail{To: user.EmailAddress,
+		Subject: "Please verify your email address for kiron",
+		Body: fmt.Sprintf("Hello %s,\n\nwelcome to kiron!  To verify your email address and log in open\n\n%s\n\n"+
+			"The link works once within %s.  If you did not sign up, you can ignore this mail.\n", user.FirstName, link, emailVerificationLifetime)})
+
+	log.Printf("Sent email verification %d to user %d", verification.ID, user.ID)
+	return nil
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// verifyEmail marks the email address of a user as verified with the token
+// of a verification mail
+func verifyEmail(u *url.URL, h http.Header, request *verifyEmailRequest, context *BasicContext) (int, http.Header, interface{}, error) {
+	var err error
+	defer CatchPanic(&err, "verifyEmail")
+
+	log.Printf("verifyEmail called: %s %s", context.RemoteAddr, context.UserAgent)
+
+	if request.Token == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide a verification token")
+	}
+
+	verification, err := repository.VerifyEmail(request.Token)
+	if err == ErrNotFound {
+		return http.StatusUnauthorized, nil, nil, errors.New("Invalid or expired verification token")
+	}
+	if err != nil {
+		log.Printf("Error:  Unable to verify email address: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	log.Printf("Verified email address of user %d", verification.UserID)
+
+	// All good!
+	return http.StatusOK, nil, nil, nil
+}
+
+type resendVerificationRequest struct {
+	EmailAddress string `json:"email"`
+}
+
+// resendVerification mails another verification link to a user that has not
+// verified yet.  Like forgotPassword the response does not tell whether a
+// mail was sent, also not while the user has to wait for the next one, and
+// the mail is sent in the background so known addresses take no longer.
+func resendVerification(u *url.URL, h http.Header, request *resendVerificationRequest, context *BasicContext) (int, http.Header, interface{}, error) {
+	var err error
+	defer CatchPanic(&err, "resendVerification")
+
+	log.Printf("resendVerification called: %s %s", context.RemoteAddr, context.UserAgent)
+
+	if request.EmailAddress == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("You must provide an email address")
+	}
+
+	user, err := repository.GetUserByEmail(request.EmailAddress)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error:  Unable to get user from repo: %v", err)
+		return http.StatusInternalServerError, nil, nil, errors.New("Internal error")
+	}
+
+	if user == nil {
+		log.Println("No email verification for unknown user")
+	} else {
+		go mailEmailVerification(user)
+	}
+
+	// All good!
+	return http.StatusOK, nil, nil, nil
+}
+
+// mailEmailVerification sends another verification mail to the user, unless
+// the address is verified already or the last mail was sent too recently.
+// Failures are only logged.
+func mailEmailVerification(user *User) {
+	if !user.Verified.IsZero() {
+		log.Printf("Email address of user %d is verified already", user.ID)
+		return
+	}
+
+	last, err := repository.GetLastEmailVerification(user.ID)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error:  Unable to get email verification: %v", err)
+		return
+	}
+	if last != nil && clock.Now().Before(last.Created.Add(emailVerificationResendInterval)) {
+		log.Printf("Not resending email verification to user %d so soon", user.ID)
+		return
+	}
+
+	err = sendEmailVerification(user)
+	if err != nil {
+		log.Printf("Error:  Unable to store email verification: %v", err)
+	}
+}
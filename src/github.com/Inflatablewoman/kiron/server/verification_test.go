@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postTestVerify verifies an email address with the token and returns the status
+func postTestVerify(t *testing.T, serverURL, token string) int {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/users/verify", "", fmt.Sprintf(`{"token": %q}`, token)).StatusCode
+}
+
+// postTestResend asks for another verification mail and returns the status
+func postTestResend(t *testing.T, serverURL, emailAddress string) int {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/users/verify/resend", "", fmt.Sprintf(`{"email": %q}`, emailAddress)).StatusCode
+}
+
+// postTestUser creates a user with the password "westEndGirls" and returns the status
+func postTestUser(t *testing.T, serverURL, emailAddress string) int {
+	return doTestRequest(t, "POST", serverURL+"/api/v1/users", "", fmt.Sprintf(`{"email": %q, "password": "westEndGirls", "name": "chris"}`, emailAddress)).StatusCode
+}
+
+func TestIsPlainEmailAddress(t *testing.T) {
+	for _, emailAddress := range []string{"neil@example.com", "neil.tennant+kiron@mail.example.com"} {
+		require.True(t, isPlainEmailAddress(emailAddress), emailAddress)
+	}
+	for _, emailAddress := range []string{"", "neil", "@example.com", "Neil <neil@example.com>", "<neil@example.com>", " neil@example.com", "neil@example.com\r\nBcc: chris@example.com"} {
+		require.False(t, isPlainEmailAddress(emailAddress), emailAddress)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+
+	require.Equal(t, http.StatusBadRequest, postTestUser(t, server.URL, "not an address"))
+	requireNoTestMail(t)
+
+	emailAddress := fmt.Sprintf("test_%s@example.com", GetRandomString(8, ""))
+	require.Equal(t, http.StatusOK, postTestUser(t, server.URL, emailAddress))
+	first := nextTestMail(t)
+	require.Equal(t, emailAddress, first.To)
+
+	// Unverified users are refused, but only with the right password
+	require.Equal(t, http.StatusUnauthorized, postTestLogin(t, server.URL, emailAddress, "wrong").StatusCode)
+	require.Equal(t, http.StatusForbidden, postTestLogin(t, server.URL, emailAddress, "westEndGirls").StatusCode)
+
+	// Another mail has to wait, the response does not tell
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, emailAddress))
+	requireNoTestMail(t)
+	fake.Advance(emailVerificationResendInterval)
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, emailAddress))
+	second := nextTestMail(t)
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, emailAddress))
+	requireNoTestMail(t)
+
+	require.Equal(t, http.StatusBadRequest, postTestVerify(t, server.URL, ""))
+	require.Equal(t, http.StatusUnauthorized, postTestVerify(t, server.URL, "made up"))
+
+	// Any of the links verifies, once
+	require.Equal(t, http.StatusOK, postTestVerify(t, server.URL, tokenFromMail(t, "/verify", first)))
+	require.Equal(t, http.StatusUnauthorized, postTestVerify(t, server.URL, tokenFromMail(t, "/verify", second)))
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, emailAddress, "westEndGirls").StatusCode)
+
+	user, err := repo.GetUserByEmail(emailAddress)
+	require.NoError(t, err)
+	require.WithinDuration(t, fake.Now(), user.Verified, time.Second)
+
+	// Verified and unknown users get no mail
+	fake.Advance(emailVerificationResendInterval)
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, emailAddress))
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, "nobody@example.com"))
+	require.Equal(t, http.StatusBadRequest, postTestResend(t, server.URL, ""))
+	requireNoTestMail(t)
+}
+
+func TestEmailVerificationExpires(t *testing.T) {
+	server, _ := newTestServer(t)
+	defer server.Close()
+
+	fake := useFakeClock(t, time.Now().UTC())
+
+	emailAddress := fmt.Sprintf("test_%s@example.com", GetRandomString(8, ""))
+	require.Equal(t, http.StatusOK, postTestUser(t, server.URL, emailAddress))
+	token := tokenFromMail(t, "/verify", nextTestMail(t))
+
+	fake.Advance(emailVerificationLifetime)
+	require.Equal(t, http.StatusUnauthorized, postTestVerify(t, server.URL, token))
+	require.Equal(t, http.StatusForbidden, postTestLogin(t, server.URL, emailAddress, "westEndGirls").StatusCode)
+
+	require.Equal(t, http.StatusOK, postTestResend(t, server.URL, emailAddress))
+	require.Equal(t, http.StatusOK, postTestVerify(t, server.URL, tokenFromMail(t, "/verify", nextTestMail(t))))
+	require.Equal(t, http.StatusOK, postTestLogin(t, server.URL, emailAddress, "westEndGirls").StatusCode)
+}
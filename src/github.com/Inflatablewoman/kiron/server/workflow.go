@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// status is the state of an application in the review workflow.  The values
+// are the labels of the status type in the database.
+type status string
+
+// Stati of an application
+const (
+	statusReceived           status = "received"
+	statusConfirmed          status = "confirmed"
+	statusInVerification     status = "in verification"
+	statusVerified           status = "verified"
+	statusWaitingForResponse status = "waiting for response"
+	statusRejected           status = "rejected"
+	statusAccepted           status = "accepted"
+)
+
+// Allowed stati
+var allowedStati = []status{statusReceived, statusConfirmed, statusInVerification, statusVerified, statusWaitingForResponse, statusRejected, statusAccepted}
+
+// roleReviewers may move an application through verification
+const roleReviewers = RoleAdmin | RoleSubAdmin | RoleTrustedHelper
+
+// roleDeciders may accept or reject an application
+const roleDeciders = RoleAdmin | RoleSubAdmin
+
+// transition is a legal change of status and the roles allowed to make it
+type transition struct {
+	From           status
+	To             status
+	Roles          role
+	ReasonRequired bool
+}
+
+// transitions lists every status change the workflow allows.  Rejected and
+// accepted are final.
+var transitions = []transition{
+	{From: statusReceived, To: statusConfirmed, Roles: roleReviewers},
+	{From: statusConfirmed, To: statusInVerification, Roles: roleReviewers},
+	{From: statusInVerification, To: statusVerified, Roles: roleReviewers},
+	{From: statusVerified, To: statusWaitingForResponse, Roles: roleDeciders},
+	{From: statusWaitingForResponse, To: statusAccepted, Roles: roleDeciders},
+
+	{From: statusReceived, To: statusRejected, Roles: roleDeciders, ReasonRequired: true},
+	{From: statusConfirmed, To: statusRejected, Roles: roleDeciders, ReasonRequired: true},
+	{From: statusInVerification, To: statusRejected, Roles: roleDeciders, ReasonRequired: true},
+	{From: statusVerified, To: statusRejected, Roles: roleDeciders, ReasonRequired: true},
+	{From: statusWaitingForResponse, To: statusRejected, Roles: roleDeciders, ReasonRequired: true},
+}
+
+// Errors returned when a status change is refused
+var (
+	ErrUnknownStatus          = errors.New("Unknown status")
+	ErrIllegalTransition      = errors.New("Status change is not allowed by the workflow")
+	ErrTransitionNotPermitted = errors.New("Role may not make this status change")
+	ErrReasonRequired         = errors.New("A reason is required for this status change")
+	ErrStatusConflict         = errors.New("Application status has been changed by somebody else")
+)
+
+// validStatus returns true for the stati of the workflow
+func validStatus(s status) bool {
+	for _, allowed := range allowedStati {
+		if s == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRank returns the position of s in the workflow
+func statusRank(s status) int {
+	for i, allowed := range allowedStati {
+		if s == allowed {
+			return i
+		}
+	}
+	return len(allowedStati)
+}
+
+// newStatusChange checks that user may move application to the status and
+// returns the change to store
+func newStatusChange(application *Application, to status, user *User, reason string, changed time.Time) (*StatusChange, error) {
+	from := status(application.Status)
+	if !validStatus(to) {
+		return nil, ErrUnknownStatus
+	}
+
+	for _, t := range transitions {
+		if t.From != from || t.To != to {
+			continue
+		}
+
+		if !user.Role.has(t.Roles) {
+			return nil, ErrTransitionNotPermitted
+		}
+
+		reason = strings.TrimSpace(reason)
+		if t.ReasonRequired && reason == "" {
+			return nil, ErrReasonRequired
+		}
+
+		change := StatusChange{ApplicationID: application.ID, From: string(from), To: string(to), UserID: user.ID, Reason: reason, Changed: changed}
+		return &change, nil
+	}
+
+	return nil, ErrIllegalTransition
+}
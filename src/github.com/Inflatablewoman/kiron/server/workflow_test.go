@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatusChange(t *testing.T) {
+	admin := &User{ID: 1, Role: RoleAdmin}
+	trusted := &User{ID: 2, Role: RoleTrustedHelper}
+	limited := &User{ID: 3, Role: RoleLimitedHelper}
+	applicant := &User{ID: 4, Role: RoleApplication}
+
+	cases := []struct {
+		from   status
+		to     status
+		user   *User
+		reason string
+		err    error
+	}{
+		{statusReceived, statusConfirmed, trusted, "", nil},
+		{statusReceived, statusConfirmed, limited, "", ErrTransitionNotPermitted},
+		{statusReceived, statusConfirmed, applicant, "", ErrTransitionNotPermitted},
+		{statusReceived, statusAccepted, admin, "", ErrIllegalTransition},
+		{statusConfirmed, statusInVerification, trusted, "", nil},
+		{statusInVerification, statusVerified, trusted, "", nil},
+		{statusVerified, statusWaitingForResponse, trusted, "", ErrTransitionNotPermitted},
+		{statusVerified, statusWaitingForResponse, admin, "", nil},
+		{statusWaitingForResponse, statusAccepted, admin, "", nil},
+		{statusWaitingForResponse, statusRejected, admin, "", ErrReasonRequired},
+		{statusWaitingForResponse, statusRejected, admin, "   ", ErrReasonRequired},
+		{statusWaitingForResponse, statusRejected, admin, "no documents", nil},
+		{statusReceived, statusRejected, trusted, "no documents", ErrTransitionNotPermitted},
+		{statusAccepted, statusRejected, admin, "changed my mind", ErrIllegalTransition},
+		{statusRejected, statusReceived, admin, "", ErrIllegalTransition},
+		{statusReceived, status("inVerfication"), admin, "", ErrUnknownStatus},
+	}
+
+	changed := time.Now().UTC()
+	for _, c := range cases {
+		application := &Application{ID: 7, Status: string(c.from)}
+
+		change, err := newStatusChange(application, c.to, c.user, c.reason, changed)
+		require.Equal(t, c.err, err, "%s -> %s as %d", c.from, c.to, c.user.Role)
+
+		if err == nil {
+			require.Equal(t, StatusChange{ApplicationID: 7, From: string(c.from), To: string(c.to), UserID: c.user.ID, Reason: c.reason, Changed: changed}, *change)
+		}
+	}
+}
+
+func TestChangeApplicationStatus(t *testing.T) {
+	server, repo := newTestServer(t)
+	defer server.Close()
+
+	admin := createTestUser(t, repo, RoleAdmin)
+	adminToken := loginTestUser(t, repo, admin)
+
+	applicant := createTestUser(t, repo, RoleApplication)
+	applicantToken := loginTestUser(t, repo, applicant)
+	appl := createTestApplication(t, repo, applicant.ID)
+
+	statusURL := fmt.Sprintf("%s/api/v1/users/%d/application/status", server.URL, applicant.ID)
+
+	// Applicants cannot change their own status
+	response := doTestRequest(t, "POST", statusURL, applicantToken, `{"status": "confirmed"}`)
+	require.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	// No shortcuts
+	response = doTestRequest(t, "POST", statusURL, adminToken, `{"status": "accepted"}`)
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+
+	response = doTestRequest(t, "POST", statusURL, adminToken, `{"status": "unheard of"}`)
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	for _, s := range []status{statusConfirmed, statusInVerification, statusVerified, statusWaitingForResponse} {
+		response = doTestRequest(t, "POST", statusURL, adminToken, fmt.Sprintf(`{"status": %q}`, s))
+		require.Equal(t, http.StatusOK, response.StatusCode, "to %s", s)
+	}
+
+	response = doTestRequest(t, "POST", statusURL, adminToken, `{"status": "rejected"}`)
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response = doTestRequest(t, "POST", statusURL, adminToken, `{"status": "rejected", "reason": "study program is full"}`)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	repoAppl, err := repo.GetApplication(appl.ID)
+	require.NoError(t, err)
+	require.Equal(t, string(statusRejected), repoAppl.Status)
+	require.Equal(t, admin.ID, repoAppl.StatusChangedBy)
+	require.Equal(t, "study program is full", repoAppl.StatusReason)
+	require.WithinDuration(t, time.Now().UTC(), repoAppl.StatusChangedAt, time.Duration(5*time.Second))
+
+	// Rejected is final
+	response = doTestRequest(t, "POST", statusURL, adminToken, `{"status": "accepted"}`)
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+
+	// Every successful change is in the history
+	historyURL := fmt.Sprintf("%s/api/v1/users/%d/application/history", server.URL, applicant.ID)
+
+	response = doTestRequest(t, "GET", historyURL, applicantToken, "")
+	require.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	request, err := http.NewRequest("GET", historyURL, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+adminToken)
+
+	response, err = client.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var history []RestStatusChange
+	err = json.NewDecoder(response.Body).Decode(&history)
+	require.NoError(t, err)
+	require.Len(t, history, 5)
+
+	require.Equal(t, "received", history[0].From)
+	require.Equal(t, "confirmed", history[0].To)
+	require.Equal(t, admin.ID, history[0].UserID)
+
+	last := history[4]
+	require.Equal(t, "waiting for response", last.From)
+	require.Equal(t, "rejected", last.To)
+	require.Equal(t, "study program is full", last.Reason)
+	require.Equal(t, appl.ID, last.ApplicationID)
+}